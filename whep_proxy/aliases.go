@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Aliases are viewer-facing names for stream IDs: /whep/front-door serves
+// whatever stream front-door points to, so a camera can be renamed or failed
+// over without touching players. They come from WHEP_CONFIG_FILE's aliases,
+// and can be changed at runtime with PUT and DELETE /aliases/{name}, which
+// aren't persisted. An alias takes precedence over a stream of the same name,
+// and points straight at a stream, never at another alias.
+var (
+	aliasesMu sync.Mutex
+	aliases   = make(map[string]string)
+)
+
+// aliasTarget is the body of PUT /aliases/{name}.
+type aliasTarget struct {
+	StreamID string `json:"stream_id"`
+}
+
+// resolveAlias returns the stream ID name points to, if it's an alias.
+func resolveAlias(name string) (string, bool) {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	streamID, ok := aliases[name]
+	return streamID, ok
+}
+
+// loadAliases sets the aliases from WHEP_CONFIG_FILE at startup.
+func loadAliases(configured map[string]string) error {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+	for name, streamID := range configured {
+		aliases[name] = streamID
+	}
+	for _, name := range sortedSettings(aliases) {
+		if err := checkAlias(name, aliases[name]); err != nil {
+			return fmt.Errorf("alias %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// checkAlias rejects an alias that would chain to another alias, either way.
+// The caller must hold aliasesMu.
+func checkAlias(name, streamID string) error {
+	switch {
+	case streamID == "":
+		return errors.New("stream_id is required")
+	case streamID == name:
+		return errors.New("an alias can't point to itself")
+	}
+	if _, ok := aliases[streamID]; ok {
+		return fmt.Errorf("%s is an alias itself", streamID)
+	}
+	for other, target := range aliases {
+		if target == name && other != name {
+			return fmt.Errorf("alias %s already points to %s", other, name)
+		}
+	}
+	return nil
+}
+
+// aliasesHandler lists the aliases, by name.
+func aliasesHandler(w http.ResponseWriter, r *http.Request) {
+	aliasesMu.Lock()
+	snapshot := make(map[string]string, len(aliases))
+	for name, streamID := range aliases {
+		snapshot[name] = streamID
+	}
+	aliasesMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// aliasHandler points an alias at a stream (PUT) or removes it (DELETE).
+// Viewers already watching through it stay on their stream.
+func aliasHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if r.Method == http.MethodDelete {
+		aliasesMu.Lock()
+		_, ok := aliases[name]
+		delete(aliases, name)
+		aliasesMu.Unlock()
+		if !ok {
+			http.Error(w, fmt.Sprintf("Alias %s not found", name), http.StatusNotFound)
+			return
+		}
+		fmt.Printf("[WHEP_PROXY] Removed alias %s\n", name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var target aliasTarget
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&target); err != nil {
+		if isMaxBytesError(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid JSON alias", http.StatusBadRequest)
+		return
+	}
+	aliasesMu.Lock()
+	err := checkAlias(name, target.StreamID)
+	if err == nil {
+		aliases[name] = target.StreamID
+	}
+	aliasesMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Printf("[WHEP_PROXY] Alias %s now points to stream %s\n", name, target.StreamID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAliases adds the /aliases endpoints to r, behind adminOnly.
+func handleAliases(r *mux.Router) {
+	r.HandleFunc("/aliases", adminOnly(aliasesHandler)).Methods("GET")
+	r.HandleFunc("/aliases/{name}", adminOnly(aliasHandler)).Methods("PUT", "DELETE")
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type streamStats struct {
+	ID                  string        `json:"id"`
+	Name                string        `json:"name,omitempty"`
+	Packets             uint64        `json:"packets"`
+	Bytes               uint64        `json:"bytes"`
+	DuplicateCandidates uint64        `json:"duplicateCandidates"`
+	LastKeyframeAt      *time.Time    `json:"lastKeyframeAt"`
+	DisconnectedAt      *time.Time    `json:"disconnectedAt,omitempty"`
+	SignalingOpen       bool          `json:"signalingOpen"`
+	Reconnecting        bool          `json:"reconnecting"`
+	Dead                bool          `json:"dead"`
+	Reconnects          uint64        `json:"reconnects"`
+	CameraLatencyMs     *float64      `json:"cameraLatencyMs,omitempty"`
+	Error               string        `json:"error,omitempty"`
+	Degraded            string        `json:"degraded,omitempty"`
+	Viewers             []viewerStats `json:"viewers"`
+}
+
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	streamID := mux.Vars(r)["streamID"]
+
+	stream, ok := getStream(streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+
+	stats := streamStats{
+		ID:                  streamID,
+		Name:                stream.config.Name,
+		DuplicateCandidates: stream.duplicateCandidates.Load(),
+		Viewers:             stream.viewerStats(),
+		Error:               stream.ingestFailure(),
+		Reconnects:          stream.reconnects.Load(),
+	}
+	if nanos := stream.lastKeyframe.Load(); nanos != 0 {
+		lastKeyframeAt := time.Unix(0, nanos)
+		stats.LastKeyframeAt = &lastKeyframeAt
+	}
+	stream.mu.Lock()
+	stats.SignalingOpen = stream.signalingAlive
+	stats.Reconnecting = stream.reconnecting
+	stats.Dead = stream.dead
+	stats.Degraded = stream.degraded
+	stream.mu.Unlock()
+	if nanos := stream.disconnectedAt.Load(); nanos != 0 {
+		disconnectedAt := time.Unix(0, nanos)
+		stats.DisconnectedAt = &disconnectedAt
+	}
+	if latency, ok := stream.cameraLatency.value(); ok {
+		latencyMs := float64(latency) / float64(time.Millisecond)
+		stats.CameraLatencyMs = &latencyMs
+	}
+	for _, viewer := range stats.Viewers {
+		stats.Packets += viewer.Packets
+		stats.Bytes += viewer.Bytes
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func viewersHandler(w http.ResponseWriter, r *http.Request) {
+	streamID := mux.Vars(r)["streamID"]
+
+	stream, ok := getStream(streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stream.viewerInfo(streamID))
+}
+
+// keyframeHandler asks the camera for a new keyframe, to recover viewers whose
+// picture is stuck without reconnecting them.
+func keyframeHandler(w http.ResponseWriter, r *http.Request) {
+	streamID := mux.Vars(r)["streamID"]
+
+	stream, ok := getStream(streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+
+	log := requestLog(r)
+	if err := stream.requestKeyframe(); err != nil {
+		log.Printf("Error requesting keyframe for stream %s: %v\n", streamID, err)
+		if errors.Is(err, errNoIngestVideo) {
+			http.Error(w, fmt.Sprintf("Stream %s has no video to refresh", streamID), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Error requesting keyframe", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Requested keyframe for stream %s\n", streamID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// restartHandler renegotiates a stream's ingest for operators, through the
+// same path as an automatic reconnect: a new PeerConnection offered over the
+// open signaling connection, else a redial. Viewers stay connected throughout.
+// It also revives a dead stream, with a fresh WHEP_MAX_RECONNECT_ATTEMPTS.
+func restartHandler(w http.ResponseWriter, r *http.Request) {
+	streamID := mux.Vars(r)["streamID"]
+
+	stream, ok := getStream(streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+
+	stream.mu.Lock()
+	peerConnection, reconnecting := stream.peerConnection, stream.reconnecting
+	if stream.dead {
+		stream.dead = false
+		stream.failure = ""
+	}
+	stream.mu.Unlock()
+	switch {
+	case peerConnection == nil:
+		http.Error(w, fmt.Sprintf("Stream %s has no ingest to restart", streamID), http.StatusConflict)
+		return
+	case reconnecting:
+		http.Error(w, fmt.Sprintf("Stream %s is already reconnecting", streamID), http.StatusConflict)
+		return
+	}
+
+	requestLog(r).Printf("Restarting ingest for stream %s on request\n", streamID)
+	stream.reconnectAttempts.Store(0)
+	go reconnectIngest(streamID, stream, peerConnection)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// adminOnly requires the WHEP_ADMIN_TOKEN bearer token. Without one set, only
+// unix socket and loopback clients are let through.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			client := clientIP(r)
+			if ip := net.ParseIP(client); ip != nil && !ip.IsLoopback() {
+				http.Error(w, "Set WHEP_ADMIN_TOKEN to use this endpoint remotely", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// streamSDP is the ingest's current negotiation. Answer is null until the
+// camera has answered the offer, and both are null before the first offer.
+type streamSDP struct {
+	Offer  *string `json:"offer"`
+	Answer *string `json:"answer"`
+}
+
+// sdpHandler returns the ingest's local offer and the camera's answer, to
+// diagnose codec and candidate mismatches without debug logging.
+func sdpHandler(w http.ResponseWriter, r *http.Request) {
+	streamID := mux.Vars(r)["streamID"]
+
+	stream, ok := getStream(streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+
+	var sdp streamSDP
+	stream.mu.Lock()
+	if stream.peerConnection != nil {
+		if offer := stream.peerConnection.LocalDescription(); offer != nil {
+			sdp.Offer = &offer.SDP
+		}
+	}
+	if stream.remoteDescription != nil {
+		sdp.Answer = &stream.remoteDescription.SDP
+	}
+	stream.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(sdp)
+}
+
+// whepResourceHandler ends a single viewer session (WHEP DELETE), answering
+// with a summary of it for client-side logging.
+func whepResourceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	streamID := vars["streamID"]
+	viewerID := vars["viewerID"]
+
+	stream, ok := getStream(streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+
+	viewer, ok := stream.viewer(viewerID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Session %s not found", viewerID), http.StatusNotFound)
+		return
+	}
+
+	log := requestLog(r)
+	log.Printf("Closing viewer %s on stream %s\n", viewerID, streamID)
+	summary := viewer.summary()
+	stream.removeViewer(viewerID)
+	if err := viewer.peerConnection.Close(); err != nil {
+		log.Printf("Error closing viewer %s: %v\n", viewerID, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+// signalingBreaker stops stream registrations from hammering a signaling
+// endpoint that keeps failing to dial. After WHEP_BREAKER_THRESHOLD failures
+// within WHEP_BREAKER_WINDOW the endpoint is rejected for
+// WHEP_BREAKER_COOLDOWN, then a single trial dial is let through (half-open):
+// success closes the breaker, failure reopens it.
+type signalingBreaker struct {
+	mu        sync.Mutex
+	endpoints map[string]*breakerState
+}
+
+type breakerState struct {
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time
+	trial        bool // a half-open trial dial is in flight
+}
+
+var breaker = &signalingBreaker{endpoints: make(map[string]*breakerState)}
+
+// breakerEndpoint identifies a signaling URL without its userinfo or query,
+// which change per request for presigned URLs.
+func breakerEndpoint(signalingURL string) string {
+	parsedURL, err := url.Parse(signalingURL)
+	if err != nil {
+		return signalingURL
+	}
+	return parsedURL.Scheme + "://" + parsedURL.Host + parsedURL.Path
+}
+
+// allow reports whether a dial to endpoint may go ahead, and if not, how long
+// until the breaker half-opens.
+func (b *signalingBreaker) allow(endpoint string) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state, ok := b.endpoints[endpoint]
+	if !ok || state.openUntil.IsZero() {
+		return true, 0
+	}
+	if wait := time.Until(state.openUntil); wait > 0 {
+		breakerRejections.WithLabelValues(endpoint).Inc()
+		return false, wait
+	}
+	if state.trial {
+		breakerRejections.WithLabelValues(endpoint).Inc()
+		return false, breakerCooldown
+	}
+	state.trial = true
+	return true, 0
+}
+
+func (b *signalingBreaker) success(endpoint string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.endpoints[endpoint]; ok {
+		delete(b.endpoints, endpoint)
+		breakerOpen.WithLabelValues(endpoint).Set(0)
+	}
+}
+
+// failure records a failed dial, opening the breaker once the threshold is
+// reached or when a half-open trial fails. It reports whether the breaker
+// opened.
+func (b *signalingBreaker) failure(endpoint string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	state, ok := b.endpoints[endpoint]
+	if !ok || (state.openUntil.IsZero() && now.Sub(state.firstFailure) > breakerWindow) {
+		state = &breakerState{firstFailure: now}
+		b.endpoints[endpoint] = state
+	}
+	state.failures++
+	if state.trial || (state.openUntil.IsZero() && state.failures >= int(breakerThreshold)) {
+		state.trial = false
+		state.openUntil = now.Add(breakerCooldown)
+		breakerOpen.WithLabelValues(endpoint).Set(1)
+		breakerTrips.WithLabelValues(endpoint).Inc()
+		return true
+	}
+	return false
+}
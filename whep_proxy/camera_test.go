@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// fakeCamera is a KVS-style signaling server backed by a Pion PeerConnection
+// per offer, sending H264 with a keyframe every second.
+type fakeCamera struct {
+	t      *testing.T
+	server *httptest.Server
+	url    string
+
+	// Set before the first offer
+	silent           bool // never answers
+	candidatesFirst  bool // sends its candidates, then the answer without them
+	repeatCandidates bool // trickles each of its candidates twice after the answer
+	noVideo          bool // answers without a video track
+	audio            bool // also sends PCMU audio
+	fragmented       bool // sends each frame as FU-A fragments, see fragmentedFrame
+	answerSDP        func(string) string
+
+	mu     sync.Mutex
+	offers int
+	peers  []*webrtc.PeerConnection
+	conns  []*websocket.Conn
+}
+
+func newFakeCamera(t *testing.T, configure func(*fakeCamera)) *fakeCamera {
+	t.Helper()
+	camera := &fakeCamera{t: t}
+	if configure != nil {
+		configure(camera)
+	}
+	camera.server = httptest.NewServer(http.HandlerFunc(camera.serve))
+	camera.url = "ws" + strings.TrimPrefix(camera.server.URL, "http")
+	t.Cleanup(camera.close)
+	return camera
+}
+
+func (c *fakeCamera) serve(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	c.conns = append(c.conns, conn)
+	c.mu.Unlock()
+	var writeMu sync.Mutex
+	send := func(messageType string, payload interface{}) {
+		data, _ := json.Marshal(payload)
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.WriteJSON(SignalingResponse{
+			MessageType:    messageType,
+			MessagePayload: json.RawMessage(`"` + base64.StdEncoding.EncodeToString(data) + `"`),
+		})
+	}
+	for {
+		var request SignalingRequest
+		if err := conn.ReadJSON(&request); err != nil {
+			return
+		}
+		if request.Action != actionSDPOffer {
+			continue // trickled candidates; the camera finds the proxy by its checks
+		}
+		c.mu.Lock()
+		c.offers++
+		c.mu.Unlock()
+		if c.silent {
+			continue
+		}
+		answer, err := c.answer(request)
+		if err != nil {
+			c.t.Errorf("fake camera: %v", err)
+			return
+		}
+		if c.candidatesFirst {
+			for _, candidate := range answerCandidates(answer.SDP) {
+				send(messageICECandidate, candidate)
+			}
+			var kept []string
+			for _, line := range strings.Split(answer.SDP, "\r\n") {
+				if !strings.HasPrefix(line, "a=candidate:") {
+					kept = append(kept, line)
+				}
+			}
+			answer.SDP = strings.Join(kept, "\r\n")
+			time.Sleep(100 * time.Millisecond)
+		}
+		send(messageSDPAnswer, answer)
+		if c.repeatCandidates {
+			for _, candidate := range answerCandidates(answer.SDP) {
+				send(messageICECandidate, candidate)
+				send(messageICECandidate, candidate)
+			}
+		}
+	}
+}
+
+// answerCandidates returns the candidates in an answer's SDP.
+func answerCandidates(sdp string) []webrtc.ICECandidateInit {
+	var candidates []webrtc.ICECandidateInit
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if strings.HasPrefix(line, "a=candidate:") {
+			candidates = append(candidates, webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a="), SDPMid: stringPointer("0")})
+		}
+	}
+	return candidates
+}
+
+func stringPointer(s string) *string {
+	return &s
+}
+
+func (c *fakeCamera) answer(request SignalingRequest) (webrtc.SessionDescription, error) {
+	data, err := base64.StdEncoding.DecodeString(request.MessagePayload)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	var offer webrtc.SessionDescription
+	if err := json.Unmarshal(data, &offer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	c.mu.Lock()
+	c.peers = append(c.peers, peerConnection)
+	c.mu.Unlock()
+
+	var track *webrtc.TrackLocalStaticRTP
+	if !c.noVideo {
+		track, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "camera")
+		if err != nil {
+			return webrtc.SessionDescription{}, err
+		}
+		sender, err := peerConnection.AddTrack(track)
+		if err != nil {
+			return webrtc.SessionDescription{}, err
+		}
+		go drainRTCP(sender)
+	}
+	var audioTrack *webrtc.TrackLocalStaticRTP
+	if c.audio {
+		audioTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU}, "audio", "camera")
+		if err != nil {
+			return webrtc.SessionDescription{}, err
+		}
+		sender, err := peerConnection.AddTrack(audioTrack)
+		if err != nil {
+			return webrtc.SessionDescription{}, err
+		}
+		go drainRTCP(sender)
+	}
+	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+	<-gatherComplete
+	if track != nil && c.fragmented {
+		go sendFragmentedVideo(track)
+	} else if track != nil {
+		go sendTestVideo(track)
+	}
+	if audioTrack != nil {
+		go sendTestAudio(audioTrack)
+	}
+	answer = *peerConnection.LocalDescription()
+	if c.answerSDP != nil {
+		answer.SDP = c.answerSDP(answer.SDP)
+	}
+	return answer, nil
+}
+
+// sendTestVideo writes one single-NAL H264 frame every 33ms, an IDR every
+// 30th, until the track's connection closes.
+func sendTestVideo(track *webrtc.TrackLocalStaticRTP) {
+	for i := 0; ; i++ {
+		time.Sleep(33 * time.Millisecond)
+		nal := byte(0x41)
+		if i%30 == 0 {
+			nal = 0x65
+		}
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 3000), Marker: true},
+			Payload: []byte{nal, 1, 2, 3, 4, 5},
+		}
+		if err := track.WriteRTP(pkt); err != nil {
+			return
+		}
+	}
+}
+
+// fragmentedFrame returns the RTP payloads of frame i as sendFragmentedVideo
+// sends it: each slice split into three FU-A fragments, with two IDR slices
+// every 30th frame and one non-IDR slice otherwise.
+func fragmentedFrame(i int) [][]byte {
+	slices := []byte{0x41}
+	if i%30 == 0 {
+		slices = []byte{0x65, 0x65}
+	}
+	var payloads [][]byte
+	for s, nal := range slices {
+		for f := range 3 {
+			header := nal & 0x1f
+			if f == 0 {
+				header |= 0x80
+			}
+			if f == 2 {
+				header |= 0x40
+			}
+			payloads = append(payloads, []byte{nal&0xe0 | 28, header, byte(i), byte(s), byte(f)})
+		}
+	}
+	return payloads
+}
+
+// sendFragmentedVideo writes fragmentedFrame every 33ms, the marker bit on
+// each frame's last packet, until the track's connection closes.
+func sendFragmentedVideo(track *webrtc.TrackLocalStaticRTP) {
+	seq := uint16(0)
+	for i := 0; ; i++ {
+		time.Sleep(33 * time.Millisecond)
+		payloads := fragmentedFrame(i)
+		for n, payload := range payloads {
+			pkt := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(i * 3000), Marker: n == len(payloads)-1},
+				Payload: payload,
+			}
+			seq++
+			if err := track.WriteRTP(pkt); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// sendTestAudio writes 20ms of PCMU silence every 20ms until the track's
+// connection closes.
+func sendTestAudio(track *webrtc.TrackLocalStaticRTP) {
+	silence := bytes.Repeat([]byte{0xff}, 160)
+	for i := 0; ; i++ {
+		time.Sleep(20 * time.Millisecond)
+		pkt := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 160)},
+			Payload: silence,
+		}
+		if err := track.WriteRTP(pkt); err != nil {
+			return
+		}
+	}
+}
+
+func (c *fakeCamera) offerCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offers
+}
+
+// dropPeers closes the camera's PeerConnections but keeps its signaling up,
+// as a camera that loses its media path does.
+func (c *fakeCamera) dropPeers() {
+	c.mu.Lock()
+	peers := c.peers
+	c.peers = nil
+	c.mu.Unlock()
+	for _, peerConnection := range peers {
+		peerConnection.Close()
+	}
+}
+
+func (c *fakeCamera) close() {
+	c.mu.Lock()
+	conns := c.conns
+	c.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	c.dropPeers()
+	c.server.Close()
+}
+
+// registerStream registers streamID with the camera through websocketHandler
+// and cleans it up when the test ends.
+func registerStream(t *testing.T, streamID string, camera *fakeCamera) *WebRTCStream {
+	t.Helper()
+	config := `{"signaling_url":"` + camera.url + `","ice_servers":[]}`
+	recorder := httptest.NewRecorder()
+	websocketHandler(recorder, withVars(httptest.NewRequest(http.MethodPost, "/websocket/"+streamID, strings.NewReader(config)), "streamID", streamID))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("registering %s: %d %s", streamID, recorder.Code, recorder.Body)
+	}
+	stream, ok := getStream(streamID)
+	if !ok {
+		t.Fatalf("stream %s isn't registered", streamID)
+	}
+	t.Cleanup(func() { removeTestStream(streamID, stream) })
+	return stream
+}
+
+// waitForIngest waits for the stream's camera connection to come up.
+func waitForIngest(t *testing.T, stream *WebRTCStream) {
+	t.Helper()
+	waitFor(t, 10*time.Second, "the ingest to connect", func() bool {
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		return stream.peerConnection != nil && stream.peerConnection.ConnectionState() == webrtc.PeerConnectionStateConnected
+	})
+}
+
+func removeTestStream(streamID string, stream *WebRTCStream) {
+	streamsMu.Lock()
+	if current, ok := streams[streamID]; ok && current == stream {
+		removeStream(streamID)
+	}
+	streamsMu.Unlock()
+	closeStream(streamID, stream)
+}
+
+func withVars(r *http.Request, pairs ...string) *http.Request {
+	vars := make(map[string]string)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		vars[pairs[i]] = pairs[i+1]
+	}
+	return mux.SetURLVars(r, vars)
+}
+
+// waitFor polls condition until it holds or timeout passes.
+func waitFor(t *testing.T, timeout time.Duration, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %s waiting for %s", timeout, what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testViewer is a Pion WHEP client.
+type testViewer struct {
+	peerConnection *webrtc.PeerConnection
+	packets        chan *rtp.Packet // video
+	audio          chan *rtp.Packet
+	location       string
+}
+
+// newTestViewer makes a client that receives video with Pion's default
+// codecs.
+func newTestViewer(t *testing.T) *testViewer {
+	return newCustomTestViewer(t, nil, webrtc.RTPCodecTypeVideo)
+}
+
+// newCustomTestViewer makes a client that receives kinds, offering only the
+// codecs registerCodecs registers, or Pion's defaults if it's nil.
+func newCustomTestViewer(t *testing.T, registerCodecs func(*webrtc.MediaEngine) error, kinds ...webrtc.RTPCodecType) *testViewer {
+	t.Helper()
+	m := &webrtc.MediaEngine{}
+	if registerCodecs == nil {
+		registerCodecs = (*webrtc.MediaEngine).RegisterDefaultCodecs
+	}
+	if err := registerCodecs(m); err != nil {
+		t.Fatal(err)
+	}
+	peerConnection, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peerConnection.Close() })
+	for _, kind := range kinds {
+		if _, err := peerConnection.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	viewer := &testViewer{
+		peerConnection: peerConnection,
+		packets:        make(chan *rtp.Packet, 1024),
+		audio:          make(chan *rtp.Packet, 1024),
+	}
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		packets := viewer.packets
+		if track.Kind() == webrtc.RTPCodecTypeAudio {
+			packets = viewer.audio
+		}
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			select {
+			case packets <- pkt:
+			default:
+			}
+		}
+	})
+	return viewer
+}
+
+// offer POSTs the viewer's offer to handler, which serves /whep/{streamID},
+// applying the answer on success.
+func (v *testViewer) offer(t *testing.T, handler http.Handler, streamID string) *httptest.ResponseRecorder {
+	t.Helper()
+	offer, err := v.peerConnection.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(v.peerConnection)
+	if err := v.peerConnection.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	request := httptest.NewRequest(http.MethodPost, "/whep/"+streamID, bytes.NewBufferString(v.peerConnection.LocalDescription().SDP))
+	request.Header.Set("Content-Type", "application/sdp")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		return recorder
+	}
+	v.location = recorder.Header().Get("Location")
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: recorder.Body.String()}
+	if err := v.peerConnection.SetRemoteDescription(answer); err != nil {
+		t.Fatalf("applying answer: %v", err)
+	}
+	return recorder
+}
+
+// waitForPackets waits for n RTP packets.
+func (v *testViewer) waitForPackets(t *testing.T, n int, timeout time.Duration) []*rtp.Packet {
+	t.Helper()
+	var pkts []*rtp.Packet
+	deadline := time.After(timeout)
+	for len(pkts) < n {
+		select {
+		case pkt := <-v.packets:
+			pkts = append(pkts, pkt)
+		case <-deadline:
+			t.Fatalf("got %d of %d RTP packets within %s", len(pkts), n, timeout)
+		}
+	}
+	return pkts
+}
+
+// testRouter serves the routes the tests exercise, as main does.
+func testRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/whep/{streamID}", withRequestID(whepHandler)).Methods("GET", "OPTIONS", "POST")
+	r.HandleFunc("/websocket/{streamID}", withRequestID(websocketHandler)).Methods("POST")
+	r.HandleFunc("/whep/{streamID}/{viewerID}", withRequestID(whepResourceHandler)).Methods("DELETE")
+	r.HandleFunc("/streams/{streamID}", streamHandler).Methods("GET")
+	r.HandleFunc("/streams/{streamID}/viewers", viewersHandler).Methods("GET")
+	return r
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+
+	"github.com/pion/stun"
+)
+
+// runCheck validates the configuration without serving, for -check or
+// WHEP_CHECK=1 in CI. Settings from the environment were already parsed at
+// startup; this reports any that fell back to defaults, then tries the
+// listeners and the streams file. It returns the process exit code.
+func runCheck() int {
+	var problems []string
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	problems = append(problems, configProblems...)
+
+	if !listenTCP && unixSocket == "" {
+		fail("WHEP_LISTEN_TCP=false requires WHEP_PROXY_UNIX_SOCKET")
+	}
+	if listenTCP {
+		if err := checkListen(tcpNetwork(), ":8080"); err != nil {
+			fail("Cannot listen on :8080: %v", err)
+		}
+	}
+	if unixSocket != "" {
+		// An existing socket is replaced at startup, so only a fresh path is bound
+		if info, err := os.Stat(unixSocket); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				fail("Cannot listen on unix:%s: exists and is not a socket", unixSocket)
+			}
+		} else if err := checkListen("unix", unixSocket); err != nil {
+			fail("Cannot listen on unix:%s: %v", unixSocket, err)
+		} else {
+			os.Remove(unixSocket)
+		}
+	}
+
+	if cameraSampleSDP != "" && !reportCameraCodecs() {
+		fail("No codec in WHEP_CAMERA_SAMPLE_SDP matches the ingest video codecs")
+	}
+
+	if entries, source, err := loadStreams(); source != "" {
+		if err != nil {
+			fail("Cannot load streams: %v", err)
+		}
+		streamIDs := make([]string, 0, len(entries))
+		for streamID := range entries {
+			streamIDs = append(streamIDs, streamID)
+		}
+		sort.Strings(streamIDs)
+		for _, streamID := range streamIDs {
+			entry := entries[streamID]
+			for _, problem := range checkWebRTCConfig(entry.WebRTCConfig) {
+				fail("Stream %s: %s", streamID, problem)
+			}
+			if entry.Port != 0 {
+				if err := checkListen(tcpNetwork(), fmt.Sprintf(":%d", entry.Port)); err != nil {
+					fail("Stream %s: cannot listen on port %d: %v", streamID, entry.Port, err)
+				}
+			}
+		}
+		if err == nil {
+			fmt.Printf("[WHEP_PROXY] Checked %d streams in %s\n", len(entries), source)
+		}
+	}
+
+	if err := loadAliases(fileConfig.Aliases); err != nil {
+		fail("Cannot load aliases: %v", err)
+	}
+
+	if len(problems) == 0 {
+		fmt.Println("[WHEP_PROXY] Configuration OK")
+		return 0
+	}
+	fmt.Printf("[WHEP_PROXY] Configuration has %d problems:\n", len(problems))
+	for _, problem := range problems {
+		fmt.Printf("[WHEP_PROXY]   %s\n", problem)
+	}
+	return 1
+}
+
+// checkListen binds an address and releases it straight away.
+func checkListen(network, address string) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
+
+// checkWebRTCConfig reports the problems /websocket would reject a stream's
+// config for, plus ICE server URLs Pion won't parse. Streams file entries may
+// leave signaling_url to the /websocket POST.
+func checkWebRTCConfig(config WebRTCConfig) []string {
+	var problems []string
+	if config.SignalingURL != "" {
+		if parsedURL, err := url.Parse(config.SignalingURL); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid signaling_url: %v", err))
+		} else {
+			switch parsedURL.Scheme {
+			case "ws", "wss", "http", "https":
+			default:
+				problems = append(problems, fmt.Sprintf("unsupported signaling scheme %q", parsedURL.Scheme))
+			}
+		}
+	}
+	switch config.ICETransportPolicy {
+	case "", "all", "relay":
+	default:
+		problems = append(problems, "ice_transport_policy must be all or relay")
+	}
+	for _, server := range config.ICEServers {
+		uri, err := stun.ParseURI(server.URL)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid ICE server %q: %v", server.URL, err))
+			continue
+		}
+		if (uri.Scheme == stun.SchemeTypeTURN || uri.Scheme == stun.SchemeTypeTURNS) && (server.Username == "" || server.Credential == "") {
+			problems = append(problems, fmt.Sprintf("TURN server %q needs a username and credential", server.URL))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+)
+
+// viewerCNAME is the RTCP CNAME of a stream's viewer tracks for
+// WHEP_RTCP_CNAME, with {stream} replaced by the stream ID. It's the same for
+// a stream's video and audio, and across viewers and reconnects, so tools that
+// group RTP by CNAME see one source per camera. It's "" when unset.
+func viewerCNAME(streamID string) string {
+	return strings.ReplaceAll(rtcpCNAME, "{stream}", streamID)
+}
+
+// cnameInterceptorFactory makes a viewer PeerConnection send an RTCP source
+// description with a CNAME along with each sender report. Pion sends no SDES
+// of its own.
+type cnameInterceptorFactory struct {
+	cname string
+}
+
+func (f *cnameInterceptorFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &cnameInterceptor{cname: f.cname}, nil
+}
+
+type cnameInterceptor struct {
+	interceptor.NoOp
+	cname string
+}
+
+// BindRTCPWriter appends an SDES chunk for each sender report's SSRC, making
+// the report a compound packet. It has to be registered before the report
+// interceptor to see its packets.
+func (i *cnameInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		var chunks []rtcp.SourceDescriptionChunk
+		for _, pkt := range pkts {
+			if report, ok := pkt.(*rtcp.SenderReport); ok {
+				chunks = append(chunks, rtcp.SourceDescriptionChunk{
+					Source: report.SSRC,
+					Items:  []rtcp.SourceDescriptionItem{{Type: rtcp.SDESCNAME, Text: i.cname}},
+				})
+			}
+		}
+		if len(chunks) > 0 {
+			pkts = append(pkts, &rtcp.SourceDescription{Chunks: chunks})
+		}
+		return writer.Write(pkts, attributes)
+	})
+}
+
+// setAnswerCNAME rewrites the cname of an answer's a=ssrc lines, which Pion
+// sets to the stream ID, to match the CNAME sent in RTCP.
+func setAnswerCNAME(answer string, cname string) (string, error) {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(answer)); err != nil {
+		return "", err
+	}
+	for _, media := range desc.MediaDescriptions {
+		for i, attr := range media.Attributes {
+			if attr.Key != sdp.AttrKeySSRC {
+				continue
+			}
+			if ssrc, value, ok := strings.Cut(attr.Value, " "); ok && strings.HasPrefix(value, "cname:") {
+				media.Attributes[i].Value = ssrc + " cname:" + cname
+			}
+		}
+	}
+	out, err := desc.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
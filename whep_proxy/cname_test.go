@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// sdesCNAMEs reads a viewer's RTCP until n source descriptions have arrived,
+// returning the CNAME the last gave each SSRC.
+func sdesCNAMEs(t *testing.T, receiver *webrtc.RTPReceiver, n int) map[uint32]string {
+	t.Helper()
+	if err := receiver.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var cnames map[uint32]string
+	for n > 0 {
+		pkts, _, err := receiver.ReadRTCP()
+		if err != nil {
+			t.Fatalf("reading RTCP: %v", err)
+		}
+		for _, pkt := range pkts {
+			sdes, ok := pkt.(*rtcp.SourceDescription)
+			if !ok {
+				continue
+			}
+			cnames = make(map[uint32]string)
+			for _, chunk := range sdes.Chunks {
+				for _, item := range chunk.Items {
+					if item.Type == rtcp.SDESCNAME {
+						cnames[chunk.Source] = item.Text
+					}
+				}
+			}
+			n--
+		}
+	}
+	return cnames
+}
+
+// A viewer is sent the same SDES CNAME, for the same SSRC, before and after
+// the ingest reconnects.
+func TestCNAMEStableAcrossRestart(t *testing.T) {
+	cname := rtcpCNAME
+	t.Cleanup(func() { rtcpCNAME = cname })
+	rtcpCNAME = "{stream}@test"
+
+	camera := newFakeCamera(t, nil)
+	stream := registerStream(t, "cname-restart", camera)
+	waitForIngest(t, stream)
+
+	viewer := newTestViewer(t)
+	if recorder := viewer.offer(t, testRouter(), "cname-restart"); recorder.Code != http.StatusCreated {
+		t.Fatalf("offer returned %d: %s", recorder.Code, recorder.Body)
+	}
+	viewer.waitForPackets(t, 10, 5*time.Second)
+	receiver := viewer.peerConnection.GetReceivers()[0]
+	before := sdesCNAMEs(t, receiver, 1)
+	if len(before) != 1 {
+		t.Fatalf("SDES before the restart = %v, want one CNAME", before)
+	}
+	for ssrc, got := range before {
+		if got != "cname-restart@test" {
+			t.Errorf("SDES gives SSRC %d CNAME %q, want cname-restart@test", ssrc, got)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	restartHandler(recorder, withVars(httptest.NewRequest(http.MethodPost, "/streams/cname-restart/restart", nil), "streamID", "cname-restart"))
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("restart returned %d: %s", recorder.Code, recorder.Body)
+	}
+	waitFor(t, 10*time.Second, "the camera to answer a second offer", func() bool {
+		return camera.offerCount() >= 2
+	})
+	waitForIngest(t, stream)
+	viewer.waitForPackets(t, 10, 5*time.Second)
+
+	// Skip a report that may have been queued before the restart
+	after := sdesCNAMEs(t, receiver, 2)
+	if len(after) != len(before) {
+		t.Fatalf("SDES after the restart = %v, want %v", after, before)
+	}
+	for ssrc, want := range before {
+		if after[ssrc] != want {
+			t.Errorf("SSRC %d CNAME after the restart = %q, want %q", ssrc, after[ssrc], want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// checkCameraCodecs compares a sample camera answer with the codecs the ingest
+// connection registers, so a codec mismatch shows up as a startup report
+// instead of a black screen. It returns a line per camera codec, and whether
+// any camera video codec matched.
+func checkCameraCodecs(path string) ([]string, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal(data); err != nil {
+		return nil, false, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	registered, err := ingestCodecs()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var report []string
+	videoMatched := false
+	for _, media := range desc.MediaDescriptions {
+		kind := media.MediaName.Media
+		if kind != "audio" && kind != "video" {
+			continue
+		}
+		if media.MediaName.Port.Value == 0 {
+			report = append(report, fmt.Sprintf("%s: rejected by the camera", kind))
+			continue
+		}
+		if kind == "audio" && disableAudio {
+			report = append(report, "audio: ignored, WHEP_DISABLE_AUDIO is set")
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			name, clockRate, fmtp := sdpCodec(media, format)
+			if name == "" {
+				report = append(report, fmt.Sprintf("%s pt %s: no rtpmap", kind, format))
+				continue
+			}
+			mimeType := kind + "/" + name
+			var match *webrtc.RTPCodecParameters
+			for i := range registered[kind] {
+				if codecMatches(registered[kind][i], mimeType, clockRate, fmtp) {
+					match = &registered[kind][i]
+					break
+				}
+			}
+			line := fmt.Sprintf("%s %s/%d pt %s", kind, name, clockRate, format)
+			if fmtp != "" {
+				line += " (" + fmtp + ")"
+			}
+			if match != nil {
+				report = append(report, line+": matches")
+				if kind == "video" {
+					videoMatched = true
+				}
+				continue
+			}
+			var offered []string
+			for _, codec := range registered[kind] {
+				offered = append(offered, strings.TrimSpace(codec.MimeType+" "+codec.SDPFmtpLine))
+			}
+			report = append(report, fmt.Sprintf("%s: no match, proxy offers %s", line, strings.Join(offered, ", ")))
+		}
+	}
+	return report, videoMatched, nil
+}
+
+// ingestCodecs returns the codecs an ingest connection with the default
+// config registers, by kind.
+func ingestCodecs() (map[string][]webrtc.RTPCodecParameters, error) {
+	peerConnection, err := newIngestPeerConnection(WebRTCConfig{ICEServers: []ICEServer{}})
+	if err != nil {
+		return nil, err
+	}
+	defer peerConnection.Close()
+
+	codecs := make(map[string][]webrtc.RTPCodecParameters)
+	kinds := []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio}
+	if disableAudio {
+		kinds = kinds[:1]
+	}
+	for _, kind := range kinds {
+		transceiver, err := peerConnection.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		if err != nil {
+			return nil, err
+		}
+		codecs[kind.String()] = transceiver.Receiver().GetParameters().Codecs
+	}
+	return codecs, nil
+}
+
+// sdpCodec reads a format's rtpmap and fmtp. Static payload types without an
+// rtpmap are filled in for the codecs cameras actually use.
+func sdpCodec(media *sdp.MediaDescription, format string) (name string, clockRate uint32, fmtp string) {
+	switch format {
+	case "0":
+		name, clockRate = "PCMU", 8000
+	case "8":
+		name, clockRate = "PCMA", 8000
+	}
+	for _, attr := range media.Attributes {
+		pt, value, ok := strings.Cut(attr.Value, " ")
+		if !ok || pt != format {
+			continue
+		}
+		switch attr.Key {
+		case "rtpmap":
+			encoding, rate, _ := strings.Cut(value, "/")
+			rate, _, _ = strings.Cut(rate, "/") // drop channels
+			if n, err := strconv.ParseUint(rate, 10, 32); err == nil {
+				name, clockRate = encoding, uint32(n)
+			}
+		case "fmtp":
+			fmtp = value
+		}
+	}
+	return name, clockRate, fmtp
+}
+
+// codecMatches follows Pion's codec matching: MIME type and clock rate, and
+// for H264 the packetization mode and profile (but not level).
+func codecMatches(codec webrtc.RTPCodecParameters, mimeType string, clockRate uint32, fmtp string) bool {
+	if !strings.EqualFold(codec.MimeType, mimeType) || codec.ClockRate != clockRate {
+		return false
+	}
+	if !strings.EqualFold(mimeType, webrtc.MimeTypeH264) {
+		return true
+	}
+	ours, theirs := parseFmtp(codec.SDPFmtpLine), parseFmtp(fmtp)
+	if ours["packetization-mode"] != theirs["packetization-mode"] {
+		return false
+	}
+	profile := func(params map[string]string) string {
+		id := params["profile-level-id"]
+		if len(id) != 6 {
+			id = "42001f" // RFC 6184 default
+		}
+		return strings.ToLower(id[:4])
+	}
+	return profile(ours) == profile(theirs)
+}
+
+// parseFmtp splits an fmtp line into lowercase keys, defaulting H264's
+// packetization-mode to 0.
+func parseFmtp(line string) map[string]string {
+	params := map[string]string{"packetization-mode": "0"}
+	for _, param := range strings.Split(line, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok {
+			params[strings.ToLower(key)] = value
+		}
+	}
+	return params
+}
+
+// reportCameraCodecs prints the codec report for WHEP_CAMERA_SAMPLE_SDP,
+// returning whether the camera's video would be received.
+func reportCameraCodecs() bool {
+	report, videoMatched, err := checkCameraCodecs(cameraSampleSDP)
+	if err != nil {
+		fmt.Printf("[WHEP_PROXY] Cannot check WHEP_CAMERA_SAMPLE_SDP: %v\n", err)
+		return false
+	}
+	fmt.Printf("[WHEP_PROXY] Codecs in %s:\n", cameraSampleSDP)
+	for _, line := range report {
+		fmt.Printf("[WHEP_PROXY]   %s\n", line)
+	}
+	if !videoMatched {
+		fmt.Println("[WHEP_PROXY] Warning: no camera video codec matches, viewers will get no video")
+	}
+	return videoMatched
+}
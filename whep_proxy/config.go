@@ -0,0 +1,718 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/webrtc/v3"
+)
+
+// configFile is an optional JSON or YAML file of settings, see Config. The
+// environment overrides it.
+var configFile = os.Getenv("WHEP_CONFIG_FILE")
+
+// unixSocket is an optional Unix socket path to serve the API on, for a
+// bridge in the same container. listenTCP=false serves it there only.
+var (
+	unixSocket = getenv("WHEP_PROXY_UNIX_SOCKET")
+	listenTCP  = envBool("WHEP_LISTEN_TCP", true)
+)
+
+// streamsFile is an optional JSON file of per-stream settings, keyed by
+// stream ID. It replaces the streams in WHEP_CONFIG_FILE.
+var streamsFile = getenv("WHEP_STREAMS_FILE")
+
+// defaultSignalingURL is used by streams that get no signaling_url from their
+// /websocket POST or WHEP_STREAMS_FILE entry.
+var defaultSignalingURL = envSecret("WHEP_SIGNALING_URL")
+
+// cameraSampleSDP is an optional camera answer to check against the ingest
+// codecs at startup, when onboarding a new camera model.
+var cameraSampleSDP = getenv("WHEP_CAMERA_SAMPLE_SDP")
+
+// maxBodySize caps the size of SDP offers and JSON configs read from clients.
+var maxBodySize = envPositiveInt64("WHEP_MAX_BODY_SIZE", 256*1024)
+
+// maxViewersPerStream caps concurrent WHEP viewers of one stream. 0 means no
+// limit.
+var maxViewersPerStream = envInt64("WHEP_MAX_VIEWERS_PER_STREAM", 0)
+
+// viewerBacklog is how many video packets may queue for a viewer before it's
+// treated as lagging: its backlog is dropped and it resumes at the next
+// keyframe.
+var viewerBacklog = envPositiveInt64("WHEP_VIEWER_BACKLOG", 256)
+
+// Adaptive keyframe requests: while a viewer's receiver reports show more than
+// lossPLIThreshold percent loss for lossPLISustain, the camera is asked for a
+// keyframe at most every lossPLIInterval per stream.
+var (
+	adaptivePLI      = envBool("WHEP_ADAPTIVE_PLI", true)
+	lossPLIThreshold = envInt64("WHEP_LOSS_PLI_THRESHOLD", 5)
+	lossPLISustain   = envDuration("WHEP_LOSS_PLI_SUSTAIN", 3*time.Second)
+	lossPLIInterval  = envPositiveDuration("WHEP_LOSS_PLI_INTERVAL", 5*time.Second)
+)
+
+// defaultTrickleMode is how viewers that don't choose get the proxy's ICE
+// candidates: "off" inline in an answer sent after gathering, or "sse" over
+// server-sent events after an immediate answer. See trickleMode.
+var defaultTrickleMode = envTrickleMode("WHEP_TRICKLE", "off")
+
+// Keyframe watchdog: a connected ingest that delivers no keyframe within
+// keyframeTimeout is asked for one every keyframePLIInterval, then handled per
+// keyframeTimeoutAction: "degrade" reports the stream degraded until one
+// arrives, "reconnect" also renegotiates the ingest, and "off" disables the
+// watchdog.
+var (
+	keyframeTimeout       = envPositiveDuration("WHEP_KEYFRAME_TIMEOUT", 10*time.Second)
+	keyframePLIInterval   = envPositiveDuration("WHEP_KEYFRAME_PLI_INTERVAL", 2*time.Second)
+	keyframeTimeoutAction = envKeyframeTimeoutAction("WHEP_KEYFRAME_TIMEOUT_ACTION", "degrade")
+)
+
+// keyframeRequest is the RTCP feedback every keyframe request sends the
+// camera, whether for a joining viewer, the keyframe endpoint, loss or the
+// watchdog: "pli" (Picture Loss Indication), "fir" (Full Intra Request, RFC
+// 5104) or "both". The KVS WebRTC SDK that Wyze cameras run answers PLI;
+// some other encoders, typically ones from SIP and RTSP gateways, only act on
+// FIR. "both" suits a camera whose support isn't known.
+var keyframeRequest = envKeyframeRequest("WHEP_KEYFRAME_REQUEST", "pli")
+
+// maxConcurrentNegotiations caps viewer offers being answered at once, so a
+// burst of reconnecting players can't spike CPU; a POST that can't start
+// within negotiationWait gets 503. 0 means no limit.
+var (
+	maxConcurrentNegotiations = envInt64("WHEP_MAX_CONCURRENT_NEGOTIATIONS", 0)
+	negotiationWait           = envDuration("WHEP_NEGOTIATION_WAIT", 2*time.Second)
+)
+
+// reconnectPolicy controls when a stream's ingest connection is re-established.
+var reconnectPolicy = envReconnectPolicy("WHEP_RECONNECT_POLICY", reconnectNever)
+
+// reconnectDelay is the wait before the first ingest reconnect attempt. It
+// doubles after each failure up to reconnectMaxDelay, unless the signaling
+// server sends a Retry-After.
+var (
+	reconnectDelay    = envPositiveDuration("WHEP_RECONNECT_DELAY", 5*time.Second)
+	reconnectMaxDelay = envPositiveDuration("WHEP_RECONNECT_MAX_DELAY", 2*time.Minute)
+)
+
+// maxReconnectAttempts is how many reconnect attempts in a row an ingest gets
+// before its stream is marked dead and left alone until a manual restart. 0
+// keeps trying forever.
+var maxReconnectAttempts = envInt64("WHEP_MAX_RECONNECT_ATTEMPTS", 0)
+
+// disconnectedGracePeriod is how long a disconnected ingest gets to recover on
+// its own before it's treated as failed and reconnected. Unset (0) waits for
+// ICE to report failure.
+var disconnectedGracePeriod = envDuration("WHEP_DISCONNECTED_GRACE_PERIOD", 0)
+
+// viewerIdleTimeout is how long a connected viewer may go without sending RTCP
+// before its session is assumed gone and closed. Unset (0) leaves viewers to
+// ICE and DELETE, since some players send no RTCP at all.
+var viewerIdleTimeout = envDuration("WHEP_VIEWER_IDLE_TIMEOUT", 0)
+
+// ingestNegotiationTimeout is how long the camera gets to answer an ingest
+// offer. Past it the ingest is treated as failed: reconnected under
+// WHEP_RECONNECT_POLICY, or else the stream is cleaned up.
+var ingestNegotiationTimeout = envPositiveDuration("WHEP_INGEST_NEGOTIATION_TIMEOUT", 30*time.Second)
+
+// reuseSignaling lets a reconnect first renegotiate over the still-open
+// signaling connection, falling back to a redial after ingestRestartTimeout.
+var (
+	reuseSignaling       = envBool("WHEP_RECONNECT_REUSE_SIGNALING", true)
+	ingestRestartTimeout = envPositiveDuration("WHEP_INGEST_RESTART_TIMEOUT", 15*time.Second)
+)
+
+// closeSignalingOnConnect closes the ingest signaling connection once the
+// camera connects, instead of keeping it open for the life of the stream.
+// Reconnects then redial signaling rather than renegotiating over it.
+var closeSignalingOnConnect = envBool("WHEP_CLOSE_SIGNALING_ON_CONNECT", false)
+
+// viewerDTLSRole forces the DTLS role answered to WHEP clients: "client"
+// (a=setup:active), "server" (a=setup:passive) or "auto" to let Pion decide.
+var viewerDTLSRole = envDTLSRole("WHEP_DTLS_ROLE", webrtc.DTLSRoleAuto)
+
+// rtspEnabled also serves each stream over RTSP on rtspPort, at
+// rtsp://host:8555/{streamID} by default; the bridge's own RTSP server
+// already has 8554.
+var (
+	rtspEnabled = envBool("WHEP_RTSP", false)
+	rtspPort    = envPositiveInt64("WHEP_RTSP_PORT", 8555)
+)
+
+// timestampExtension is the RTP header extension offered to cameras for
+// measuring their latency: abs-send-time, abs-capture-time, or off. Empty
+// means off, the default, so the ingest offer is unchanged unless
+// WHEP_TIMESTAMP_EXTENSION opts in.
+var timestampExtension = envTimestampExtension("WHEP_TIMESTAMP_EXTENSION", "")
+
+// disableAudio leaves audio out of both connections: the ingest offers video
+// only, and viewers' audio sections are rejected, for players that trip over
+// PCMU.
+var disableAudio = envBool("WHEP_DISABLE_AUDIO", false)
+
+// viewerForceBundle answers viewers with max-bundle and requires rtcp-mux, for
+// clients that can't cope with anything else.
+var viewerForceBundle = envBool("WHEP_FORCE_BUNDLE", false)
+
+// answerSSRCLines makes sure viewer answers carry a=ssrc lines with the
+// cname and msid of each track, and an a=ssrc-group for RTX, for legacy
+// clients that won't render without them.
+var answerSSRCLines = envBool("WHEP_ANSWER_SSRC_LINES", false)
+
+// rtcpCNAME is the CNAME viewers are sent in RTCP SDES and in the answer's
+// a=ssrc lines, with {stream} replaced by the stream ID, e.g.
+// "{stream}@wyze-bridge". Unset, no SDES is sent and the answer's cname is
+// the stream ID. See cname.go.
+var rtcpCNAME = envString("WHEP_RTCP_CNAME", "")
+
+// debugLogging enables verbose logs for expected-but-noisy events.
+var debugLogging = envBool("WHEP_DEBUG", false)
+
+// testPattern replaces camera signaling with a synthetic H264 pattern, for
+// debugging WHEP clients without a camera.
+var testPattern = envBool("WHEP_TEST_PATTERN", false)
+
+// impairmentTesting lets viewers delay, jitter and drop their own video with
+// impair_* query parameters on their offer, to test players against a bad
+// network. Don't enable it in production.
+var impairmentTesting = envBool("WHEP_IMPAIRMENT_TESTING", false)
+
+// codecPreference is the ordered list of video MIME types offered to viewers,
+// from e.g. WHEP_CODEC_PREFERENCE=H264,VP8. Empty keeps Pion's default order.
+var codecPreference = envCodecList("WHEP_CODEC_PREFERENCE")
+
+// eventWebhook receives stream lifecycle events for streams that don't set
+// their own webhook_url.
+var eventWebhook = envSecret("WHEP_EVENT_WEBHOOK")
+
+// eventLogPath is an optional file every stream's timeline, as served at
+// /streams/{streamID}/events, is appended to as JSON lines.
+var eventLogPath = getenv("WHEP_EVENT_LOG")
+
+// adminToken, from WHEP_ADMIN_TOKEN, is the bearer token for operator
+// endpoints that expose session details or act on a stream. Without one they
+// only answer local clients.
+var adminToken = envSecret("WHEP_ADMIN_TOKEN")
+
+// webhookTimeout bounds each lifecycle webhook request.
+var webhookTimeout = envPositiveDuration("WHEP_EVENT_WEBHOOK_TIMEOUT", 3*time.Second)
+
+// shutdownTimeout bounds shutdown on SIGINT or SIGTERM. Streams still closing
+// when it runs out are abandoned, so the proxy exits within Docker's stop
+// grace period (10s by default) instead of being killed.
+var shutdownTimeout = envPositiveDuration("WHEP_SHUTDOWN_TIMEOUT", 8*time.Second)
+
+// pollInterval is how often HTTP polling signaling checks for new messages.
+var pollInterval = envPositiveDuration("WHEP_POLL_INTERVAL", 500*time.Millisecond)
+
+// hlsEnabled also muxes each stream's video into an HLS playlist served at
+// /hls/{streamID}/index.m3u8, for clients without WebRTC.
+var hlsEnabled = envBool("WHEP_HLS", false)
+
+// HLS segments are cut on the first keyframe after hlsSegmentDuration, and
+// the newest hlsSegmentCount are kept in memory.
+var (
+	hlsSegmentDuration = envPositiveDuration("WHEP_HLS_SEGMENT_DURATION", 2*time.Second)
+	hlsSegmentCount    = envPositiveInt64("WHEP_HLS_SEGMENT_COUNT", 6)
+)
+
+// gopCacheEnabled keeps each stream's video since its last keyframe and
+// replays it to viewers as they connect, so they start with a picture instead
+// of waiting for the camera's next keyframe. A GOP longer than
+// gopCacheMaxAge, larger than gopCacheMaxBytes or than WHEP_VIEWER_BACKLOG
+// packets isn't kept, and those viewers wait as before.
+var (
+	gopCacheEnabled  = envBool("WHEP_GOP_CACHE", false)
+	gopCacheMaxAge   = envPositiveDuration("WHEP_GOP_CACHE_MAX_AGE", 4*time.Second)
+	gopCacheMaxBytes = envPositiveInt64("WHEP_GOP_CACHE_MAX_BYTES", 1<<20)
+)
+
+// snapshotEnabled serves a JPEG of each stream's latest keyframe at
+// /snapshot/{streamID}.jpg, decoded by snapshotFFmpeg. Decoding costs CPU, so
+// the JPEG is reused for snapshotTTL.
+var (
+	snapshotEnabled = envBool("WHEP_SNAPSHOT", false)
+	snapshotFFmpeg  = envString("WHEP_SNAPSHOT_FFMPEG", "ffmpeg")
+	snapshotTTL     = envPositiveDuration("WHEP_SNAPSHOT_TTL", 2*time.Second)
+)
+
+// mediaDSCP marks outgoing RTP/RTCP on ingest and viewer connections, from
+// e.g. WHEP_DSCP=EF or WHEP_DSCP=46. -1 leaves packets unmarked.
+var mediaDSCP = envDSCP("WHEP_DSCP", -1)
+
+// UDP socket buffer sizes in bytes for ingest and viewer connections. 0 keeps
+// the OS default (on Linux net.core.wmem_default/rmem_default, usually 208KB).
+// Raising them absorbs bursts when fanning a high-bitrate stream out to many
+// viewers, at the cost of that much kernel memory per connection, e.g. 50
+// viewers at 4MB is 200MB. The kernel caps them at net.core.wmem_max and
+// rmem_max.
+var (
+	udpSendBuffer    = envInt64("WHEP_UDP_SEND_BUFFER", 0)
+	udpReceiveBuffer = envInt64("WHEP_UDP_RECEIVE_BUFFER", 0)
+)
+
+// viewerUDPPort, if set, serves every viewer's ICE from that one UDP port on
+// each interface, instead of binding new sockets per connection, so Docker
+// needs only that port published. Pion v3 doesn't pre-gather candidates
+// (ICECandidatePoolSize is accepted but unused), so this is the only way to
+// reuse them across viewers. Viewers gather host candidates only, which takes
+// about a millisecond either way; whep_viewer_gathering_seconds shows it for
+// a given host.
+var viewerUDPPort = envInt64("WHEP_VIEWER_UDP_PORT", 0)
+
+// advertisedIP replaces the address of host candidates in the ingest offer and
+// viewer answers, for host networking setups where Pion picks an address peers
+// can't reach. Pion's c= line is always 0.0.0.0, so peers only ever connect to
+// candidates. Empty advertises the local addresses.
+var advertisedIP = envIP("WHEP_ADVERTISED_IP")
+
+// ipFamily is "dual", the default, or "ipv4" or "ipv6" to listen and gather
+// ICE candidates on that family only. See ipfamily.go.
+var ipFamily = envIPFamily("WHEP_IP_FAMILY", "dual")
+
+// srtpProfileSetting restricts the SRTP protection profiles negotiated, e.g.
+// WHEP_SRTP_PROFILES=AEAD_AES_256_GCM,AEAD_AES_128_GCM. It's parsed into
+// srtpProfiles at startup, which fails on an unknown profile.
+var srtpProfileSetting = getenv("WHEP_SRTP_PROFILES")
+
+// stunServers are the STUN servers for ingests that don't configure ICE
+// servers, from a comma-separated WHEP_STUN_SERVERS. ICE queries all of them,
+// so gathering server reflexive candidates survives one being blocked or down.
+var stunServers = envSTUNList("WHEP_STUN_SERVERS", []string{
+	"stun:stun.l.google.com:19302",
+	"stun:stun1.l.google.com:19302",
+	"stun:stun.cloudflare.com:3478",
+})
+
+// iceTransportPolicy is the default ICE transport policy for ingest and viewer
+// connections: "all", or "relay" to only use TURN candidates. Each side can
+// override it, e.g. WHEP_VIEWER_ICE_POLICY=relay to send remote viewers
+// through TURN while LAN cameras still connect over host candidates.
+var (
+	iceTransportPolicy = envICETransportPolicy("WHEP_ICE_TRANSPORT_POLICY", webrtc.ICETransportPolicyAll)
+	ingestICEPolicy    = envICETransportPolicy("WHEP_INGEST_ICE_POLICY", iceTransportPolicy)
+	viewerICEPolicy    = envICETransportPolicy("WHEP_VIEWER_ICE_POLICY", iceTransportPolicy)
+)
+
+// streamWaitTimeout lets a viewer POST wait for its stream to be registered
+// instead of getting an immediate 404. Unset (0) disables waiting.
+var streamWaitTimeout = envDuration("WHEP_STREAM_WAIT_TIMEOUT", 0)
+
+// sdpDumpDir, if set, receives {streamID}-offer.sdp and {streamID}-answer.sdp
+// for each ingest negotiation, for attaching to support tickets.
+var sdpDumpDir = getenv("WHEP_SDP_DUMP_DIR")
+
+// Signaling circuit breaker: after breakerThreshold dial failures within
+// breakerWindow, registrations for that endpoint get 503 for breakerCooldown.
+var (
+	breakerThreshold = envPositiveInt64("WHEP_BREAKER_THRESHOLD", 5)
+	breakerWindow    = envPositiveDuration("WHEP_BREAKER_WINDOW", time.Minute)
+	breakerCooldown  = envPositiveDuration("WHEP_BREAKER_COOLDOWN", 30*time.Second)
+)
+
+// statsdAddr, a host:port, turns on the StatsD exporter, which sends per-stream
+// stats over UDP every statsdInterval alongside the Prometheus /metrics.
+var (
+	statsdAddr     = getenv("WHEP_STATSD_ADDR")
+	statsdPrefix   = envString("WHEP_STATSD_PREFIX", "whep.")
+	statsdInterval = envPositiveDuration("WHEP_STATSD_INTERVAL", 10*time.Second)
+)
+
+// Per-client rate limit on /websocket and /whep: a token bucket refilled at
+// rateLimitPerMinute holding up to rateLimitBurst requests. 0 disables it.
+// X-Forwarded-For is only believed from trustedProxies, a comma-separated
+// list of IPs and CIDRs.
+var (
+	rateLimitPerMinute = envInt64("WHEP_RATE_LIMIT_PER_MINUTE", 0)
+	rateLimitBurst     = envPositiveInt64("WHEP_RATE_LIMIT_BURST", 10)
+	trustedProxies     = envCIDRList("WHEP_TRUSTED_PROXIES")
+)
+
+// Ingest RTCP tuning. rtcpReportInterval sets both sender and receiver report
+// intervals (default 1s; 100ms-5s is sensible). nackInterval is how often
+// missing packets are NACKed (default 100ms; keep it under the jitter buffer,
+// 20-500ms). nackBufferSize is the packets tracked for NACK and retransmission,
+// a power of two from 64 to 32768 (default 512). WHEP_NACK=false disables NACK
+// on constrained links.
+var (
+	rtcpReportInterval = envPositiveDuration("WHEP_RTCP_REPORT_INTERVAL", time.Second)
+	nackEnabled        = envBool("WHEP_NACK", true)
+	nackInterval       = envPositiveDuration("WHEP_NACK_INTERVAL", 100*time.Millisecond)
+	nackBufferSize     = envNackBufferSize("WHEP_NACK_BUFFER_SIZE", 512)
+)
+
+// WebSocket signaling dialer limits
+var (
+	wsConnectTimeout   = envPositiveDuration("WHEP_WS_CONNECT_TIMEOUT", 10*time.Second)
+	wsHandshakeTimeout = envPositiveDuration("WHEP_WS_HANDSHAKE_TIMEOUT", 10*time.Second)
+	wsKeepAlive        = envPositiveDuration("WHEP_WS_KEEPALIVE", 30*time.Second)
+	wsReadBufferSize   = envPositiveInt64("WHEP_WS_READ_BUFFER_SIZE", 4096)
+	wsWriteBufferSize  = envPositiveInt64("WHEP_WS_WRITE_BUFFER_SIZE", 4096)
+	wsReadLimit        = envPositiveInt64("WHEP_WS_READ_LIMIT", 1024*1024)
+)
+
+// wsReadTimeout closes signaling that has sent nothing, not even a keepalive,
+// for this long, so a half-open connection isn't mistaken for a live one. Off
+// (0) by default: only set it for signaling servers known to send keepalives,
+// since an idle but healthy connection would be closed otherwise.
+var wsReadTimeout = envDuration("WHEP_WS_READ_TIMEOUT", 0)
+
+type ingestReconnectPolicy string
+
+const (
+	// reconnectNever leaves a failed ingest alone.
+	reconnectNever ingestReconnectPolicy = "never"
+	// reconnectOnFailure reconnects when the ingest connection fails.
+	reconnectOnFailure ingestReconnectPolicy = "on-failure"
+	// reconnectAlways also reconnects when the camera closes the connection cleanly.
+	reconnectAlways ingestReconnectPolicy = "always"
+)
+
+func (p ingestReconnectPolicy) shouldReconnect(state webrtc.PeerConnectionState) bool {
+	switch p {
+	case reconnectOnFailure:
+		return state == webrtc.PeerConnectionStateFailed
+	case reconnectAlways:
+		return state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed
+	}
+	return false
+}
+
+// configProblems collects the settings that fell back to defaults, for the
+// -check report.
+var configProblems []string
+
+func invalidConfig(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	configProblems = append(configProblems, problem)
+	fmt.Printf("[WHEP_PROXY] %s\n", problem)
+}
+
+func logDebugf(format string, args ...interface{}) {
+	baseLogger.Debugf(format, args...)
+}
+
+func envInt64(key string, def int64) int64 {
+	value := getenv(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		invalidConfig("Invalid %s=%q, using default %d", key, value, def)
+		return def
+	}
+	return n
+}
+
+// envPositiveInt64 is envInt64 for settings 0 would break rather than turn off.
+func envPositiveInt64(key string, def int64) int64 {
+	n := envInt64(key, def)
+	if n == 0 {
+		invalidConfig("Invalid %s=0, using default %d", key, def)
+		return def
+	}
+	return n
+}
+
+func envString(key string, def string) string {
+	if value := getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// envSecret reads key, or the file named by key_FILE as with Docker secrets,
+// so tokens in URLs needn't sit in the environment.
+func envSecret(key string) string {
+	secretSettings[key] = true
+	path := getenv(key + "_FILE")
+	if path == "" {
+		return getenv(key)
+	}
+	value, err := readSecretFile(path)
+	if err != nil {
+		invalidConfig("Cannot read %s_FILE: %v", key, err)
+		return getenv(key)
+	}
+	return value
+}
+
+// readSecretFile reads a secret, dropping the trailing newline editors and
+// echo leave behind.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func envBool(key string, def bool) bool {
+	value := getenv(key)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		invalidConfig("Invalid %s=%q, using default %t", key, value, def)
+		return def
+	}
+	return b
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	value := getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		invalidConfig("Invalid %s=%q, using default %s", key, value, def)
+		return def
+	}
+	return d
+}
+
+// envPositiveDuration is envDuration for settings 0 would break rather than
+// turn off, such as ticker intervals.
+func envPositiveDuration(key string, def time.Duration) time.Duration {
+	d := envDuration(key, def)
+	if d == 0 {
+		invalidConfig("Invalid %s=0, using default %s", key, def)
+		return def
+	}
+	return d
+}
+
+func envNackBufferSize(key string, def int64) int64 {
+	size := envInt64(key, def)
+	for shift := 6; shift <= 15; shift++ {
+		if size == 1<<shift {
+			return size
+		}
+	}
+	invalidConfig("Invalid %s=%d, must be a power of two from 64 to 32768, using default %d", key, size, def)
+	return def
+}
+
+func envReconnectPolicy(key string, def ingestReconnectPolicy) ingestReconnectPolicy {
+	value := getenv(key)
+	switch policy := ingestReconnectPolicy(value); policy {
+	case "":
+		return def
+	case reconnectNever, reconnectOnFailure, reconnectAlways:
+		return policy
+	}
+	invalidConfig("Invalid %s=%q, using default %s", key, value, def)
+	return def
+}
+
+func envTimestampExtension(key string, def string) string {
+	value := getenv(key)
+	switch strings.ToLower(value) {
+	case "":
+		return def
+	case "off":
+		return ""
+	case "abs-send-time", absSendTimeURI:
+		return absSendTimeURI
+	case "abs-capture-time", absCaptureTimeURI:
+		return absCaptureTimeURI
+	}
+	if def == "" {
+		invalidConfig("Invalid %s=%q, must be abs-send-time, abs-capture-time or off, using off", key, value)
+	} else {
+		invalidConfig("Invalid %s=%q, must be abs-send-time, abs-capture-time or off, using default %s", key, value, def)
+	}
+	return def
+}
+
+func envTrickleMode(key string, def string) string {
+	value := getenv(key)
+	switch strings.ToLower(value) {
+	case "":
+		return def
+	case "off", "sse":
+		return strings.ToLower(value)
+	}
+	invalidConfig("Invalid %s=%q, using default %s", key, value, def)
+	return def
+}
+
+func envKeyframeTimeoutAction(key string, def string) string {
+	value := getenv(key)
+	switch strings.ToLower(value) {
+	case "":
+		return def
+	case "off", "degrade", "reconnect":
+		return strings.ToLower(value)
+	}
+	invalidConfig("Invalid %s=%q, using default %s", key, value, def)
+	return def
+}
+
+func envKeyframeRequest(key string, def string) string {
+	value := getenv(key)
+	switch strings.ToLower(value) {
+	case "":
+		return def
+	case "pli", "fir", "both":
+		return strings.ToLower(value)
+	}
+	invalidConfig("Invalid %s=%q, using default %s", key, value, def)
+	return def
+}
+
+func envDTLSRole(key string, def webrtc.DTLSRole) webrtc.DTLSRole {
+	value := getenv(key)
+	switch strings.ToLower(value) {
+	case "":
+		return def
+	case "auto":
+		return webrtc.DTLSRoleAuto
+	case "client", "active":
+		return webrtc.DTLSRoleClient
+	case "server", "passive":
+		return webrtc.DTLSRoleServer
+	}
+	invalidConfig("Invalid %s=%q, using default %s", key, value, def)
+	return def
+}
+
+func envIP(key string) string {
+	value := getenv(key)
+	if value == "" {
+		return ""
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		invalidConfig("Invalid %s=%q, not an IP address, ignoring", key, value)
+		return ""
+	}
+	return ip.String()
+}
+
+func envIPFamily(key string, def string) string {
+	value := getenv(key)
+	switch strings.ToLower(value) {
+	case "":
+		return def
+	case "dual", "ipv4", "ipv6":
+		return strings.ToLower(value)
+	}
+	invalidConfig("Invalid %s=%q, using default %s", key, value, def)
+	return def
+}
+
+func envCIDRList(key string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, value := range strings.Split(getenv(key), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		cidr := value
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			invalidConfig("Invalid entry %q in %s, ignoring", value, key)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func envICETransportPolicy(key string, def webrtc.ICETransportPolicy) webrtc.ICETransportPolicy {
+	value := getenv(key)
+	switch strings.ToLower(value) {
+	case "":
+		return def
+	case "all":
+		return webrtc.ICETransportPolicyAll
+	case "relay":
+		return webrtc.ICETransportPolicyRelay
+	}
+	invalidConfig("Invalid %s=%q, using default %s", key, value, def)
+	return def
+}
+
+// dscpNames are the standard per-hop behaviour names accepted for WHEP_DSCP.
+var dscpNames = map[string]int{
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14, "AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30, "AF41": 34, "AF42": 36, "AF43": 38,
+	"EF": 46, "VA": 44,
+}
+
+func envDSCP(key string, def int) int {
+	value := getenv(key)
+	if value == "" {
+		return def
+	}
+	if dscp, ok := dscpNames[strings.ToUpper(value)]; ok {
+		return dscp
+	}
+	dscp, err := strconv.Atoi(value)
+	if err != nil || dscp < 0 || dscp > 63 {
+		invalidConfig("Invalid %s=%q, using default %d", key, value, def)
+		return def
+	}
+	return dscp
+}
+
+// envSTUNList reads STUN URLs, adding the stun: scheme to bare host:port
+// entries and dropping ones that don't parse.
+func envSTUNList(key string, def []string) []string {
+	value := getenv(key)
+	if value == "" {
+		return def
+	}
+	var urls []string
+	for _, url := range strings.Split(value, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		if !strings.HasPrefix(url, "stun:") && !strings.HasPrefix(url, "stuns:") {
+			url = "stun:" + url
+		}
+		if _, err := stun.ParseURI(url); err != nil {
+			invalidConfig("Invalid STUN server %q in %s: %v, ignoring", url, key, err)
+			continue
+		}
+		urls = append(urls, url)
+	}
+	if len(urls) == 0 {
+		invalidConfig("No valid STUN servers in %s=%q, using the defaults", key, value)
+		return def
+	}
+	return urls
+}
+
+func envCodecList(key string) []string {
+	var mimeTypes []string
+	for _, name := range strings.Split(getenv(key), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !strings.Contains(name, "/") {
+			name = "video/" + name
+		}
+		mimeTypes = append(mimeTypes, name)
+	}
+	return mimeTypes
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvZeroTurnsSettingsOff(t *testing.T) {
+	defer func(problems []string) { configProblems = problems }(configProblems)
+
+	tests := []struct {
+		value      string
+		wantInt    int64
+		wantPosInt int64
+		wantDur    time.Duration
+		wantPosDur time.Duration
+	}{
+		{"", 7, 7, 7 * time.Second, 7 * time.Second},
+		{"0", 0, 7, 0, 7 * time.Second},
+		{"0s", 7, 7, 0, 7 * time.Second},
+		{"3", 3, 3, 7 * time.Second, 7 * time.Second},
+		{"3s", 7, 7, 3 * time.Second, 3 * time.Second},
+		{"-1", 7, 7, 7 * time.Second, 7 * time.Second},
+		{"-1s", 7, 7, 7 * time.Second, 7 * time.Second},
+	}
+	for _, test := range tests {
+		t.Setenv("WHEP_TEST_SETTING", test.value)
+		if got := envInt64("WHEP_TEST_SETTING", 7); got != test.wantInt {
+			t.Errorf("envInt64(%q) = %d, want %d", test.value, got, test.wantInt)
+		}
+		if got := envPositiveInt64("WHEP_TEST_SETTING", 7); got != test.wantPosInt {
+			t.Errorf("envPositiveInt64(%q) = %d, want %d", test.value, got, test.wantPosInt)
+		}
+		if got := envDuration("WHEP_TEST_SETTING", 7*time.Second); got != test.wantDur {
+			t.Errorf("envDuration(%q) = %s, want %s", test.value, got, test.wantDur)
+		}
+		if got := envPositiveDuration("WHEP_TEST_SETTING", 7*time.Second); got != test.wantPosDur {
+			t.Errorf("envPositiveDuration(%q) = %s, want %s", test.value, got, test.wantPosDur)
+		}
+	}
+}
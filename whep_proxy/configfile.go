@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the layout of WHEP_CONFIG_FILE, a JSON or YAML file holding any
+// setting otherwise taken from the environment, plus the streams
+// WHEP_STREAMS_FILE would hold and stream aliases:
+//
+//	rtsp: true
+//	stun_servers: [stun.example.com:3478]
+//	admin_token_file: /run/secrets/whep_admin_token
+//	streams:
+//	  front-door: {signaling_url: "wss://...", port: 8081}
+//	aliases:
+//	  porch: front-door
+//
+// Settings are named as their environment variable without WHEP_, in lower
+// case, and lists may be sequences. A setting in the environment overrides
+// the file.
+type Config struct {
+	Settings map[string]string // by environment variable
+	Streams  map[string]streamFileEntry
+	Aliases  map[string]string // see aliases.go
+}
+
+// fileConfig is WHEP_CONFIG_FILE, loaded before any setting is read. A file
+// that can't be loaded is reported by main.
+var fileConfig, fileConfigErr = loadConfigFile(configFile)
+
+// settingsRead are the settings looked up at startup, to spot unknown names in
+// WHEP_CONFIG_FILE, and secretSettings those to redact when logging.
+var (
+	settingsRead   = make(map[string]bool)
+	secretSettings = make(map[string]bool)
+)
+
+func loadConfigFile(path string) (Config, error) {
+	if path == "" {
+		return Config{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	// YAML is a superset of JSON, so one parser reads both
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return Config{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	config := Config{Settings: make(map[string]string)}
+	for name, value := range raw {
+		if name == "streams" {
+			// Entries take the JSON fields of WHEP_STREAMS_FILE
+			data, err := json.Marshal(value)
+			if err == nil {
+				err = json.Unmarshal(data, &config.Streams)
+			}
+			if err != nil {
+				return Config{}, fmt.Errorf("parsing %s: streams: %w", path, err)
+			}
+			continue
+		}
+		if name == "aliases" {
+			data, err := json.Marshal(value)
+			if err == nil {
+				err = json.Unmarshal(data, &config.Aliases)
+			}
+			if err != nil {
+				return Config{}, fmt.Errorf("parsing %s: aliases: %w", path, err)
+			}
+			continue
+		}
+		setting, err := configValue(value)
+		if err != nil {
+			return Config{}, fmt.Errorf("parsing %s: %s: %w", path, name, err)
+		}
+		config.Settings["WHEP_"+strings.ToUpper(name)] = setting
+	}
+	return config, nil
+}
+
+// configValue formats a setting from the file as it would appear in the
+// environment, with lists comma-separated.
+func configValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case bool, int, float64:
+		return fmt.Sprint(value), nil
+	case []interface{}:
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			switch item.(type) {
+			case string, bool, int, float64:
+				items = append(items, fmt.Sprint(item))
+			default:
+				return "", fmt.Errorf("lists may only hold values")
+			}
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("must be a value or a list of values")
+}
+
+// getenv reads a setting from the environment, or else from WHEP_CONFIG_FILE.
+func getenv(key string) string {
+	settingsRead[key] = true
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fileConfig.Settings[key]
+}
+
+// checkConfigFile reports WHEP_CONFIG_FILE settings nothing read, most likely
+// typos. Call it once every setting has been read.
+func checkConfigFile() {
+	for _, key := range sortedSettings(fileConfig.Settings) {
+		if !settingsRead[key] {
+			invalidConfig("Unknown setting %s in WHEP_CONFIG_FILE, ignoring", strings.ToLower(strings.TrimPrefix(key, "WHEP_")))
+		}
+	}
+}
+
+// logConfig logs the settings that aren't left at their defaults, and where
+// each came from. Secrets are redacted; their _FILE paths are not.
+func logConfig() {
+	set := make(map[string]string)
+	for key := range settingsRead {
+		if value := getenv(key); value != "" {
+			set[key] = value
+		}
+	}
+	if len(set) == 0 {
+		fmt.Println("[WHEP_PROXY] Using the default configuration")
+		return
+	}
+	fmt.Println("[WHEP_PROXY] Configuration:")
+	for _, key := range sortedSettings(set) {
+		value := set[key]
+		if secretSettings[key] {
+			value = "<redacted>"
+		}
+		source := "environment"
+		if os.Getenv(key) == "" {
+			source = "WHEP_CONFIG_FILE"
+		}
+		fmt.Printf("[WHEP_PROXY]   %s=%s (%s)\n", key, value, source)
+	}
+}
+
+func sortedSettings(settings map[string]string) []string {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// rtpContinuity rewrites ingest sequence numbers, timestamps and SSRCs so
+// each reconnected ingest carries on from where the last one stopped. Viewers
+// keep their tracks across reconnects, and their jitter buffers would
+// otherwise drop the new packets as late or duplicate.
+type rtpContinuity struct {
+	mu         sync.Mutex
+	started    bool
+	switching  bool // the next packet starts a new ingest track
+	frameTicks uint32
+	seqOffset  uint16
+	tsOffset   uint32
+	lastSeq    uint16
+	lastTS     uint32
+	sourceSSRC uint32 // the camera's current SSRC
+	ssrc       uint32 // the first track's SSRC, sent on for all of them
+}
+
+// newSource marks the start of a new ingest track, returning whether it
+// replaces an earlier one.
+func (c *rtpContinuity) newSource() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.switching = c.started
+	return c.started
+}
+
+// rewrite adjusts pkt in place. frameTicks of timestamp are left between the
+// old track's last packet and the new track's first. A packet whose SSRC
+// changed within a track, as when a camera restarts its encoder but keeps the
+// connection, is treated as starting a new track; rewrite reports it so the
+// caller can ask for a keyframe.
+func (c *rtpContinuity) rewrite(pkt *rtp.Packet) (ssrcChanged bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started {
+		c.ssrc = pkt.SSRC
+	} else if !c.switching && pkt.SSRC != c.sourceSSRC {
+		c.switching = true
+		ssrcChanged = true
+	}
+	if c.switching {
+		c.seqOffset = c.lastSeq + 1 - pkt.SequenceNumber
+		c.tsOffset = c.lastTS + c.frameTicks - pkt.Timestamp
+		c.switching = false
+	}
+	c.started = true
+	c.sourceSSRC = pkt.SSRC
+	pkt.SSRC = c.ssrc
+	pkt.SequenceNumber += c.seqOffset
+	pkt.Timestamp += c.tsOffset
+	c.lastSeq = pkt.SequenceNumber
+	c.lastTS = pkt.Timestamp
+	return ssrcChanged
+}
+
+// insertBefore makes room for a packet inserted ahead of pkt, which must be
+// the last one rewritten, by moving pkt and everything after it up one
+// sequence number. It returns the inserted packet's sequence number.
+func (c *rtpContinuity) insertBefore(pkt *rtp.Packet) uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seq := pkt.SequenceNumber
+	c.seqOffset++
+	pkt.SequenceNumber++
+	c.lastSeq = pkt.SequenceNumber
+	return seq
+}
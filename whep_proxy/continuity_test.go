@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestRTPContinuityAcrossSources(t *testing.T) {
+	c := rtpContinuity{frameTicks: 3000}
+	for i := range 3 {
+		pkt := &rtp.Packet{Header: rtp.Header{SSRC: 1, SequenceNumber: 100 + uint16(i), Timestamp: 9000 + uint32(i)*3000}}
+		if c.rewrite(pkt) {
+			t.Fatal("first track reported an SSRC change")
+		}
+	}
+
+	// The ingest reconnects: a new track, SSRC, and numbering
+	if !c.newSource() {
+		t.Fatal("newSource didn't report replacing a track")
+	}
+	pkt := &rtp.Packet{Header: rtp.Header{SSRC: 2, SequenceNumber: 60000, Timestamp: 42}}
+	if c.rewrite(pkt) {
+		t.Error("a new track reported an SSRC change")
+	}
+	if pkt.SSRC != 1 || pkt.SequenceNumber != 103 || pkt.Timestamp != 18000 {
+		t.Errorf("first packet of the new track = ssrc %d seq %d ts %d, want ssrc 1 seq 103 ts 18000", pkt.SSRC, pkt.SequenceNumber, pkt.Timestamp)
+	}
+	pkt = &rtp.Packet{Header: rtp.Header{SSRC: 2, SequenceNumber: 60001, Timestamp: 3042}}
+	c.rewrite(pkt)
+	if pkt.SequenceNumber != 104 || pkt.Timestamp != 21000 {
+		t.Errorf("second packet of the new track = seq %d ts %d, want seq 104 ts 21000", pkt.SequenceNumber, pkt.Timestamp)
+	}
+
+	// The camera restarts its encoder without reconnecting
+	pkt = &rtp.Packet{Header: rtp.Header{SSRC: 3, SequenceNumber: 7, Timestamp: 7}}
+	if !c.rewrite(pkt) {
+		t.Error("an SSRC change within a track wasn't reported")
+	}
+	if pkt.SSRC != 1 || pkt.SequenceNumber != 105 || pkt.Timestamp != 24000 {
+		t.Errorf("packet after the SSRC change = ssrc %d seq %d ts %d, want ssrc 1 seq 105 ts 24000", pkt.SSRC, pkt.SequenceNumber, pkt.Timestamp)
+	}
+}
+
+// A viewer connected across an ingest restart keeps one SSRC and unbroken
+// numbering, though the camera starts a new track.
+func TestViewerContinuousAcrossRestart(t *testing.T) {
+	camera := newFakeCamera(t, nil)
+	stream := registerStream(t, "continuous-restart", camera)
+	waitForIngest(t, stream)
+
+	viewer := newTestViewer(t)
+	if recorder := viewer.offer(t, testRouter(), "continuous-restart"); recorder.Code != http.StatusCreated {
+		t.Fatalf("offer returned %d: %s", recorder.Code, recorder.Body)
+	}
+	pkts := viewer.waitForPackets(t, 10, 5*time.Second)
+
+	recorder := httptest.NewRecorder()
+	restartHandler(recorder, withVars(httptest.NewRequest(http.MethodPost, "/streams/continuous-restart/restart", nil), "streamID", "continuous-restart"))
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("restart returned %d: %s", recorder.Code, recorder.Body)
+	}
+	waitFor(t, 10*time.Second, "the camera to answer a second offer", func() bool {
+		return camera.offerCount() >= 2
+	})
+	waitForIngest(t, stream)
+	pkts = append(pkts, viewer.waitForPackets(t, 30, 5*time.Second)...)
+
+	for i := 1; i < len(pkts); i++ {
+		prev, pkt := pkts[i-1], pkts[i]
+		if pkt.SSRC != prev.SSRC {
+			t.Fatalf("packet %d switched SSRC from %d to %d", i, prev.SSRC, pkt.SSRC)
+		}
+		// Allow a little loss, but not a jump to the new track's numbering
+		if gap := pkt.SequenceNumber - prev.SequenceNumber; gap == 0 || gap > 5 {
+			t.Errorf("packet %d jumped from seq %d to %d", i, prev.SequenceNumber, pkt.SequenceNumber)
+		}
+		if step := pkt.Timestamp - prev.Timestamp; step > 10*3000 {
+			t.Errorf("packet %d jumped from ts %d to %d", i, prev.Timestamp, pkt.Timestamp)
+		}
+	}
+}
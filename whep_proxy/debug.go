@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+)
+
+// debugStats is what /debug/stats reports, to correlate connection churn with
+// goroutine and memory growth when hunting leaks.
+type debugStats struct {
+	Goroutines      int                  `json:"goroutines"`
+	HeapBytes       uint64               `json:"heapBytes"`
+	Streams         int                  `json:"streams"`
+	Viewers         int                  `json:"viewers"`
+	PeerConnections debugPeerConnections `json:"peerConnections"`
+}
+
+// debugPeerConnections counts the PeerConnections the streams hold that
+// aren't closed yet. One that's closed but still counted, or a goroutine
+// count that keeps growing with these steady, points to a leak.
+type debugPeerConnections struct {
+	Ingest int `json:"ingest"` // including extra sources
+	Viewer int `json:"viewer"`
+}
+
+// debugStatsHandler serves /debug/stats.
+func debugStatsHandler(w http.ResponseWriter, r *http.Request) {
+	streamsMu.Lock()
+	snapshot := make([]*WebRTCStream, 0, len(streams))
+	for _, stream := range streams {
+		snapshot = append(snapshot, stream)
+	}
+	streamsMu.Unlock()
+
+	stats := debugStats{Streams: len(snapshot)}
+	open := func(peerConnection *webrtc.PeerConnection) bool {
+		return peerConnection != nil && peerConnection.ConnectionState() != webrtc.PeerConnectionStateClosed
+	}
+	for _, stream := range snapshot {
+		stream.mu.Lock()
+		if open(stream.peerConnection) {
+			stats.PeerConnections.Ingest++
+		}
+		for _, ingest := range stream.sources {
+			if open(ingest.peerConnection) {
+				stats.PeerConnections.Ingest++
+			}
+		}
+		stats.Viewers += len(stream.viewers)
+		for _, viewer := range stream.viewers {
+			if open(viewer.peerConnection) {
+				stats.PeerConnections.Viewer++
+			}
+		}
+		stream.mu.Unlock()
+	}
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	stats.Goroutines = runtime.NumGoroutine()
+	stats.HeapBytes = memStats.HeapAlloc
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleDebug adds /debug/stats and the pprof profiles under /debug/pprof/
+// to r, behind adminOnly. /debug/pprof/goroutine?debug=1 groups the running
+// goroutines by stack, which shows what a leak is stuck in.
+func handleDebug(r *mux.Router) {
+	r.HandleFunc("/debug/stats", adminOnly(debugStatsHandler)).Methods("GET")
+	r.HandleFunc("/debug/pprof/cmdline", adminOnly(pprof.Cmdline)).Methods("GET")
+	r.HandleFunc("/debug/pprof/profile", adminOnly(pprof.Profile)).Methods("GET")
+	r.HandleFunc("/debug/pprof/symbol", adminOnly(pprof.Symbol)).Methods("GET", "POST")
+	r.HandleFunc("/debug/pprof/trace", adminOnly(pprof.Trace)).Methods("GET")
+	r.PathPrefix("/debug/pprof/").HandlerFunc(adminOnly(pprof.Index)).Methods("GET")
+}
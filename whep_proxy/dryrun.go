@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runDryRunOffer prints the SDP offer the proxy would send a camera, for
+// -dry-run-offer, without gathering candidates or connecting anything. It
+// uses the codec, header extension and audio settings from the environment,
+// and with a stream ID that stream's entry in the streams file, e.g. its
+// h264_fmtp. The offer goes to stdout, for diffing against a working client's;
+// notes go to stderr. It returns the process exit code.
+func runDryRunOffer(streamID string) int {
+	fail := func(format string, args ...interface{}) int {
+		fmt.Fprintf(os.Stderr, "[WHEP_PROXY] "+format+"\n", args...)
+		return 1
+	}
+	var config WebRTCConfig
+	if streamID != "" {
+		entries, source, err := loadStreams()
+		if err != nil {
+			return fail("Cannot load streams: %v", err)
+		}
+		entry, ok := entries[streamID]
+		if !ok {
+			return fail("Stream %s isn't in %q", streamID, source)
+		}
+		config = entry.WebRTCConfig
+	}
+	// Without ICE servers nothing is resolved while building the offer
+	config.ICEServers = []ICEServer{}
+
+	peerConnection, err := newIngestPeerConnection(config)
+	if err != nil {
+		return fail("Cannot create ingest PeerConnection: %v", err)
+	}
+	defer peerConnection.Close()
+	if err := addIngestTransceivers(peerConnection, config); err != nil {
+		return fail("%v", err)
+	}
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return fail("Cannot create offer: %v", err)
+	}
+	for _, source := range config.Sources {
+		fmt.Fprintf(os.Stderr, "[WHEP_PROXY] Leaving out %s, which is offered to its own source\n", source.Media)
+	}
+	fmt.Fprintln(os.Stderr, "[WHEP_PROXY] Candidates are left out, they're gathered when the offer is sent")
+	fmt.Print(offer.SDP)
+	return 0
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// h264ClockRate is the RTP clock of H264 video, for measuring a GOP's length.
+const h264ClockRate = 90000
+
+// gopCache holds a stream's video packets since the last keyframe, see
+// WHEP_GOP_CACHE. It's guarded by the stream's mu. Packets are shared with the
+// viewers' queues, which only read them.
+type gopCache struct {
+	packets []*rtp.Packet
+	bytes   int64
+	// skipping is set when the current GOP outgrew the limits, until the
+	// next keyframe
+	skipping bool
+}
+
+// add appends a forwarded packet. A keyframe starts a new GOP, unless it
+// continues the keyframe already at the head, as the IDR slice after its
+// SPS and PPS does.
+func (c *gopCache) add(pkt *rtp.Packet, keyframe bool) {
+	if keyframe && (len(c.packets) == 0 || pkt.Timestamp != c.packets[0].Timestamp) {
+		c.reset()
+	}
+	if c.skipping || len(c.packets) == 0 && !keyframe {
+		return
+	}
+	size := int64(pkt.MarshalSize())
+	if len(c.packets) > 0 {
+		length := time.Duration(pkt.Timestamp-c.packets[0].Timestamp) * time.Second / h264ClockRate
+		if length > gopCacheMaxAge || c.bytes+size > gopCacheMaxBytes || int64(len(c.packets)) >= viewerBacklog {
+			c.reset()
+			c.skipping = true
+			return
+		}
+	}
+	c.packets = append(c.packets, pkt)
+	c.bytes += size
+}
+
+func (c *gopCache) reset() {
+	c.packets = nil
+	c.bytes = 0
+	c.skipping = false
+}
+
+// replayGOP queues the cached GOP for a viewer that just connected, ahead of
+// live video. Packets queued before the viewer's SRTP was ready were dropped
+// by Pion and are part of the GOP, so they're replaced rather than repeated.
+func (s *WebRTCStream) replayGOP(viewer *viewerSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gop == nil || len(s.gop.packets) == 0 || viewer.track == nil || s.viewers[viewer.id] != viewer {
+		return
+	}
+	for drained := false; !drained; {
+		select {
+		case <-viewer.queue:
+		default:
+			drained = true
+		}
+	}
+	// The cache is capped at WHEP_VIEWER_BACKLOG packets, so this fits
+	for _, pkt := range s.gop.packets {
+		viewer.queue <- pkt
+	}
+	viewer.resyncing = false
+	logDebugf("Replayed %d cached packets to viewer %s", len(s.gop.packets), viewer.id)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// HLS output is video-only MPEG-TS, segmented on keyframes and kept in memory.
+const (
+	hlsPATPID   = 0x0000
+	hlsPMTPID   = 0x1000
+	hlsVideoPID = 0x0100
+	hlsPTSDelay = 9000 // 100ms of PTS ahead of PCR
+)
+
+type hlsSegment struct {
+	sequence int
+	duration float64 // seconds
+	data     []byte
+}
+
+// hlsMuxer turns a stream's H264 RTP into a rolling window of TS segments.
+type hlsMuxer struct {
+	mu           sync.Mutex
+	depacketizer codecs.H264Packet
+
+	started bool
+	ssrc    uint32
+	lastTS  uint32
+	lastPTS int64 // 90kHz, unwrapped across timestamp wraps and reconnects
+
+	au    []byte
+	auPTS int64
+
+	current      []byte // segment being written, nil until the first keyframe
+	currentStart int64
+	segments     []hlsSegment
+	nextSequence int
+	continuity   map[uint16]byte
+}
+
+func newHLSMuxer() *hlsMuxer {
+	return &hlsMuxer{continuity: make(map[uint16]byte)}
+}
+
+// writeRTP adds an ingest video packet, emitting an access unit on each
+// marker bit or timestamp change.
+func (m *hlsMuxer) writeRTP(pkt *rtp.Packet) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.started || pkt.SSRC != m.ssrc {
+		// A reconnected ingest starts a new timeline; continue ours after it
+		if m.started {
+			m.lastPTS += 3000
+		}
+		m.started = true
+		m.ssrc = pkt.SSRC
+		m.lastTS = pkt.Timestamp
+		m.au = nil
+		m.depacketizer = codecs.H264Packet{}
+	}
+	pts := m.lastPTS + int64(int32(pkt.Timestamp-m.lastTS))
+	m.lastTS = pkt.Timestamp
+	m.lastPTS = pts
+
+	if len(m.au) > 0 && pts != m.auPTS {
+		m.writeAccessUnit()
+	}
+
+	nals, err := m.depacketizer.Unmarshal(pkt.Payload)
+	if err != nil {
+		logDebugf("Dropping H264 packet for HLS: %v", err)
+		return
+	}
+	if len(nals) > 0 {
+		if len(m.au) == 0 {
+			m.auPTS = pts
+		}
+		m.au = append(m.au, nals...)
+	}
+	if pkt.Marker && len(m.au) > 0 {
+		m.writeAccessUnit()
+	}
+}
+
+func (m *hlsMuxer) writeAccessUnit() {
+	au, pts := m.au, m.auPTS
+	m.au = nil
+
+	keyframe := h264IsKeyframe(au)
+	if m.current == nil && !keyframe {
+		return // segments must start on a keyframe
+	}
+	if keyframe && (m.current == nil || float64(pts-m.currentStart)/90000 >= hlsSegmentDuration.Seconds()) {
+		m.finishSegment(pts)
+		m.current = []byte{}
+		m.currentStart = pts
+		m.writePSI()
+	}
+	m.writePES(au, pts, keyframe)
+}
+
+// finishSegment publishes the current segment, dropping the oldest beyond
+// WHEP_HLS_SEGMENT_COUNT.
+func (m *hlsMuxer) finishSegment(end int64) {
+	if m.current == nil {
+		return
+	}
+	m.segments = append(m.segments, hlsSegment{
+		sequence: m.nextSequence,
+		duration: float64(end-m.currentStart) / 90000,
+		data:     m.current,
+	})
+	m.nextSequence++
+	if len(m.segments) > int(hlsSegmentCount) {
+		m.segments = m.segments[len(m.segments)-int(hlsSegmentCount):]
+	}
+	m.current = nil
+}
+
+func (m *hlsMuxer) playlist() (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.segments) == 0 {
+		return "", false
+	}
+
+	target := 1.0
+	for _, segment := range m.segments {
+		target = math.Max(target, math.Ceil(segment.duration))
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(target))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", m.segments[0].sequence)
+	for _, segment := range m.segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.ts\n", segment.duration, segment.sequence)
+	}
+	return b.String(), true
+}
+
+func (m *hlsMuxer) segment(sequence int) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, segment := range m.segments {
+		if segment.sequence == sequence {
+			return segment.data, true
+		}
+	}
+	return nil, false
+}
+
+// writePSI starts a segment with the PAT and PMT so it can be played alone.
+func (m *hlsMuxer) writePSI() {
+	pat := []byte{
+		0x00,       // table_id
+		0xb0, 0x0d, // section_syntax_indicator, section_length
+		0x00, 0x01, // transport_stream_id
+		0xc1,       // version 0, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		0x00, 0x01, // program_number
+		0xe0 | hlsPMTPID>>8, hlsPMTPID & 0xff,
+	}
+	pmt := []byte{
+		0x02,       // table_id
+		0xb0, 0x12, // section_syntax_indicator, section_length
+		0x00, 0x01, // program_number
+		0xc1,       // version 0, current_next_indicator
+		0x00, 0x00, // section_number, last_section_number
+		0xe0 | hlsVideoPID>>8, hlsVideoPID & 0xff, // PCR_PID
+		0xf0, 0x00, // program_info_length
+		0x1b, // stream_type: H264
+		0xe0 | hlsVideoPID>>8, hlsVideoPID & 0xff,
+		0xf0, 0x00, // ES_info_length
+	}
+	for _, table := range []struct {
+		pid     uint16
+		section []byte
+	}{{hlsPATPID, pat}, {hlsPMTPID, pmt}} {
+		payload := append([]byte{0x00}, table.section...) // pointer_field
+		crc := mpegCRC32(table.section)
+		payload = append(payload, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+		payload = append(payload, bytes.Repeat([]byte{0xff}, 184-len(payload))...)
+		m.writePacket(table.pid, true, nil, payload)
+	}
+}
+
+// writePES writes an access unit as one PES packet, carrying the PCR in its
+// first TS packet.
+func (m *hlsMuxer) writePES(au []byte, pts int64, keyframe bool) {
+	pesPTS := pts + hlsPTSDelay
+	pes := []byte{
+		0x00, 0x00, 0x01, 0xe0, // start code, video stream_id
+		0x00, 0x00, // PES_packet_length: unbounded
+		0x80, // marker bits
+		0x80, // PTS only
+		0x05, // PES_header_data_length
+		byte(0x21 | (pesPTS>>29)&0x0e), byte(pesPTS >> 22),
+		byte(0x01 | (pesPTS>>14)&0xfe), byte(pesPTS >> 7),
+		byte(0x01 | (pesPTS<<1)&0xfe),
+		0x00, 0x00, 0x00, 0x01, 0x09, 0xf0, // access unit delimiter
+	}
+	pes = append(pes, au...)
+
+	flags := byte(0x10) // PCR_flag
+	if keyframe {
+		flags |= 0x40 // random_access_indicator
+	}
+	adaptation := []byte{
+		flags,
+		byte(pts >> 25), byte(pts >> 17), byte(pts >> 9), byte(pts >> 1),
+		byte(pts<<7) | 0x7e, 0x00,
+	}
+
+	first := true
+	for len(pes) > 0 {
+		n := m.writePacket(hlsVideoPID, first, adaptation, pes)
+		pes = pes[n:]
+		first = false
+		adaptation = nil
+	}
+}
+
+// writePacket writes one 188-byte TS packet with as much of payload as fits,
+// stuffing the adaptation field when it runs short. adaptation is the field
+// body after its length byte, or nil for none. It returns the payload bytes
+// consumed.
+func (m *hlsMuxer) writePacket(pid uint16, unitStart bool, adaptation []byte, payload []byte) int {
+	space := 184
+	if adaptation != nil {
+		space -= 1 + len(adaptation)
+	}
+	n := min(len(payload), space)
+	if stuffing := space - n; stuffing > 0 {
+		if adaptation == nil {
+			adaptation = []byte{}
+			stuffing--
+			if stuffing > 0 {
+				adaptation = append(adaptation, 0x00) // no flags
+				stuffing--
+			}
+		}
+		adaptation = append(adaptation, bytes.Repeat([]byte{0xff}, stuffing)...)
+	}
+
+	header := byte(0x00)
+	if unitStart {
+		header = 0x40
+	}
+	control := byte(0x10) // payload only
+	if adaptation != nil {
+		control = 0x30 // adaptation field and payload
+	}
+	cc := m.continuity[pid]
+	m.continuity[pid] = (cc + 1) & 0x0f
+
+	m.current = append(m.current, 0x47, header|byte(pid>>8), byte(pid), control|cc)
+	if adaptation != nil {
+		m.current = append(m.current, byte(len(adaptation)))
+		m.current = append(m.current, adaptation...)
+	}
+	m.current = append(m.current, payload[:n]...)
+	return n
+}
+
+// h264IsKeyframe reports whether an Annex B access unit contains an IDR slice.
+func h264IsKeyframe(au []byte) bool {
+	for i := 0; i+3 < len(au); i++ {
+		if au[i] == 0 && au[i+1] == 0 && au[i+2] == 1 {
+			if au[i+3]&0x1f == 5 {
+				return true
+			}
+			i += 2
+		}
+	}
+	return false
+}
+
+// mpegCRC32 is the CRC-32/MPEG-2 used by PSI sections.
+func mpegCRC32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func hlsPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	streamID := mux.Vars(r)["streamID"]
+
+	stream, ok := getStream(streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+	playlist, ok := stream.hls.playlist()
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s has no segments yet", streamID), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, playlist)
+}
+
+func hlsSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	streamID := vars["streamID"]
+
+	stream, ok := getStream(streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+	sequence, err := strconv.Atoi(vars["sequence"])
+	if err != nil {
+		http.Error(w, "Invalid segment", http.StatusBadRequest)
+		return
+	}
+	data, ok := stream.hls.segment(sequence)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Segment %d not found", sequence), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Write(data)
+}
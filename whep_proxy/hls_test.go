@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+type tsPacket struct {
+	pid        uint16
+	unitStart  bool
+	cc         byte
+	adaptation []byte // after the length byte, nil without one
+	payload    []byte
+}
+
+// parseTS splits muxer output into TS packets, failing on anything that
+// isn't a whole number of well-formed 188-byte packets.
+func parseTS(t *testing.T, data []byte) []tsPacket {
+	t.Helper()
+	if len(data)%188 != 0 {
+		t.Fatalf("%d bytes of TS isn't a whole number of packets", len(data))
+	}
+	var packets []tsPacket
+	for i := 0; i < len(data); i += 188 {
+		b := data[i : i+188]
+		if b[0] != 0x47 {
+			t.Fatalf("packet %d sync byte = %#x", i/188, b[0])
+		}
+		p := tsPacket{
+			pid:       uint16(b[1]&0x1f)<<8 | uint16(b[2]),
+			unitStart: b[1]&0x40 != 0,
+			cc:        b[3] & 0x0f,
+		}
+		rest := b[4:]
+		if b[3]&0x20 != 0 {
+			n := int(rest[0])
+			p.adaptation = rest[1 : 1+n]
+			rest = rest[1+n:]
+		}
+		if b[3]&0x10 != 0 {
+			p.payload = rest
+		}
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+// checkContinuity fails unless each PID's continuity counter goes up by one,
+// wrapping at 16, from packet to packet.
+func checkContinuity(t *testing.T, packets []tsPacket) {
+	t.Helper()
+	last := make(map[uint16]byte)
+	for i, p := range packets {
+		if cc, ok := last[p.pid]; ok && p.cc != (cc+1)&0x0f {
+			t.Errorf("packet %d on PID %#x has continuity %d after %d", i, p.pid, p.cc, cc)
+		}
+		last[p.pid] = p.cc
+	}
+}
+
+func TestMPEGCRC32(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want uint32
+	}{
+		{"empty", nil, 0xffffffff},
+		{"check", []byte("123456789"), 0x0376e6e7},
+		{"pat", []byte{0x00, 0xb0, 0x0d, 0x00, 0x01, 0xc1, 0x00, 0x00, 0x00, 0x01, 0xf0, 0x00}, 0x2ab104b2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := mpegCRC32(test.data); got != test.want {
+				t.Errorf("mpegCRC32 = %#08x, want %#08x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHLSPSI(t *testing.T) {
+	m := newHLSMuxer()
+	m.current = []byte{}
+	m.writePSI()
+	packets := parseTS(t, m.current)
+	if len(packets) != 2 {
+		t.Fatalf("PSI took %d packets, want 2", len(packets))
+	}
+
+	tests := []struct {
+		name    string
+		pid     uint16
+		tableID byte
+	}{
+		{"pat", hlsPATPID, 0x00},
+		{"pmt", hlsPMTPID, 0x02},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := packets[i]
+			if p.pid != test.pid || !p.unitStart || p.adaptation != nil {
+				t.Fatalf("packet = PID %#x, unit start %v, adaptation %x", p.pid, p.unitStart, p.adaptation)
+			}
+			if p.payload[0] != 0 {
+				t.Fatalf("pointer_field = %d, want 0", p.payload[0])
+			}
+			section := p.payload[1:]
+			if section[0] != test.tableID {
+				t.Errorf("table_id = %#x, want %#x", section[0], test.tableID)
+			}
+			length := int(section[1]&0x0f)<<8 | int(section[2])
+			// The CRC over a section including its own CRC comes to zero
+			if crc := mpegCRC32(section[:3+length]); crc != 0 {
+				t.Errorf("section CRC residue = %#08x, want 0", crc)
+			}
+			if stuffing := section[3+length:]; len(bytes.Trim(stuffing, "\xff")) != 0 {
+				t.Errorf("stuffing after section = %x, want all 0xff", stuffing)
+			}
+		})
+	}
+}
+
+func TestHLSPES(t *testing.T) {
+	au := append([]byte{0x00, 0x00, 0x00, 0x01, 0x65}, bytes.Repeat([]byte{0xab}, 3000)...)
+	tests := []struct {
+		name     string
+		pts      int64
+		keyframe bool
+	}{
+		{"zero", 0, true},
+		{"one second", 90000, false},
+		{"bit 30", 1 << 30, true},
+		{"bit 32", 1<<32 + 12345, false},
+		{"last", 1<<33 - 1 - hlsPTSDelay, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newHLSMuxer()
+			m.current = []byte{}
+			m.writePES(au, test.pts, test.keyframe)
+			packets := parseTS(t, m.current)
+			checkContinuity(t, packets)
+
+			first := packets[0]
+			if !first.unitStart || first.adaptation == nil {
+				t.Fatalf("first packet: unit start %v, adaptation %x", first.unitStart, first.adaptation)
+			}
+			a := first.adaptation
+			if got := a[0]&0x40 != 0; got != test.keyframe {
+				t.Errorf("random_access_indicator = %v, want %v", got, test.keyframe)
+			}
+			if a[0]&0x10 == 0 {
+				t.Fatal("no PCR in the first packet")
+			}
+			pcr := int64(a[1])<<25 | int64(a[2])<<17 | int64(a[3])<<9 | int64(a[4])<<1 | int64(a[5])>>7
+			if pcr != test.pts {
+				t.Errorf("PCR = %d, want %d", pcr, test.pts)
+			}
+
+			var pes []byte
+			for i, p := range packets {
+				if p.pid != hlsVideoPID {
+					t.Fatalf("packet %d on PID %#x", i, p.pid)
+				}
+				if i > 0 && p.unitStart {
+					t.Fatalf("packet %d starts another unit", i)
+				}
+				pes = append(pes, p.payload...)
+			}
+			if !bytes.Equal(pes[:4], []byte{0x00, 0x00, 0x01, 0xe0}) {
+				t.Fatalf("PES start = %x", pes[:4])
+			}
+			h := pes[9:14]
+			if h[0]&0xf1 != 0x21 || h[2]&0x01 != 1 || h[4]&0x01 != 1 {
+				t.Errorf("PTS marker bits wrong in %x", h)
+			}
+			pts := int64(h[0]>>1&0x07)<<30 | int64(h[1])<<22 | int64(h[2]>>1)<<15 | int64(h[3])<<7 | int64(h[4]>>1)
+			if want := test.pts + hlsPTSDelay; pts != want {
+				t.Errorf("PTS = %d, want %d", pts, want)
+			}
+			want := append([]byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xf0}, au...)
+			if !bytes.Equal(pes[14:], want) {
+				t.Errorf("PES carries %d bytes, want the delimiter and %d-byte access unit", len(pes[14:]), len(au))
+			}
+		})
+	}
+}
+
+func TestHLSSegmentsCutOnKeyframes(t *testing.T) {
+	defer func(d time.Duration) { hlsSegmentDuration = d }(hlsSegmentDuration)
+	hlsSegmentDuration = 2 * time.Second
+
+	// Frames are every half second, given as whether each is a keyframe
+	tests := []struct {
+		name      string
+		keyframes []bool
+		want      []float64 // durations of finished segments
+	}{
+		{
+			"keyframe every second",
+			[]bool{true, false, true, false, true, false, true, false, true, false},
+			[]float64{2, 2},
+		},
+		{
+			"late keyframe",
+			[]bool{true, false, false, false, false, false, false, true, false},
+			[]float64{3.5},
+		},
+		{
+			"leading delta frames",
+			[]bool{false, false, true, false, false, false, true, false},
+			[]float64{2},
+		},
+		{
+			"no keyframe",
+			[]bool{false, false, false, false, false, false},
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newHLSMuxer()
+			for i, keyframe := range test.keyframes {
+				nal := byte(0x41)
+				if keyframe {
+					nal = 0x65
+				}
+				m.writeRTP(&rtp.Packet{
+					Header:  rtp.Header{SSRC: 5, SequenceNumber: uint16(i), Timestamp: uint32(i * 45000), Marker: true},
+					Payload: []byte{nal, 0x88, 0x84},
+				})
+			}
+
+			if len(m.segments) != len(test.want) {
+				t.Fatalf("%d segments, want %d", len(m.segments), len(test.want))
+			}
+			var all []tsPacket
+			for i, segment := range m.segments {
+				if segment.duration != test.want[i] {
+					t.Errorf("segment %d lasts %.3fs, want %.3fs", i, segment.duration, test.want[i])
+				}
+				packets := parseTS(t, segment.data)
+				all = append(all, packets...)
+				if len(packets) < 3 || packets[0].pid != hlsPATPID || packets[1].pid != hlsPMTPID {
+					t.Fatalf("segment %d doesn't start with the PAT and PMT", i)
+				}
+				if video := packets[2]; video.pid != hlsVideoPID || video.adaptation[0]&0x40 == 0 {
+					t.Errorf("segment %d doesn't start on a keyframe", i)
+				}
+			}
+			checkContinuity(t, all)
+		})
+	}
+}
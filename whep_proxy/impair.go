@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Impairment testing lets a WHEP client degrade its own video, to exercise a
+// player against a bad network without impairing a real link. It's only for
+// testing players: with WHEP_IMPAIRMENT_TESTING set, a viewer opts in with
+// query parameters on its offer POST:
+//
+//	impair_delay=200ms  holds every packet this long
+//	impair_jitter=50ms  adds up to this much more per packet, at random
+//	impair_loss=5       drops this percentage of packets
+//	impair_seed=1       seeds the randomness, so runs repeat exactly
+//
+// It's applied to the viewer's own video queue, so other viewers, its audio,
+// HLS and RTSP are unaffected. Packets stay in order.
+type viewerImpairment struct {
+	delay  time.Duration
+	jitter time.Duration
+	loss   float64 // percent
+	seed   int64
+}
+
+// impairedPacket is a packet held until it's due.
+type impairedPacket struct {
+	pkt *rtp.Packet
+	due time.Time
+}
+
+// parseImpairment reads a viewer's impair_* query parameters. It returns nil
+// if there are none.
+func parseImpairment(query url.Values) (*viewerImpairment, error) {
+	impairment := &viewerImpairment{seed: time.Now().UnixNano()}
+	requested := false
+	for key, target := range map[string]*time.Duration{"impair_delay": &impairment.delay, "impair_jitter": &impairment.jitter} {
+		value := query.Get(key)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative duration, got %q", key, value)
+		}
+		*target = duration
+		requested = true
+	}
+	if value := query.Get("impair_loss"); value != "" {
+		loss, err := strconv.ParseFloat(value, 64)
+		if err != nil || loss < 0 || loss > 100 {
+			return nil, fmt.Errorf("impair_loss must be a percentage from 0 to 100, got %q", value)
+		}
+		impairment.loss = loss
+		requested = true
+	}
+	if value := query.Get("impair_seed"); value != "" {
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("impair_seed must be an integer, got %q", value)
+		}
+		impairment.seed = seed
+	}
+	if !requested {
+		return nil, nil
+	}
+	return impairment, nil
+}
+
+func (i *viewerImpairment) String() string {
+	return fmt.Sprintf("delay %s, jitter %s, loss %g%%, seed %d", i.delay, i.jitter, i.loss, i.seed)
+}
+
+// apply passes a viewer's video queue through the impairment, returning the
+// queue to send from. It's closed once queue is closed and drained. Packets
+// are stamped as they're queued, and the held backlog is capped at
+// WHEP_VIEWER_BACKLOG packets, beyond which they're dropped too.
+func (i *viewerImpairment) apply(queue <-chan *rtp.Packet) <-chan *rtp.Packet {
+	held := make(chan impairedPacket, viewerBacklog)
+	impaired := make(chan *rtp.Packet)
+	go func() {
+		defer close(held)
+		random := rand.New(rand.NewSource(i.seed))
+		var lastDue time.Time
+		for pkt := range queue {
+			if random.Float64()*100 < i.loss {
+				continue
+			}
+			due := time.Now().Add(i.delay)
+			if i.jitter > 0 {
+				due = due.Add(time.Duration(random.Int63n(int64(i.jitter) + 1)))
+			}
+			if due.Before(lastDue) {
+				due = lastDue
+			}
+			lastDue = due
+			select {
+			case held <- impairedPacket{pkt, due}:
+			default:
+			}
+		}
+	}()
+	go func() {
+		defer close(impaired)
+		for packet := range held {
+			time.Sleep(time.Until(packet.due))
+			impaired <- packet.pkt
+		}
+	}()
+	return impaired
+}
@@ -0,0 +1,967 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// newIngestPeerConnection builds the camera-facing PeerConnection with the
+// codecs and header extensions the KVS signaling expects.
+func newIngestPeerConnection(config WebRTCConfig) (*webrtc.PeerConnection, error) {
+	iceServers := config.webrtcICEServers()
+
+	// If no ICE servers provided, use the public STUN servers
+	if config.ICEServers == nil {
+		iceServers = []webrtc.ICEServer{
+			{
+				URLs: stunServers,
+			},
+		}
+	}
+
+	// Create media engine
+	m := &webrtc.MediaEngine{}
+
+	// Register RTP header extensions
+	for _, extension := range []string{
+		"urn:ietf:params:rtp-hdrext:sdes:mid",
+		"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+		"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+	} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, fmt.Errorf("registering extension %s: %w", extension, err)
+		}
+		if disableAudio {
+			continue
+		}
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, fmt.Errorf("registering extension %s: %w", extension, err)
+		}
+	}
+	if timestampExtension != "" {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: timestampExtension}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, fmt.Errorf("registering extension %s: %w", timestampExtension, err)
+		}
+	}
+
+	// Only advertise NACK when the interceptors will act on it
+	feedback := []webrtc.RTCPFeedback{}
+	if nackEnabled {
+		feedback = append(feedback, webrtc.RTCPFeedback{Type: "nack", Parameter: ""})
+	}
+	videoFeedback := feedback
+	if keyframeRequest != "pli" {
+		videoFeedback = append(videoFeedback, webrtc.RTCPFeedback{Type: "ccm", Parameter: "fir"})
+	}
+
+	// Register H264 codec
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			Channels:     0,
+			SDPFmtpLine:  config.h264Fmtp(),
+			RTCPFeedback: videoFeedback,
+		},
+		PayloadType: 102,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, fmt.Errorf("registering H264 codec: %w", err)
+	}
+
+	// Register PCMU codec
+	if !disableAudio {
+		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     "audio/PCMU",
+				ClockRate:    8000,
+				Channels:     1,
+				RTCPFeedback: feedback,
+			},
+			PayloadType: 0,
+		}, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, fmt.Errorf("registering PCMU codec: %w", err)
+		}
+	}
+	interceptorRegistry, err := newIngestInterceptors(m)
+	if err != nil {
+		return nil, fmt.Errorf("registering interceptors: %w", err)
+	}
+
+	settingEngine := webrtc.SettingEngine{}
+	if err := applySocketOptions(&settingEngine); err != nil {
+		return nil, fmt.Errorf("applying socket options: %w", err)
+	}
+	applyAdvertisedIP(&settingEngine)
+	applyIPFamily(&settingEngine)
+	applySRTPProfiles(&settingEngine)
+
+	// Create the API object with the MediaEngine
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
+		webrtc.WithSettingEngine(settingEngine),
+	).NewPeerConnection(webrtc.Configuration{
+		ICEServers:         iceServers,
+		ICETransportPolicy: config.iceTransportPolicy(ingestICEPolicy),
+	})
+}
+
+// newIngestInterceptors mirrors webrtc.RegisterDefaultInterceptors, but with
+// the NACK and RTCP report settings taken from the environment.
+func newIngestInterceptors(m *webrtc.MediaEngine) (*interceptor.Registry, error) {
+	interceptorRegistry := &interceptor.Registry{}
+
+	if nackEnabled {
+		generator, err := nack.NewGeneratorInterceptor(
+			nack.GeneratorSize(uint16(nackBufferSize)),
+			nack.GeneratorInterval(nackInterval),
+		)
+		if err != nil {
+			return nil, err
+		}
+		responder, err := nack.NewResponderInterceptor(nack.ResponderSize(uint16(nackBufferSize)))
+		if err != nil {
+			return nil, err
+		}
+		m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+		m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+		interceptorRegistry.Add(responder)
+		interceptorRegistry.Add(generator)
+	}
+
+	receiver, err := report.NewReceiverInterceptor(report.ReceiverInterval(rtcpReportInterval))
+	if err != nil {
+		return nil, err
+	}
+	sender, err := report.NewSenderInterceptor(report.SenderInterval(rtcpReportInterval))
+	if err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(receiver)
+	interceptorRegistry.Add(sender)
+
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(m); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureTWCCSender(m, interceptorRegistry); err != nil {
+		return nil, err
+	}
+	return interceptorRegistry, nil
+}
+
+// startIngest negotiates a new camera PeerConnection for the stream over conn.
+// Call it without stream.mu: it gathers ICE candidates first, which can take
+// seconds, and only takes the lock to make the connection the stream's ingest.
+func startIngest(streamID string, stream *WebRTCStream, conn Signaler) error {
+	peerConnection, offer, err := offerIngest(streamID, stream, conn)
+	if err != nil {
+		return err
+	}
+	stream.mu.Lock()
+	if stream.closed {
+		stream.mu.Unlock()
+		peerConnection.Close()
+		return errStreamClosed
+	}
+	newSignaler := publishIngest(stream, conn, peerConnection)
+	stream.mu.Unlock()
+	return sendIngestOffer(streamID, stream, conn, peerConnection, offer, newSignaler)
+}
+
+// offerIngest creates a camera PeerConnection and its offer, and waits for ICE
+// gathering to complete. Candidates trickle out over conn as they're found.
+// It doesn't touch the stream's guarded fields, and closes the connection if
+// it fails.
+func offerIngest(streamID string, stream *WebRTCStream, conn Signaler) (*webrtc.PeerConnection, webrtc.SessionDescription, error) {
+	log := stream.log
+	peerConnection, err := newIngestPeerConnection(stream.config)
+	if err != nil {
+		return nil, webrtc.SessionDescription{}, err
+	}
+	fail := func(err error) (*webrtc.PeerConnection, webrtc.SessionDescription, error) {
+		peerConnection.Close()
+		return nil, webrtc.SessionDescription{}, err
+	}
+
+	if err := addIngestTransceivers(peerConnection, stream.config); err != nil {
+		return fail(err)
+	}
+
+	// Handlers go in before the local description, which starts gathering
+	peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			candidate := c.ToJSON()
+			log.Printf("New ICE candidate: %v\n", candidate)
+			if err := conn.WriteJSON(iceCandidateMessage{Type: "iceCandidate", Candidate: candidate}); err != nil {
+				log.Println("Error sending ICE candidate:", err)
+				return
+			}
+		}
+	})
+
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		err := readIngestTrack(streamID, stream, track, receiver)
+		log.Printf("Track for stream %s ended: %v\n", streamID, err)
+		if reconnectPolicy == reconnectAlways {
+			reconnectIngest(streamID, stream, peerConnection)
+		}
+	})
+
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("Ingest connection state for stream %s: %s\n", streamID, state.String())
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			if len(srtpProfiles) > 0 {
+				log.Printf("Ingest for stream %s connected with SRTP profile %s\n", streamID, negotiatedSRTPProfile())
+			}
+			stream.disconnectedAt.Store(0)
+			stream.reconnectAttempts.Store(0)
+			notifyStreamEvent(streamID, stream, eventConnected)
+			if keyframeTimeoutAction != "off" && stream.config.carries(webrtc.RTPCodecTypeVideo) {
+				go watchKeyframes(streamID, stream, peerConnection)
+			}
+			if closeSignalingOnConnect {
+				closeSignaling(streamID, stream, peerConnection)
+			}
+		case webrtc.PeerConnectionStateDisconnected:
+			since := time.Now().UnixNano()
+			stream.disconnectedAt.Store(since)
+			notifyStreamEvent(streamID, stream, eventDisconnected)
+			if disconnectedGracePeriod > 0 {
+				time.AfterFunc(disconnectedGracePeriod, func() {
+					escalateDisconnect(streamID, stream, peerConnection, since)
+				})
+			}
+		case webrtc.PeerConnectionStateFailed:
+			notifyStreamEvent(streamID, stream, eventFailed)
+		}
+		if reconnectPolicy.shouldReconnect(state) {
+			reconnectIngest(streamID, stream, peerConnection)
+		}
+	})
+
+	// Create offer
+	offerCreated := time.Now()
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return fail(fmt.Errorf("creating offer: %w", err))
+	}
+
+	// Gather ICE candidates
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+
+	// Set local description
+	if err := peerConnection.SetLocalDescription(offer); err != nil {
+		return fail(fmt.Errorf("setting local description: %w", err))
+	}
+	log.Printf("Offering H264 fmtp %s for stream %s\n", stream.config.h264Fmtp(), streamID)
+	log.Println("Local Description:", offer.SDP)
+
+	// Wait for ICE gathering to complete
+	<-gatherComplete
+	gathering := time.Since(offerCreated)
+	ingestGatheringSeconds.WithLabelValues(streamID).Observe(gathering.Seconds())
+	log.Printf("ICE gathering complete after %s with candidates: %s\n", gathering.Round(time.Millisecond), candidateFamilies(peerConnection.LocalDescription().SDP))
+	return peerConnection, offer, nil
+}
+
+// publishIngest makes peerConnection the stream's ingest, negotiated over
+// conn, and reports whether conn is new to the stream and needs a reader. The
+// caller must hold stream.mu.
+func publishIngest(stream *WebRTCStream, conn Signaler, peerConnection *webrtc.PeerConnection) bool {
+	stream.peerConnection = peerConnection
+	stream.remoteDescription = nil // pairs with the new offer once answered
+	if stream.gop != nil {
+		stream.gop.reset() // the camera's new session starts its own GOP
+	}
+	// A restart reuses the signaling connection and its reader
+	newSignaler := stream.signaler != conn
+	stream.signaler = conn // Store the signaling connection
+	if newSignaler {
+		stream.signalingAlive = true
+		stream.signalingClosed = false
+	}
+	return newSignaler
+}
+
+// sendIngestOffer sends a published ingest's offer over conn, and starts
+// reading conn if it's new.
+func sendIngestOffer(streamID string, stream *WebRTCStream, conn Signaler, peerConnection *webrtc.PeerConnection, offer webrtc.SessionDescription, newSignaler bool) error {
+	// Send offer through WebSocket
+	request, err := newSignalingRequest(actionSDPOffer, offer)
+	if err != nil {
+		return fmt.Errorf("encoding offer: %w", err)
+	}
+	if err := conn.WriteJSON(request); err != nil {
+		return fmt.Errorf("sending offer: %w", err)
+	}
+	time.AfterFunc(ingestNegotiationTimeout, func() {
+		expireNegotiation(streamID, stream, peerConnection)
+	})
+	dumpSDP(stream.log, streamID, "offer", offer.SDP)
+
+	// Handle incoming messages from the WebSocket (offer/answer)
+	if newSignaler {
+		go readSignaling(streamID, stream, conn)
+	}
+	return nil
+}
+
+// addIngestTransceivers adds the media the stream's own signaling_url
+// carries to an ingest offer. Media its sources carry isn't offered there.
+func addIngestTransceivers(peerConnection *webrtc.PeerConnection, config WebRTCConfig) error {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if !config.carries(kind) {
+			continue
+		}
+		if _, err := peerConnection.AddTransceiverFromKind(kind); err != nil {
+			return fmt.Errorf("adding %s transceiver: %w", kind, err)
+		}
+	}
+	return nil
+}
+
+// readIngestTrack forwards a camera track to the stream's outputs until it
+// ends, returning why. Tracks from the stream's extra sources are read the
+// same way, so viewers get their media merged.
+func readIngestTrack(streamID string, stream *WebRTCStream, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) error {
+	log := stream.log
+	log.Println("Got track:", track.ID(), track.StreamID())
+
+	continuity := &stream.videoContinuity
+	if track.Kind() == webrtc.RTPCodecTypeAudio {
+		continuity = &stream.audioContinuity
+	}
+	if continuity.newSource() && track.Kind() == webrtc.RTPCodecTypeVideo {
+		// Viewers carried over from the old ingest need a keyframe to
+		// decode the new one
+		log.Printf("Requesting keyframe for viewers of reconnected stream %s\n", streamID)
+		if err := stream.requestKeyframe(); err != nil {
+			log.Printf("Error requesting keyframe for stream %s: %v\n", streamID, err)
+		}
+	}
+
+	var keyframeSeen bool
+	var keyframeTimestamp uint32
+	var latencyExtension uint8
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		latencyExtension = timestampExtensionID(receiver)
+	}
+
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return err
+		}
+		stream.ingestPackets.Add(1)
+		stream.ingestBytes.Add(uint64(pkt.MarshalSize()))
+		if latencyExtension != 0 {
+			stream.cameraLatency.record(pkt, latencyExtension, time.Now())
+		}
+		if source := pkt.SSRC; continuity.rewrite(pkt) {
+			log.Printf("%s SSRC of stream %s changed to %d mid-stream\n", track.Kind(), streamID, source)
+			ingestSSRCChanges.Inc()
+			stream.recordEvent(streamID, eventSSRCChange, fmt.Sprintf("%s SSRC %d", track.Kind(), source))
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				if err := stream.requestKeyframe(); err != nil {
+					log.Printf("Error requesting keyframe for stream %s: %v\n", streamID, err)
+				}
+			}
+		}
+
+		if track.Kind() == webrtc.RTPCodecTypeAudio {
+			stream.forwardAudioRTP(pkt)
+			continue
+		}
+		pkts := []*rtp.Packet{pkt}
+		if inserted := stream.parameterSets.before(pkt); inserted != nil {
+			inserted.SequenceNumber = continuity.insertBefore(pkt)
+			pkts = []*rtp.Packet{inserted, pkt}
+		}
+		for _, pkt := range pkts {
+			if h264PacketIsKeyframe(pkt.Payload) {
+				stream.lastKeyframe.Store(time.Now().UnixNano())
+				// The parameter sets and IDR slices of one keyframe
+				// share a timestamp
+				if !keyframeSeen || pkt.Timestamp != keyframeTimestamp {
+					stream.recordEvent(streamID, eventKeyframe, "")
+					keyframeSeen, keyframeTimestamp = true, pkt.Timestamp
+				}
+			}
+			if stream.snapshot != nil {
+				stream.snapshot.writeRTP(pkt)
+			}
+			stream.forwardRTP(pkt)
+		}
+	}
+}
+
+// readSignaling handles camera messages for whichever ingest PeerConnection
+// is current, until conn fails or is replaced.
+func readSignaling(streamID string, stream *WebRTCStream, conn Signaler) {
+	log := stream.log
+	var peerConnection *webrtc.PeerConnection
+	var seenCandidates map[string]struct{}
+	var pendingCandidates []webrtc.ICECandidateInit // received before the answer
+	for {
+		var raw json.RawMessage
+		err := conn.ReadJSON(&raw)
+
+		if err != nil {
+			stream.mu.Lock()
+			closedOnConnect := stream.signaler == conn && stream.signalingClosed
+			if stream.signaler == conn {
+				stream.signalingAlive = false
+			}
+			stream.mu.Unlock()
+			if closedOnConnect {
+				return
+			}
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("error: %v", err)
+			}
+			log.Println("Error reading JSON:", err)
+			return
+		}
+
+		stream.mu.Lock()
+		current, replaced := stream.peerConnection, stream.signaler != conn
+		stream.mu.Unlock()
+		if replaced {
+			return
+		}
+		if current != peerConnection {
+			// Cameras resend candidates; only the first copy is worth adding
+			peerConnection = current
+			seenCandidates = make(map[string]struct{})
+			pendingCandidates = nil
+		}
+
+		if isKeepalive(raw) {
+			signalingKeepalives.Inc()
+			log.Debugf("Signaling keepalive for stream %s", streamID)
+			continue
+		}
+		var msg SignalingResponse
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			log.Println("Invalid message format:", err)
+			continue
+		}
+		if msg.MessageType == "" {
+			log.Debugf("Ignoring signaling message without a messageType: %s", raw)
+			continue
+		}
+
+		switch msg.MessageType {
+		case messageSDPAnswer:
+			var answer webrtc.SessionDescription
+			if err := msg.decodePayload(&answer); err != nil {
+				log.Println("Error decoding answer payload:", err)
+				continue
+			}
+			log.Println("Remote Description:", answer)
+			if err := peerConnection.SetRemoteDescription(answer); err != nil {
+				log.Println("Error setting remote description:", err)
+				continue
+			}
+			// Without a video section OnTrack never fires, so say so rather
+			// than leave viewers waiting. Video from a source is its own.
+			var failure string
+			if stream.config.carries(webrtc.RTPCodecTypeVideo) {
+				if err := checkAnswerHasVideo(answer.SDP); err != nil {
+					log.Printf("Error: Camera answer for stream %s is unusable: %v\n", streamID, err)
+					failure = err.Error()
+				}
+				parameterSets := spropParameterSets(answer.SDP)
+				if parameterSets != nil {
+					log.Printf("Camera for stream %s advertises sprop-parameter-sets, sending them inline before keyframes that lack them\n", streamID)
+				}
+				stream.parameterSets.set(parameterSets)
+			}
+			stream.mu.Lock()
+			stream.remoteDescription = &answer
+			stream.failure = failure
+			stream.mu.Unlock()
+			dumpSDP(log, streamID, "answer", answer.SDP)
+			if failure != "" {
+				notifyStreamEvent(streamID, stream, eventFailed)
+			}
+			if len(pendingCandidates) > 0 {
+				log.Printf("Adding %d ICE candidates that arrived before the answer\n", len(pendingCandidates))
+				for _, candidate := range pendingCandidates {
+					addIngestCandidate(log, peerConnection, candidate)
+				}
+				pendingCandidates = nil
+			}
+
+		case messageICECandidate:
+			var candidate webrtc.ICECandidateInit
+			if err := msg.decodePayload(&candidate); err != nil {
+				log.Println("Error decoding candidate payload:", err)
+				continue
+			}
+			if candidate.Candidate == "" {
+				log.Println("Invalid candidate format")
+				continue
+			}
+
+			if _, seen := seenCandidates[candidate.Candidate]; seen {
+				stream.duplicateCandidates.Add(1)
+				log.Debugf("Dropping duplicate ICE candidate: %s", candidate.Candidate)
+				continue
+			}
+			seenCandidates[candidate.Candidate] = struct{}{}
+
+			// Pion rejects candidates until the answer is applied, and
+			// cameras don't always send it first
+			if peerConnection.RemoteDescription() == nil {
+				log.Debugf("Holding ICE candidate until the answer arrives: %s", candidate.Candidate)
+				pendingCandidates = append(pendingCandidates, candidate)
+				continue
+			}
+			addIngestCandidate(log, peerConnection, candidate)
+
+		default:
+			log.Println("Unknown message type:", msg.MessageType)
+		}
+	}
+}
+
+// addIngestCandidate adds a camera ICE candidate to the ingest connection.
+func addIngestCandidate(log logger, peerConnection *webrtc.PeerConnection, candidate webrtc.ICECandidateInit) {
+	if err := peerConnection.AddICECandidate(candidate); err != nil {
+		// Late candidates are expected once ICE has already connected
+		switch peerConnection.ICEConnectionState() {
+		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+			log.Debugf("Ignoring ICE candidate after connection: %v", err)
+		default:
+			log.Println("Warning: error adding ICE candidate:", err)
+		}
+	}
+}
+
+var (
+	errNoVideoSection = errors.New("no active video section")
+	errNoAudioSection = errors.New("no active audio section")
+)
+
+// checkAnswerHasVideo verifies the camera's answer will send us video: at
+// least one video section that isn't rejected, inactive or recvonly.
+func checkAnswerHasVideo(answer string) error {
+	return checkAnswerHasMedia(answer, webrtc.RTPCodecTypeVideo)
+}
+
+// checkAnswerHasMedia is checkAnswerHasVideo for either media kind.
+func checkAnswerHasMedia(answer string, kind webrtc.RTPCodecType) error {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(answer)); err != nil {
+		return fmt.Errorf("parsing answer: %w", err)
+	}
+	for _, media := range desc.MediaDescriptions {
+		if media.MediaName.Media != kind.String() || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		if _, ok := media.Attribute("inactive"); ok {
+			continue
+		}
+		if _, ok := media.Attribute("recvonly"); ok {
+			continue
+		}
+		return nil
+	}
+	if kind == webrtc.RTPCodecTypeAudio {
+		return errNoAudioSection
+	}
+	return errNoVideoSection
+}
+
+// h264PacketIsKeyframe reports whether an H264 RTP payload starts an IDR
+// frame or carries its SPS/PPS, looking at single NAL, STAP-A and the first
+// FU-A fragment.
+func h264PacketIsKeyframe(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	isKey := func(nalType byte) bool {
+		return nalType == 5 || nalType == 7 || nalType == 8 // IDR, SPS, PPS
+	}
+	switch nalType := payload[0] & 0x1f; nalType {
+	case 24: // STAP-A
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if isKey(payload[i+2] & 0x1f) {
+				return true
+			}
+			i += 2 + size
+		}
+		return false
+	case 28: // FU-A
+		return payload[1]&0x80 != 0 && isKey(payload[1]&0x1f)
+	default:
+		return isKey(nalType)
+	}
+}
+
+// giveUpReconnecting counts a reconnect attempt in attempts, the ingest's or
+// a source's, and once there have been more than WHEP_MAX_RECONNECT_ATTEMPTS
+// since it last connected, closes the stream's connections and marks it dead
+// instead. A dead stream keeps its entry, so /streams shows why viewers are
+// turned away, until a manual restart.
+func giveUpReconnecting(streamID string, stream *WebRTCStream, attempts *atomic.Int64) bool {
+	if n := attempts.Add(1); maxReconnectAttempts <= 0 || n <= maxReconnectAttempts {
+		return false
+	}
+	stream.mu.Lock()
+	if stream.closed {
+		stream.mu.Unlock()
+		return true
+	}
+	stream.dead = true
+	stream.reconnecting = false
+	stream.failure = fmt.Sprintf("gave up after %d reconnect attempts", maxReconnectAttempts)
+	closeIngest(streamID, stream)
+	closeSources(streamID, stream)
+	stream.mu.Unlock()
+	stream.log.Printf("Error: Stream %s is dead, %s\n", streamID, stream.ingestFailure())
+	notifyStreamEvent(streamID, stream, eventDead)
+	return true
+}
+
+// restartIngest renegotiates over the stream's signaling connection if its
+// reader is still alive, saving a redial. If the camera hasn't connected by
+// WHEP_INGEST_RESTART_TIMEOUT the signaling is treated as dead and the stream
+// is reconnected from scratch.
+func restartIngest(streamID string, stream *WebRTCStream) bool {
+	log := stream.log
+	stream.mu.Lock()
+	if !reuseSignaling || stream.closed || !stream.signalingAlive {
+		stream.mu.Unlock()
+		return false
+	}
+	log.Printf("Restarting ingest for stream %s over the existing signaling connection\n", streamID)
+	closeIngestPeerConnection(streamID, stream)
+	signaler := stream.signaler
+	stream.mu.Unlock()
+
+	if err := startIngest(streamID, stream, signaler); err != nil {
+		log.Printf("Error restarting stream %s: %v\n", streamID, err)
+		return false
+	}
+	stream.mu.Lock()
+	stream.reconnecting = false
+	restarted := stream.peerConnection
+	stream.mu.Unlock()
+
+	time.AfterFunc(ingestRestartTimeout, func() {
+		stream.mu.Lock()
+		stale := stream.peerConnection == restarted && restarted.ConnectionState() != webrtc.PeerConnectionStateConnected
+		if stale {
+			stream.signalingAlive = false
+		}
+		stream.mu.Unlock()
+		if stale {
+			log.Printf("Stream %s didn't reconnect over existing signaling, redialing\n", streamID)
+			reconnectIngest(streamID, stream, restarted)
+		}
+	})
+	return true
+}
+
+// expireNegotiation fails an ingest whose offer the camera hasn't answered
+// within ingestNegotiationTimeout, rather than leave the stream registered
+// with no track. Viewers are refused with the failure until it reconnects.
+func expireNegotiation(streamID string, stream *WebRTCStream, offered *webrtc.PeerConnection) {
+	stream.mu.Lock()
+	pending := !stream.closed && stream.peerConnection == offered && offered.RemoteDescription() == nil
+	if pending {
+		stream.failure = fmt.Sprintf("camera didn't answer within %s", ingestNegotiationTimeout)
+	}
+	stream.mu.Unlock()
+	if !pending {
+		return
+	}
+	stream.log.Printf("Error: Camera for stream %s didn't answer the offer within %s\n", streamID, ingestNegotiationTimeout)
+	notifyStreamEvent(streamID, stream, eventFailed)
+	if reconnectPolicy.shouldReconnect(webrtc.PeerConnectionStateFailed) {
+		reconnectIngest(streamID, stream, offered)
+		return
+	}
+	streamsMu.Lock()
+	if current, ok := streams[streamID]; ok && current == stream {
+		cleanupStream(streamID, stream)
+	}
+	streamsMu.Unlock()
+}
+
+// dumpSDP writes a negotiated description to WHEP_SDP_DUMP_DIR, replacing the
+// one from any previous negotiation of the stream.
+func dumpSDP(log logger, streamID, kind, sdp string) {
+	if sdpDumpDir == "" {
+		return
+	}
+	path := filepath.Join(sdpDumpDir, fmt.Sprintf("%s-%s.sdp", streamID, kind))
+	if err := os.WriteFile(path, []byte(sdp), 0o644); err != nil {
+		log.Printf("Error writing %s: %v\n", path, err)
+		return
+	}
+	log.Printf("Wrote %s SDP for stream %s to %s\n", kind, streamID, path)
+}
+
+var errNoIngestVideo = errors.New("no ingest video track")
+
+// requestKeyframe sends a PLI or FIR upstream, per WHEP_KEYFRAME_REQUEST, for
+// each video track the camera is sending, on the main ingest or a video
+// source, so viewers get a fresh keyframe. Each request gets a new FIR
+// sequence number, as RFC 5104 requires for a camera to tell it from a
+// retransmission of the last.
+func (s *WebRTCStream) requestKeyframe() error {
+	s.mu.Lock()
+	peerConnections := []*webrtc.PeerConnection{s.peerConnection}
+	for _, ingest := range s.sources {
+		if ingest.kind == webrtc.RTPCodecTypeVideo {
+			peerConnections = append(peerConnections, ingest.peerConnection)
+		}
+	}
+	s.mu.Unlock()
+
+	var firSequence uint8
+	if keyframeRequest != "pli" {
+		firSequence = uint8(s.firSequence.Add(1))
+	}
+	sent := false
+	for _, peerConnection := range peerConnections {
+		if peerConnection == nil {
+			continue
+		}
+		var pkts []rtcp.Packet
+		for _, receiver := range peerConnection.GetReceivers() {
+			for _, track := range receiver.Tracks() {
+				if track.Kind() != webrtc.RTPCodecTypeVideo || track.SSRC() == 0 {
+					continue
+				}
+				ssrc := uint32(track.SSRC())
+				if keyframeRequest != "fir" {
+					pkts = append(pkts, &rtcp.PictureLossIndication{MediaSSRC: ssrc})
+				}
+				if keyframeRequest != "pli" {
+					// The media source SSRC is unused in FIR, whose entries
+					// name their targets
+					pkts = append(pkts, &rtcp.FullIntraRequest{
+						FIR: []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: firSequence}},
+					})
+				}
+			}
+		}
+		if len(pkts) == 0 {
+			continue
+		}
+		if err := peerConnection.WriteRTCP(pkts); err != nil {
+			return err
+		}
+		sent = true
+	}
+	if !sent {
+		return errNoIngestVideo
+	}
+	return nil
+}
+
+// closeSignaling closes the stream's signaling connection once peerConnection
+// has connected, as candidates are no longer exchanged. The next reconnect
+// dials a new one.
+func closeSignaling(streamID string, stream *WebRTCStream, peerConnection *webrtc.PeerConnection) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if stream.closed || stream.peerConnection != peerConnection || stream.signalingClosed {
+		return
+	}
+	stream.signalingAlive = false
+	stream.signalingClosed = true
+	if err := stream.signaler.Close(); err != nil {
+		stream.log.Printf("Error closing signaling for connected stream %s: %v\n", streamID, err)
+		return
+	}
+	stream.log.Printf("Closed signaling for stream %s now that it's connected\n", streamID)
+}
+
+// closeIngest tears down the camera side of a stream. The caller must hold
+// stream.mu.
+func closeIngest(streamID string, stream *WebRTCStream) {
+	if stream.signaler != nil && !stream.signalingClosed {
+		err := stream.signaler.Close()
+		if err != nil {
+			stream.log.Printf("Error closing signaling for stream %s: %v\n", streamID, err)
+		} else {
+			stream.log.Printf("Signaling closed for stream %s\n", streamID)
+		}
+	}
+	closeIngestPeerConnection(streamID, stream)
+}
+
+// closeIngestPeerConnection closes the camera PeerConnection but leaves
+// signaling open. The caller must hold stream.mu.
+func closeIngestPeerConnection(streamID string, stream *WebRTCStream) {
+	if stream.peerConnection != nil {
+		err := stream.peerConnection.Close()
+		if err != nil {
+			stream.log.Printf("Error closing PeerConnection for stream %s: %v\n", streamID, err)
+		} else {
+			stream.log.Printf("PeerConnection closed for stream %s\n", streamID)
+		}
+	}
+}
+
+// escalateDisconnect treats an ingest that has stayed disconnected for
+// WHEP_DISCONNECTED_GRACE_PERIOD as failed, instead of waiting for ICE to give
+// up. since identifies the disconnect, so one that recovered and dropped again
+// gets its own grace period.
+func escalateDisconnect(streamID string, stream *WebRTCStream, peerConnection *webrtc.PeerConnection, since int64) {
+	if !stillDisconnected(stream, peerConnection, since) {
+		return
+	}
+	stream.log.Printf("Ingest for stream %s still disconnected after %s\n", streamID, disconnectedGracePeriod)
+	if reconnectPolicy.shouldReconnect(webrtc.PeerConnectionStateFailed) {
+		reconnectIngest(streamID, stream, peerConnection)
+	}
+}
+
+// stillDisconnected reports whether the disconnect at since is still going,
+// neither recovered nor superseded by a later one.
+func stillDisconnected(stream *WebRTCStream, peerConnection *webrtc.PeerConnection, since int64) bool {
+	return peerConnection.ConnectionState() == webrtc.PeerConnectionStateDisconnected && stream.disconnectedAt.Load() == since
+}
+
+// watchKeyframes tells a connected ingest that never delivers a keyframe,
+// leaving viewers on black, from a working one. Until a keyframe arrives it
+// asks the camera for one every WHEP_KEYFRAME_PLI_INTERVAL, and past
+// WHEP_KEYFRAME_TIMEOUT marks the stream degraded, reconnecting it too with
+// WHEP_KEYFRAME_TIMEOUT_ACTION=reconnect.
+func watchKeyframes(streamID string, stream *WebRTCStream, peerConnection *webrtc.PeerConnection) {
+	log := stream.log
+	connectedAt := time.Now()
+	timedOut := false
+	ticker := time.NewTicker(keyframePLIInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if peerConnection.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			return
+		}
+		if stream.lastKeyframe.Load() >= connectedAt.UnixNano() {
+			if stream.setDegraded("") {
+				log.Printf("Stream %s recovered, first keyframe %s after connecting\n", streamID, time.Since(connectedAt).Round(time.Second))
+				stream.recordEvent(streamID, eventRecovered, "")
+			}
+			return
+		}
+		if !timedOut && time.Since(connectedAt) >= keyframeTimeout {
+			timedOut = true
+			reason := fmt.Sprintf("no keyframe within %s of connecting", keyframeTimeout)
+			stream.setDegraded(reason)
+			stream.recordEvent(streamID, eventDegraded, reason)
+			log.Printf("Error: Stream %s is degraded, %s\n", streamID, reason)
+			if keyframeTimeoutAction == "reconnect" {
+				reconnectIngest(streamID, stream, peerConnection)
+				return
+			}
+		}
+		stream.throttledKeyframeRequest(streamID, &stream.lastWatchdogPLI, keyframePLIInterval, "watchdog")
+	}
+}
+
+// setDegraded records why the stream is degraded, or clears it for "", and
+// reports whether that changed anything.
+func (s *WebRTCStream) setDegraded(reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := s.degraded != reason
+	s.degraded = reason
+	return changed
+}
+
+// reconnectIngest replaces a failed ingest PeerConnection. It first tries a
+// new offer over the existing signaling connection, then falls back to
+// redialing the signaling server until it succeeds or the stream is cleaned up.
+func reconnectIngest(streamID string, stream *WebRTCStream, failed *webrtc.PeerConnection) {
+	log := stream.log
+	stream.mu.Lock()
+	if stream.closed || stream.dead || stream.peerConnection != failed || stream.reconnecting {
+		// Stream was cleaned up, given up on, already replaced, or closed by us
+		stream.mu.Unlock()
+		return
+	}
+	stream.reconnecting = true
+	stream.mu.Unlock()
+	stream.reconnects.Add(1)
+	stream.recordEvent(streamID, eventReconnect, "")
+
+	if giveUpReconnecting(streamID, stream, &stream.reconnectAttempts) || restartIngest(streamID, stream) {
+		return
+	}
+
+	// Failed attempts back off exponentially, unless the signaling server
+	// says when to come back
+	delay := reconnectDelay
+	for attempt := 1; ; attempt++ {
+		time.Sleep(delay)
+		if giveUpReconnecting(streamID, stream, &stream.reconnectAttempts) {
+			return
+		}
+		log.Printf("Reconnecting stream %s (attempt %d)\n", streamID, attempt)
+		delay = min(delay*2, max(reconnectMaxDelay, reconnectDelay))
+
+		conn, err := dialSignaling(log, stream.config.SignalingURL)
+
+		stream.mu.Lock()
+		if stream.closed {
+			stream.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			stream.mu.Unlock()
+			var retryAfter *retryAfterError
+			if errors.As(err, &retryAfter) {
+				delay = retryAfter.wait
+			}
+			continue
+		}
+		closeIngest(streamID, stream)
+		stream.mu.Unlock()
+
+		if err := startIngest(streamID, stream, conn); err != nil {
+			stream.mu.Lock()
+			if stream.signaler != conn {
+				conn.Close() // the offer failed before the stream took it
+			}
+			if stream.closed {
+				stream.mu.Unlock()
+				return
+			}
+			log.Printf("Error reconnecting stream %s: %v\n", streamID, err)
+			closeIngest(streamID, stream)
+			stream.mu.Unlock()
+			continue
+		}
+		stream.mu.Lock()
+		stream.reconnecting = false
+		stream.mu.Unlock()
+		log.Printf("Stream %s reconnected\n", streamID)
+		return
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// unresponsiveSTUN returns a STUN URL whose server never answers, so ingest
+// gathering waits out Pion's server-reflexive timeout.
+func unresponsiveSTUN(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return "stun:" + conn.LocalAddr().String()
+}
+
+// assertUnlockedWhile runs negotiate, which gathers ingest candidates, while
+// the API, viewers and keyframe requests take stream.mu, and fails if the
+// lock stays held while it runs.
+func assertUnlockedWhile(t *testing.T, streamID string, stream func() *WebRTCStream, negotiate func()) {
+	t.Helper()
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		negotiate()
+	}()
+
+	var current *WebRTCStream
+	waitFor(t, 5*time.Second, "the stream to be added", func() bool {
+		current = stream()
+		return current != nil
+	})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	hammer := func(call func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				call()
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	request := func(handler http.HandlerFunc, path string) func() {
+		return func() {
+			handler(httptest.NewRecorder(), withVars(httptest.NewRequest(http.MethodGet, path, nil), "streamID", streamID))
+		}
+	}
+	hammer(request(streamHandler, "/streams/"+streamID))
+	hammer(request(viewersHandler, "/streams/"+streamID+"/viewers"))
+	hammer(request(debugStatsHandler, "/debug/stats"))
+	hammer(func() { current.requestKeyframe() })
+
+	unlocked := false
+	deadline := time.After(time.Second)
+wait:
+	for {
+		select {
+		case <-deadline:
+			break wait
+		default:
+		}
+		if current.mu.TryLock() {
+			current.mu.Unlock()
+			unlocked = true
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case <-finished:
+		t.Fatal("negotiation finished before gathering could be observed")
+	default:
+		<-finished
+	}
+	close(done)
+	wg.Wait()
+	if !unlocked {
+		t.Error("stream.mu was held while gathering ingest candidates")
+	}
+}
+
+func slowGatheringConfig(t *testing.T, camera *fakeCamera) string {
+	return `{"signaling_url":"` + camera.url + `","ice_servers":[{"url":"` + unresponsiveSTUN(t) + `"}]}`
+}
+
+// Gathering the ingest's candidates must not hold stream.mu: viewers, the
+// API and keyframe requests all take it.
+func TestStartIngestGathersUnlocked(t *testing.T) {
+	camera := newFakeCamera(t, nil)
+	streamID := "gather-unlocked"
+	config := slowGatheringConfig(t, camera)
+
+	var code int
+	assertUnlockedWhile(t, streamID, func() *WebRTCStream {
+		stream, _ := getStream(streamID)
+		return stream
+	}, func() {
+		recorder := httptest.NewRecorder()
+		websocketHandler(recorder, withVars(httptest.NewRequest(http.MethodPost, "/websocket/"+streamID, strings.NewReader(config)), "streamID", streamID))
+		code = recorder.Code
+	})
+	stream, ok := getStream(streamID)
+	if !ok {
+		t.Fatal("stream isn't registered")
+	}
+	defer removeTestStream(streamID, stream)
+	if code != http.StatusOK {
+		t.Fatalf("registration returned %d", code)
+	}
+	waitFor(t, 5*time.Second, "the camera's offer", func() bool { return camera.offerCount() == 1 })
+}
+
+func TestRestartIngestGathersUnlocked(t *testing.T) {
+	if testing.Short() {
+		t.Skip("gathers twice against an unresponsive STUN server")
+	}
+	camera := newFakeCamera(t, nil)
+	streamID := "restart-unlocked"
+	recorder := httptest.NewRecorder()
+	websocketHandler(recorder, withVars(httptest.NewRequest(http.MethodPost, "/websocket/"+streamID, strings.NewReader(slowGatheringConfig(t, camera))), "streamID", streamID))
+	stream, ok := getStream(streamID)
+	if !ok {
+		t.Fatalf("registration returned %d", recorder.Code)
+	}
+	defer removeTestStream(streamID, stream)
+	waitFor(t, 5*time.Second, "the camera's offer", func() bool { return camera.offerCount() == 1 })
+
+	stream.mu.Lock()
+	stream.reconnecting = true // as reconnectIngest sets before restarting
+	stream.mu.Unlock()
+	var restarted bool
+	assertUnlockedWhile(t, streamID, func() *WebRTCStream { return stream }, func() {
+		restarted = restartIngest(streamID, stream)
+	})
+	if !restarted {
+		t.Fatal("restartIngest didn't reuse the signaling connection")
+	}
+	waitFor(t, 5*time.Second, "the restart's offer", func() bool { return camera.offerCount() == 2 })
+}
+
+func TestCheckAnswerHasVideo(t *testing.T) {
+	const header = "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"
+	tests := []struct {
+		name   string
+		answer string
+		want   error
+	}{
+		{"sendonly video", header + "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=sendonly\r\n", nil},
+		{"audio only", header + "m=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=sendonly\r\n", errNoVideoSection},
+		{"rejected video", header + "m=video 0 UDP/TLS/RTP/SAVPF 102\r\n", errNoVideoSection},
+		{"inactive video", header + "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=inactive\r\n", errNoVideoSection},
+		{"recvonly video", header + "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=recvonly\r\n", errNoVideoSection},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := checkAnswerHasVideo(test.answer); !errors.Is(err, test.want) {
+				t.Errorf("checkAnswerHasVideo = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// A camera that answers without video fails the stream, and /streams says why.
+func TestAnswerWithoutVideoShownInStreams(t *testing.T) {
+	stream := registerStream(t, "ingest-without-video", newFakeCamera(t, func(c *fakeCamera) { c.noVideo = true }))
+	waitFor(t, 5*time.Second, "the answer to fail the stream", func() bool {
+		return stream.ingestFailure() != ""
+	})
+	// Closing the camera mid-negotiation trips a race inside Pion
+	waitForIngest(t, stream)
+
+	recorder := httptest.NewRecorder()
+	testRouter().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/streams/ingest-without-video", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("GET /streams returned %d: %s", recorder.Code, recorder.Body)
+	}
+	var stats streamStats
+	if err := json.Unmarshal(recorder.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stats.Error, errNoVideoSection.Error()) {
+		t.Errorf("error = %q, want it to mention %q", stats.Error, errNoVideoSection)
+	}
+}
+
+// connectedPeer returns a PeerConnection connected to another in-process
+// one, both closed when the test ends.
+func connectedPeer(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	offerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { offerer.Close() })
+	answerer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { answerer.Close() })
+	if _, err := offerer.CreateDataChannel("test", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	if err := offerer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	if err := answerer.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := offerer.SetRemoteDescription(*answerer.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "the peers to connect", func() bool {
+		return offerer.ConnectionState() == webrtc.PeerConnectionStateConnected
+	})
+	return offerer
+}
+
+// An ingest that recovers within WHEP_DISCONNECTED_GRACE_PERIOD, or has
+// disconnected again since, isn't escalated when the grace period ends.
+func TestDisconnectRecoveredWithinGracePeriod(t *testing.T) {
+	ingest := connectedPeer(t)
+	stream := newWebRTCStream(WebRTCConfig{}, baseLogger)
+	stream.peerConnection = ingest
+
+	// The ingest went disconnected at since and is connected again
+	since := time.Now().UnixNano()
+	stream.disconnectedAt.Store(since)
+	if stillDisconnected(stream, ingest, since) {
+		t.Error("a recovered ingest is still disconnected")
+	}
+	// A later disconnect has its own grace period
+	stream.disconnectedAt.Store(since + 1)
+	if stillDisconnected(stream, ingest, since) {
+		t.Error("a superseded disconnect is still going")
+	}
+}
+
+// A camera that trickles all its candidates before an answer carrying none
+// still connects: the early candidates are held until the answer is applied.
+func TestCandidatesBeforeAnswer(t *testing.T) {
+	camera := newFakeCamera(t, func(c *fakeCamera) { c.candidatesFirst = true })
+	stream := registerStream(t, "candidates-before-answer", camera)
+	waitForIngest(t, stream)
+
+	stream.mu.Lock()
+	answer := stream.remoteDescription
+	stream.mu.Unlock()
+	if answer == nil || strings.Contains(answer.SDP, "a=candidate:") {
+		t.Fatal("the camera's answer should carry no candidates")
+	}
+}
+
+// A stream whose camera never answers is failed and cleaned up once
+// WHEP_INGEST_NEGOTIATION_TIMEOUT passes, under the default never policy.
+func TestNegotiationExpires(t *testing.T) {
+	defer func(timeout time.Duration) { ingestNegotiationTimeout = timeout }(ingestNegotiationTimeout)
+	ingestNegotiationTimeout = 200 * time.Millisecond
+
+	stream := registerStream(t, "negotiation-expires", newFakeCamera(t, func(c *fakeCamera) { c.silent = true }))
+	waitFor(t, 5*time.Second, "the stream to be cleaned up", func() bool {
+		_, ok := getStream("negotiation-expires")
+		return !ok
+	})
+	stream.mu.Lock()
+	closed := stream.closed
+	stream.mu.Unlock()
+	if !closed {
+		t.Error("stream wasn't closed")
+	}
+	if got, want := stream.ingestFailure(), "camera didn't answer within 200ms"; got != want {
+		t.Errorf("failure = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// By default the proxy is dual stack: Go's ":port" listeners accept IPv4 and
+// IPv6, and Pion gathers UDP host candidates of both families on every
+// interface. WHEP_IP_FAMILY restricts the HTTP, RTSP and ICE sides to one
+// family, for hosts where the other is unroutable and only slows ICE down.
+
+// tcpNetwork is the network for TCP listeners.
+func tcpNetwork() string {
+	switch ipFamily {
+	case "ipv4":
+		return "tcp4"
+	case "ipv6":
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// applyIPFamily restricts a PeerConnection's candidates to WHEP_IP_FAMILY.
+// Dual stack keeps Pion's defaults.
+func applyIPFamily(settingEngine *webrtc.SettingEngine) {
+	switch ipFamily {
+	case "ipv4":
+		settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	case "ipv6":
+		settingEngine.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP6})
+	}
+}
+
+// iceNetworkTypes are the networks WHEP_VIEWER_UDP_PORT listens on.
+func iceNetworkTypes() []ice.NetworkType {
+	switch ipFamily {
+	case "ipv4":
+		return []ice.NetworkType{ice.NetworkTypeUDP4}
+	case "ipv6":
+		return []ice.NetworkType{ice.NetworkTypeUDP6}
+	}
+	return []ice.NetworkType{ice.NetworkTypeUDP4, ice.NetworkTypeUDP6}
+}
+
+// candidateFamilies summarizes the candidates in a description by family,
+// e.g. "IPv4 2, IPv6 1", for logging which families a connection gathered.
+// Candidates with an mDNS hostname are counted as such.
+func candidateFamilies(description string) string {
+	var ipv4, ipv6, mdns int
+	for _, line := range strings.Split(description, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		switch ip := net.ParseIP(fields[4]); {
+		case ip == nil:
+			mdns++
+		case ip.To4() != nil:
+			ipv4++
+		default:
+			ipv6++
+		}
+	}
+	summary := fmt.Sprintf("IPv4 %d, IPv6 %d", ipv4, ipv6)
+	if mdns > 0 {
+		summary += fmt.Sprintf(", mDNS %d", mdns)
+	}
+	return summary
+}
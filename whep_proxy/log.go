@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// logger prefixes log lines. Everything done on behalf of one request,
+// including the goroutines it starts, logs through a logger carrying that
+// request's ID.
+type logger struct {
+	prefix string
+}
+
+var baseLogger = logger{prefix: "[WHEP_PROXY] "}
+
+func (l logger) withRequestID(id string) logger {
+	return logger{prefix: l.prefix + "[" + id + "] "}
+}
+
+// withStreamName tags a stream's log lines with its friendly name, if any.
+func (l logger) withStreamName(name string) logger {
+	if name == "" {
+		return l
+	}
+	return logger{prefix: l.prefix + "[" + name + "] "}
+}
+
+func (l logger) Printf(format string, args ...interface{}) {
+	fmt.Printf(l.prefix+format, args...)
+}
+
+func (l logger) Println(args ...interface{}) {
+	fmt.Println(append([]interface{}{strings.TrimSuffix(l.prefix, " ")}, args...)...)
+}
+
+func (l logger) Debugf(format string, args ...interface{}) {
+	if debugLogging {
+		fmt.Printf(l.prefix+"Debug: "+format+"\n", args...)
+	}
+}
+
+// Fatalf logs and exits, for errors the proxy can't start or run without.
+func (l logger) Fatalf(format string, args ...interface{}) {
+	fmt.Printf(l.prefix+"Fatal: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// withRequestID tags a request with the client's X-Request-ID, or a new one,
+// echoes it back, and puts a logger carrying it in the request context.
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), loggerKey{}, baseLogger.withRequestID(id))
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// requestLog returns the logger for a request, or the base logger outside
+// withRequestID.
+func requestLog(r *http.Request) logger {
+	if l, ok := r.Context().Value(loggerKey{}).(logger); ok {
+		return l
+	}
+	return baseLogger
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID keeps client-supplied IDs short and printable, since they
+// end up in every log line.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
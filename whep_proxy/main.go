@@ -1,28 +1,77 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
-	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type WebRTCStream struct {
+	config   WebRTCConfig // Set once when the stream is created
+	hls      *hlsMuxer    // Set once when the stream is created, nil unless WHEP_HLS
+	rtsp     *rtspOutput  // Set once when the stream is created, nil unless WHEP_RTSP
+	snapshot *snapshotter // Set once when the stream is created, nil unless WHEP_SNAPSHOT
+	log      logger       // Carries the ID of the request that created the stream
+
+	duplicateCandidates atomic.Uint64
+	ingestPackets       atomic.Uint64 // RTP packets received from the camera
+	ingestBytes         atomic.Uint64
+	reconnects          atomic.Uint64
+	firSequence         atomic.Uint32
+	reconnectAttempts   atomic.Int64 // since the ingest last connected
+	lastKeyframe        atomic.Int64 // UnixNano of the last ingest keyframe, 0 if none
+	lastViewerPLI       atomic.Int64 // UnixNano of the last viewer PLI/FIR relayed upstream
+	lastLossPLI         atomic.Int64 // UnixNano of the last keyframe requested for viewer loss
+	lastWatchdogPLI     atomic.Int64 // UnixNano of the last keyframe requested by the watchdog
+	disconnectedAt      atomic.Int64 // UnixNano the ingest went disconnected, 0 while connected
+	videoContinuity     rtpContinuity
+	audioContinuity     rtpContinuity
+	parameterSets       parameterSets // from the camera's sprop-parameter-sets
+	cameraLatency       cameraLatency // from WHEP_TIMESTAMP_EXTENSION, when the camera sends it
+	timeline            streamTimeline
+
+	// mu guards the fields below. Take streamsMu first when holding both.
+	mu                sync.Mutex
 	peerConnection    *webrtc.PeerConnection
-	wsConn            *websocket.Conn
+	signaler          Signaler
+	signalingAlive    bool // signaler has a reader that hasn't failed
+	signalingClosed   bool // signaler was closed on connect, see WHEP_CLOSE_SIGNALING_ON_CONNECT
 	remoteDescription *webrtc.SessionDescription
 	etag              string // Add ETag field
+	reconnecting      bool
+	dead              bool // gave up reconnecting, see WHEP_MAX_RECONNECT_ATTEMPTS
+	closed            bool
+	failure           string // why the ingest can't carry video, empty if it can
+	degraded          string // why the connected ingest isn't delivering video, see watchKeyframes
+	viewers           map[string]*viewerSession
+	gop               *gopCache // nil unless WHEP_GOP_CACHE
+	sources           []*sourceIngest
+
+	// keyframe is the timestamp of the last keyframe forwarded, so lagging
+	// viewers resume at its first packet rather than a later IDR slice
+	keyframe     uint32
+	keyframeSeen bool
 }
 
 type ICEServer struct {
@@ -31,400 +80,496 @@ type ICEServer struct {
 	Credential string `json:"credential"`
 }
 
+// IngestSource is an extra camera session whose media is merged into a stream,
+// e.g. {"signaling_url": "wss://...", "media": "audio"}.
+type IngestSource struct {
+	SignalingURL string `json:"signaling_url"`
+	Media        string `json:"media"` // "video" or "audio"
+}
+
 type WebRTCConfig struct {
-	SignalingURL string      `json:"signaling_url"`
-	ICEServers   []ICEServer `json:"ice_servers"`
+	SignalingURL string `json:"signaling_url"`
+	// Name is a friendly label for dashboards and logs, e.g. "Front Door"
+	Name string `json:"name"`
+	// ICEServers for the ingest connection. Unset falls back to the stream's
+	// WHEP_STREAMS_FILE entry, then WHEP_STUN_SERVERS; [] uses none, for
+	// cameras on the LAN.
+	ICEServers []ICEServer `json:"ice_servers"`
+	WebhookURL string      `json:"webhook_url"`
+	// ICETransportPolicy is "all" or "relay" for both ingest and viewers; empty
+	// uses WHEP_INGEST_ICE_POLICY and WHEP_VIEWER_ICE_POLICY
+	ICETransportPolicy string `json:"ice_transport_policy"`
+	// H264Fmtp overrides the H264 fmtp offered to the camera, for models that
+	// reject the default profile-level-id
+	H264Fmtp string `json:"h264_fmtp"`
+	// Sources are extra signaling sessions merged into the stream, for
+	// cameras that send video and audio separately. Each carries one media
+	// kind, and signaling_url carries the rest.
+	Sources []IngestSource `json:"sources"`
+}
+
+const defaultH264Fmtp = "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"
+
+func (c WebRTCConfig) h264Fmtp() string {
+	if c.H264Fmtp == "" {
+		return defaultH264Fmtp
+	}
+	return c.H264Fmtp
+}
+
+// webrtcICEServers converts the configured ICE servers for Pion.
+func (c WebRTCConfig) webrtcICEServers() []webrtc.ICEServer {
+	iceServers := []webrtc.ICEServer{}
+	for _, server := range c.ICEServers {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:       []string{server.URL},
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return iceServers
+}
+
+// iceTransportPolicy is the stream's ice_transport_policy, or def for the
+// connection type when it's unset.
+func (c WebRTCConfig) iceTransportPolicy(def webrtc.ICETransportPolicy) webrtc.ICETransportPolicy {
+	if c.ICETransportPolicy == "" {
+		return def
+	}
+	return webrtc.NewICETransportPolicy(c.ICETransportPolicy)
 }
 
 var streams = make(map[string]*WebRTCStream)
-var streamsMu sync.Mutex
+var streamsMu sync.Mutex // Guards the streams map only
 
-var videoTrack *webrtc.TrackLocalStaticRTP
+// streamAdded is closed and replaced whenever a stream registers, waking
+// viewers waiting for it. Guarded by streamsMu.
+var streamAdded = make(chan struct{})
 
 func main() {
+	check := flag.Bool("check", envBool("WHEP_CHECK", false), "validate the configuration and exit without serving")
+	dryRunOffer := flag.Bool("dry-run-offer", false, "print the SDP offer sent to cameras, for the stream named by the argument if any, and exit")
+	flag.Parse()
+
+	if fileConfigErr != nil {
+		if !*check {
+			baseLogger.Fatalf("Cannot load WHEP_CONFIG_FILE: %v", fileConfigErr)
+		}
+		invalidConfig("Cannot load WHEP_CONFIG_FILE: %v", fileConfigErr)
+	}
+	checkConfigFile()
+	codecPreference = validateCodecPreference(codecPreference)
 	var err error
-	if videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion"); err != nil {
-		panic(err)
+	if srtpProfiles, srtpProfileNames, err = parseSRTPProfiles(srtpProfileSetting); err != nil {
+		if !*check {
+			baseLogger.Fatalf("Invalid WHEP_SRTP_PROFILES: %v", err)
+		}
+		invalidConfig("Invalid WHEP_SRTP_PROFILES: %v", err)
+	}
+	if *check {
+		os.Exit(runCheck())
+	}
+	if *dryRunOffer {
+		os.Exit(runDryRunOffer(flag.Arg(0)))
+	}
+	logConfig()
+	if cameraSampleSDP != "" {
+		reportCameraCodecs()
+	}
+	if mediaDSCP >= 0 {
+		fmt.Printf("[WHEP_PROXY] Marking media packets with DSCP %d (TOS 0x%02x)\n", mediaDSCP, mediaDSCP<<2)
+	}
+	if statsdAddr != "" {
+		go runStatsD(statsdAddr)
+	}
+	if eventLogPath != "" {
+		if eventLog, err = openEventLog(eventLogPath); err != nil {
+			baseLogger.Fatalf("Cannot open WHEP_EVENT_LOG: %v", err)
+		}
+		fmt.Printf("[WHEP_PROXY] Appending stream events to %s\n", eventLogPath)
+	}
+	if viewerUDPPort != 0 {
+		if err := startViewerUDPMux(); err != nil {
+			baseLogger.Fatalf("Cannot listen for viewers on UDP port %d: %v", viewerUDPPort, err)
+		}
+		fmt.Printf("[WHEP_PROXY] Serving viewer ICE on UDP port %d\n", viewerUDPPort)
+	}
+	if impairmentTesting {
+		fmt.Println("[WHEP_PROXY] Impairment testing is enabled: viewers can degrade their own video with impair_* query parameters")
+	}
+	if ipFamily != "dual" {
+		fmt.Printf("[WHEP_PROXY] Listening and gathering ICE candidates on %s only\n", ipFamily)
+	}
+	if advertisedIP != "" {
+		fmt.Printf("[WHEP_PROXY] Advertising %s in place of local host candidate addresses\n", advertisedIP)
 	}
 
-	r := mux.NewRouter()
+	r := newRouter()
+
+	if !listenTCP && unixSocket == "" {
+		baseLogger.Fatalf("WHEP_LISTEN_TCP=false requires WHEP_PROXY_UNIX_SOCKET")
+	}
+	serveErr := make(chan error, 2)
+	if listenTCP {
+		listener, err := net.Listen(tcpNetwork(), ":8080")
+		if err != nil {
+			baseLogger.Fatalf("Cannot listen on :8080: %v", err)
+		}
+		go func() {
+			fmt.Println("[WHEP_PROXY] Listening on :8080")
+			err := http.Serve(listener, r)
+			serveErr <- fmt.Errorf("serving on :8080: %w", err)
+		}()
+	}
+	var unixListener net.Listener
+	if unixSocket != "" {
+		var err error
+		unixListener, err = listenUnix(unixSocket)
+		if err != nil {
+			baseLogger.Fatalf("Cannot listen on unix:%s: %v", unixSocket, err)
+		}
+		go func() {
+			fmt.Printf("[WHEP_PROXY] Listening on unix:%s\n", unixSocket)
+			err := http.Serve(unixListener, r)
+			if !errors.Is(err, net.ErrClosed) {
+				serveErr <- fmt.Errorf("serving on unix:%s: %w", unixSocket, err)
+			}
+		}()
+	}
 
-	r.HandleFunc("/whep/{streamID}", whepHandler).Methods("GET", "OPTIONS", "POST")
-	r.HandleFunc("/websocket/{streamID}", websocketHandler).Methods("GET", "POST")
+	if rtspEnabled {
+		if err := startRTSPServer(); err != nil {
+			baseLogger.Fatalf("Cannot listen for RTSP on :%d: %v", rtspPort, err)
+		}
+		fmt.Printf("[WHEP_PROXY] Serving RTSP on :%d\n", rtspPort)
+	}
 
-	go func() {
-		fmt.Println("[WHEP_PROXY] Listening on :8080")
-		err := http.ListenAndServe(":8080", r)
+	var streamServers []*http.Server
+	entries, _, err := loadStreams()
+	if err != nil {
+		baseLogger.Fatalf("Cannot load streams: %v", err)
+	}
+	fileStreams = entries
+	if err := loadAliases(fileConfig.Aliases); err != nil {
+		baseLogger.Fatalf("Cannot load aliases: %v", err)
+	}
+	for streamID, entry := range entries {
+		if entry.Port == 0 {
+			continue
+		}
+		server, err := serveStreamPort(streamID, entry.Port)
 		if err != nil {
-			panic(err)
+			baseLogger.Fatalf("Cannot listen on port %d for stream %s: %v", entry.Port, streamID, err)
 		}
-	}()
+		streamServers = append(streamServers, server)
+	}
 
 	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, os.Interrupt)
-	<-sigchan
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
+	exitCode := 0
+	select {
+	case <-sigchan:
+		fmt.Println("[WHEP_PROXY] Exiting.")
+	case err := <-serveErr:
+		fmt.Printf("[WHEP_PROXY] Fatal: %v\n", err)
+		exitCode = 1
+	}
 
-	fmt.Println("[WHEP_PROXY] Exiting.")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	shutdownStreamPorts(ctx, streamServers)
+	shutdownStreams(ctx)
+	if rtspServer != nil {
+		rtspServer.Close()
+	}
+	if unixListener != nil {
+		unixListener.Close()
+		os.Remove(unixSocket)
+	}
+	os.Exit(exitCode)
+}
 
+func newWebRTCStream(config WebRTCConfig, log logger) *WebRTCStream {
+	stream := &WebRTCStream{config: config, log: log.withStreamName(config.Name)}
+	stream.videoContinuity.frameTicks = 3000 // one frame at 30fps
+	stream.audioContinuity.frameTicks = 160  // one 20ms PCMU packet
+	if hlsEnabled {
+		stream.hls = newHLSMuxer()
+	}
+	if snapshotEnabled {
+		stream.snapshot = newSnapshotter()
+	}
+	if gopCacheEnabled {
+		stream.gop = &gopCache{}
+	}
+	if rtspServer != nil {
+		stream.rtsp = newRTSPOutput()
+	}
+	return stream
+}
+
+// listenUnix listens on a Unix socket, replacing a stale socket left by a
+// previous run.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+func getStream(streamID string) (*WebRTCStream, bool) {
 	streamsMu.Lock()
 	defer streamsMu.Unlock()
-	for streamID, stream := range streams {
-		cleanupStream(streamID, stream)
+	stream, ok := streams[streamID]
+	return stream, ok
+}
+
+// addStream registers a stream. The caller must hold streamsMu.
+func addStream(streamID string, stream *WebRTCStream) {
+	streams[streamID] = stream
+	close(streamAdded)
+	streamAdded = make(chan struct{})
+}
+
+// waitForStream waits up to timeout for a stream to be registered.
+func waitForStream(ctx context.Context, streamID string, timeout time.Duration) (*WebRTCStream, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		streamsMu.Lock()
+		stream, ok := streams[streamID]
+		added := streamAdded
+		streamsMu.Unlock()
+		if ok {
+			return stream, true
+		}
+
+		select {
+		case <-added:
+		case <-timer.C:
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
 	}
 }
 
+// cleanupStream closes a stream and its viewers and removes it. The caller
+// must hold streamsMu.
 func cleanupStream(streamID string, stream *WebRTCStream) {
-	fmt.Printf("[WHEP_PROXY] Cleaning up stream %s\n", streamID)
-	if stream.wsConn != nil {
-		err := stream.wsConn.Close()
-		if err != nil {
-			fmt.Printf("[WHEP_PROXY] Error closing WebSocket for stream %s: %v\n", streamID, err)
-		} else {
-			fmt.Printf("[WHEP_PROXY] WebSocket closed for stream %s\n", streamID)
-		}
+	removeStream(streamID)
+	closeStream(streamID, stream)
+}
+
+// removeStream drops a stream from the map and its metrics. The caller must
+// hold streamsMu.
+func removeStream(streamID string) {
+	delete(streams, streamID)
+	ingestGatheringSeconds.DeleteLabelValues(streamID)
+	viewerNegotiationSeconds.DeleteLabelValues(streamID)
+}
+
+// closeStream closes a removed stream's ingest, viewers and RTSP clients.
+// Closing a connection can block on the network, e.g. DTLS sending its
+// close_notify, so it doesn't need streamsMu.
+func closeStream(streamID string, stream *WebRTCStream) {
+	stream.log.Printf("Cleaning up stream %s\n", streamID)
+	stream.mu.Lock()
+	stream.closed = true
+	closeIngest(streamID, stream)
+	closeSources(streamID, stream)
+	viewers := stream.viewers
+	stream.viewers = nil
+	for _, viewer := range viewers {
+		close(viewer.queue)
 	}
-	if stream.peerConnection != nil {
-		err := stream.peerConnection.Close()
-		if err != nil {
-			fmt.Printf("[WHEP_PROXY] Error closing PeerConnection for stream %s: %v\n", streamID, err)
-		} else {
-			fmt.Printf("[WHEP_PROXY] PeerConnection closed for stream %s\n", streamID)
+	stream.mu.Unlock()
+
+	// Close viewers so players see the stream end instead of freezing. This
+	// also ends their RTCP readers.
+	for viewerID, viewer := range viewers {
+		if err := viewer.peerConnection.Close(); err != nil {
+			stream.log.Printf("Error closing viewer %s: %v\n", viewerID, err)
 		}
 	}
-	delete(streams, streamID)
-	fmt.Printf("[WHEP_PROXY] Stream %s cleaned up\n", streamID)
+	if stream.rtsp != nil {
+		stream.rtsp.close()
+	}
+	notifyStreamEvent(streamID, stream, eventReaped)
+	stream.log.Printf("Stream %s cleaned up\n", streamID)
+}
+
+// shutdownStreams closes every stream concurrently on exit, abandoning those
+// still closing when ctx is done.
+func shutdownStreams(ctx context.Context) {
+	streamsMu.Lock()
+	closing := make(map[string]*WebRTCStream, len(streams))
+	for streamID, stream := range streams {
+		closing[streamID] = stream
+		removeStream(streamID)
+	}
+	streamsMu.Unlock()
+
+	var wg sync.WaitGroup
+	for streamID, stream := range closing {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			closeStream(streamID, stream)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		fmt.Printf("[WHEP_PROXY] Shutdown timed out after %s, abandoning streams still closing\n", shutdownTimeout)
+	}
 }
 
 func websocketHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
 	vars := mux.Vars(r)
 	streamID := vars["streamID"]
 
+	// Test pattern streams skip signaling entirely
+	if testPattern {
+		streamsMu.Lock()
+		defer streamsMu.Unlock()
+		if _, ok := streams[streamID]; !ok {
+			stream := newWebRTCStream(WebRTCConfig{}, log)
+			addStream(streamID, stream)
+			go runTestPattern(streamID, stream)
+		}
+		return
+	}
+
 	var config WebRTCConfig
 	var wsURL string
-	fmt.Println(r.Body)
-	// Parse configuration if POST request
-	if r.Method == "POST" {
-		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
-			http.Error(w, "Invalid JSON configuration", http.StatusBadRequest)
+	// Parse configuration
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		if isMaxBytesError(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
 			return
 		}
-		fmt.Println("[WHEP_PROXY] Config:", config)
-		// Use signaling URL from config if provided
-		if config.SignalingURL == "" {
-			panic("Signaling URL is required")
-		}
+		http.Error(w, "Invalid JSON configuration", http.StatusBadRequest)
+		return
+	}
+	config = withStreamFileDefaults(streamID, config)
+	log.Println("Config:", config)
+	// Use signaling URL from config if provided
+	if config.SignalingURL == "" {
+		http.Error(w, "signaling_url is required", http.StatusBadRequest)
+		return
+	}
+	switch config.ICETransportPolicy {
+	case "", "all", "relay":
+	default:
+		http.Error(w, "ice_transport_policy must be all or relay", http.StatusBadRequest)
+		return
+	}
+	if err := config.checkSources(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	// Parse the URL to unescape any escaped characters
 	parsedURL, err := url.Parse(config.SignalingURL)
 	if err != nil {
-		fmt.Printf("[WHEP_PROXY] Failed to parse WebSocket URL: %v\n", err)
+		log.Printf("Failed to parse WebSocket URL: %v\n", err)
 		http.Error(w, fmt.Sprintf("Failed to parse WebSocket URL: %v", err), http.StatusInternalServerError)
 		return
 	}
 	wsURL = parsedURL.String()
 
-	// Connect to WebSocket
-	dialer := websocket.Dialer{}
-	fmt.Printf("[WHEP_PROXY] Attempting to connect to WebSocket: %s\n", wsURL) // Log connection attempt
+	endpoint := breakerEndpoint(wsURL)
+	if ok, wait := breaker.allow(endpoint); !ok {
+		log.Printf("Signaling endpoint %s is failing, rejecting for %s\n", endpoint, wait.Round(time.Second))
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Signaling endpoint is unavailable", http.StatusServiceUnavailable)
+		return
+	}
 
-	conn, resp, err := dialer.Dial(wsURL, nil)
+	conn, err := dialSignaling(log, wsURL)
 	if err != nil {
-		fmt.Println("[WHEP_PROXY] Response:", resp)
-		bodyBytes := make([]byte, 1024)
-		n, err := resp.Body.Read(bodyBytes)
-		if err != nil && err != io.EOF {
-			fmt.Println("Error reading response body:", err)
-		} else {
-			fmt.Println("response body", string(bodyBytes[:n]))
+		if breaker.failure(endpoint) {
+			log.Printf("Circuit breaker opened for %s for %s\n", endpoint, breakerCooldown)
 		}
-		fmt.Println("conn:", conn)
-		fmt.Printf("[WHEP_PROXY] Failed to connect to WebSocket: %v\n", err) // Log connection failure
 		http.Error(w, fmt.Sprintf("Failed to connect to WebSocket: %v", err), http.StatusInternalServerError)
 		return
 	}
-	fmt.Println("[WHEP_PROXY] Successfully connected to WebSocket") // Log successful connection
+	breaker.success(endpoint)
 
 	streamsMu.Lock()
-	defer streamsMu.Unlock()
-
 	stream, ok := streams[streamID]
-	if !ok {
-		// Convert ICE servers configuration
-		iceServers := []webrtc.ICEServer{}
-		for _, server := range config.ICEServers {
-			iceServers = append(iceServers, webrtc.ICEServer{
-				URLs:       []string{server.URL},
-				Username:   server.Username,
-				Credential: server.Credential,
-			})
-		}
-
-		// If no ICE servers provided, use a default STUN server
-		if len(iceServers) == 0 {
-			iceServers = []webrtc.ICEServer{
-				{
-					URLs: []string{"stun:stun.l.google.com:19302"},
-				},
-			}
-		}
-
-		// Create media engine
-		m := &webrtc.MediaEngine{}
-
-		// Register RTP header extensions
-		for _, extension := range []string{
-			"urn:ietf:params:rtp-hdrext:sdes:mid",
-			"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
-			"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
-		} {
-			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
-				fmt.Printf("[WHEP_PROXY] Error registering extension %s: %v\n", extension, err)
-				return
-			}
-			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeAudio); err != nil {
-				fmt.Printf("[WHEP_PROXY] Error registering extension %s: %v\n", extension, err)
-				return
-			}
-		}
-
-		// Register H264 codec
-		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
-			RTPCodecCapability: webrtc.RTPCodecCapability{
-				MimeType:    webrtc.MimeTypeH264,
-				ClockRate:   90000,
-				Channels:    0,
-				SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f",
-				RTCPFeedback: []webrtc.RTCPFeedback{
-					{Type: "nack", Parameter: ""},
-				},
-			},
-			PayloadType: 102,
-		}, webrtc.RTPCodecTypeVideo); err != nil {
-			fmt.Println("[WHEP_PROXY] Error registering H264 codec:", err)
-			return
-		}
-
-		// Register PCMU codec
-		if err := m.RegisterCodec(webrtc.RTPCodecParameters{
-			RTPCodecCapability: webrtc.RTPCodecCapability{
-				MimeType:  "audio/PCMU",
-				ClockRate: 8000,
-				Channels:  1,
-				RTCPFeedback: []webrtc.RTCPFeedback{
-					{Type: "nack", Parameter: ""},
-				},
-			},
-			PayloadType: 0,
-		}, webrtc.RTPCodecTypeAudio); err != nil {
-			fmt.Println("[WHEP_PROXY] Error registering PCMU codec:", err)
-			return
-		}
-		interceptorRegistry := &interceptor.Registry{}
-		// Use the default set of Interceptors
-		if err := webrtc.RegisterDefaultInterceptors(m, interceptorRegistry); err != nil {
-			panic(err)
-		}
-
-		// Create the API object with the MediaEngine
-		peerConnection, err := webrtc.NewAPI(
-			webrtc.WithMediaEngine(m),
-			webrtc.WithInterceptorRegistry(interceptorRegistry),
-		).NewPeerConnection(webrtc.Configuration{
-			ICEServers: iceServers,
-		})
-		if err != nil {
-			fmt.Println("[WHEP_PROXY] Error creating peer connection:", err)
-			return
-		}
-
-		stream = &WebRTCStream{
-			peerConnection: peerConnection,
-			wsConn:         conn, // Store the WebSocket connection
-		}
-		streams[streamID] = stream
-
-		if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
-			panic(err)
-		}
-
-		// _, err = peerConnection.AddTrack(videoTrack)
-		// if err != nil {
-		// 	fmt.Println("Error adding video track:", err)
-		// 	return
-		// }
-
-		// Create offer
-		offer, err := peerConnection.CreateOffer(nil)
-		if err != nil {
-			fmt.Println("[WHEP_PROXY] Error creating offer:", err)
-			return
-		}
-
-		// Set local description
-		err = peerConnection.SetLocalDescription(offer)
-		if err != nil {
-			fmt.Println("[WHEP_PROXY] Error setting local description:", err)
-			return
-		}
-		fmt.Println("[WHEP_PROXY] Local Description:", offer.SDP)
-
-		peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
-			if c != nil {
-				candidate := c.ToJSON()
-				fmt.Printf("[WHEP_PROXY] New ICE candidate: %v\n", candidate)
-				if err := conn.WriteJSON(map[string]interface{}{"type": "iceCandidate", "candidate": candidate}); err != nil {
-					fmt.Println("[WHEP_PROXY] Error sending ICE candidate:", err)
-					return
-				}
-			}
-		})
-
-		// Gather ICE candidates
-		gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if ok {
+		streamsMu.Unlock()
+		stream.mu.Lock()
+		stream.signaler = conn // Update signaling connection
+		stream.signalingAlive = false
+		stream.signalingClosed = false
+		stream.mu.Unlock()
+		return
+	}
 
-		// Wait for ICE gathering to complete
-		<-gatherComplete
-		fmt.Println("[WHEP_PROXY] ICE gathering complete")
-
-		// Send offer through WebSocket
-		offerJSON := map[string]interface{}{"type": "offer", "sdp": offer.SDP}
-		offerJSONBytes, _ := json.Marshal(offerJSON)
-		offerBase64 := base64.StdEncoding.EncodeToString(offerJSONBytes)
-
-		if err := conn.WriteJSON(map[string]interface{}{
-			"action":            "SDP_OFFER",
-			"messagePayload":    offerBase64,
-			"recipientClientId": "ada06f08-87f4-4e13-b699-e82db8517ae5",
-		}); err != nil {
-			fmt.Println("[WHEP_PROXY] Error sending offer:", err)
-			return
+	config.SignalingURL = wsURL
+	stream = newWebRTCStream(config, log)
+	addStream(streamID, stream)
+	streamsMu.Unlock()
+
+	if err := startIngest(streamID, stream, conn); err != nil {
+		log.Printf("Error starting ingest for stream %s: %v\n", streamID, err)
+		conn.Close() // the stream doesn't hold it yet if the offer failed
+		streamsMu.Lock()
+		// Gathering runs unlocked, so the stream may be gone, and its ID
+		// reused, by now
+		if current, ok := streams[streamID]; ok && current == stream {
+			cleanupStream(streamID, stream)
 		}
-
-		peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-			fmt.Println("[WHEP_PROXY] Got track:", track.ID(), track.StreamID())
-
-			for {
-				pkt, _, err := track.ReadRTP()
-				if err != nil {
-					panic(err)
-				}
-
-				if err = videoTrack.WriteRTP(pkt); err != nil {
-					panic(err)
-				}
-			}
-		})
-
-		// Handle incoming messages from the WebSocket (offer/answer)
-		go func() {
-			for {
-				var msg map[string]interface{}
-
-				err := conn.ReadJSON(&msg)
-				if len(msg) == 0 && err == nil {
-					continue
-				}
-
-				if err != nil {
-					if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-						fmt.Printf("[WHEP_PROXY] error: %v", err)
-					}
-					fmt.Println("[WHEP_PROXY] Error reading JSON:", err)
-					continue
-				}
-
-				msgType, ok := msg["messageType"].(string)
-				if !ok {
-					fmt.Println("[WHEP_PROXY] Invalid message format")
-					continue
-				}
-
-				switch msgType {
-				case "SDP_ANSWER":
-					var answer webrtc.SessionDescription
-					payload := msg["messagePayload"].(string)
-					decoded, err := base64.StdEncoding.DecodeString(payload)
-					if err != nil {
-						fmt.Println("[WHEP_PROXY] Error decoding base64:", err)
-						continue
-					}
-					answerSDP := string(decoded)
-
-					if err := json.Unmarshal([]byte(answerSDP), &answer); err != nil {
-						fmt.Println("[WHEP_PROXY] Error unmarshaling answer:", err)
-						continue
-					}
-					fmt.Println("[WHEP_PROXY] Remote Description:", answer)
-					if err := stream.peerConnection.SetRemoteDescription(answer); err != nil {
-						fmt.Println("[WHEP_PROXY] Error setting remote description:", err)
-						continue
-					}
-					stream.remoteDescription = &answer
-
-				case "ICE_CANDIDATE":
-					var candidate webrtc.ICECandidateInit
-					payload := msg["messagePayload"].(string)
-					decoded, err := base64.StdEncoding.DecodeString(payload)
-					if err != nil {
-						fmt.Println("[WHEP_PROXY] Error decoding base64:", err)
-						continue
-					}
-					var candidateMap map[string]interface{}
-					if err := json.Unmarshal(decoded, &candidateMap); err != nil {
-						fmt.Println("[WHEP_PROXY] Error unmarshaling candidate:", err)
-						continue
-					}
-
-					candidateString, ok := candidateMap["candidate"].(string)
-					if !ok {
-						fmt.Println("[WHEP_PROXY] Invalid candidate format")
-						continue
-					}
-					candidate.Candidate = candidateString
-
-					sdpMid, ok := candidateMap["sdpMid"].(string)
-					if ok {
-						candidate.SDPMid = &sdpMid
-					}
-
-					if mLineIndex, ok := candidateMap["sdpMLineIndex"].(float64); ok {
-						uint16Val := uint16(mLineIndex)
-						candidate.SDPMLineIndex = &uint16Val
-					}
-
-					if err := stream.peerConnection.AddICECandidate(candidate); err != nil {
-						fmt.Println("[WHEP_PROXY] Error adding ICE candidate:", err)
-						continue
-					}
-
-				default:
-					fmt.Println("[WHEP_PROXY] Unknown message type:", msgType)
-				}
-			}
-		}()
-
-	} else {
-		stream.wsConn = conn // Update websocket connection
+		streamsMu.Unlock()
+		http.Error(w, "Error starting stream", http.StatusInternalServerError)
+		return
 	}
-
+	startSources(streamID, stream)
 }
 
 func whepHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
 	// Log incoming request
-	fmt.Printf("[WHEP_PROXY] %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
-	fmt.Printf("[WHEP_PROXY] Headers: %v\n", r.Header)
+	log.Printf("%s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+	log.Printf("Headers: %v\n", r.Header)
 
 	vars := mux.Vars(r)
 	streamID := vars["streamID"]
-	fmt.Printf("[WHEP_PROXY] Stream ID: %s\n", streamID)
-
-	streamsMu.Lock()
-	defer streamsMu.Unlock()
+	log.Printf("Stream ID: %s\n", streamID)
+	alias, aliased := streamID, false
+	if target, ok := resolveAlias(streamID); ok {
+		log.Printf("Alias %s points to stream %s\n", alias, target)
+		streamID, aliased = target, true
+	}
 
-	stream, ok := streams[streamID]
+	stream, ok := getStream(streamID)
+	if !ok && r.Method == http.MethodPost && streamWaitTimeout > 0 {
+		// The player may start before the camera stream is registered
+		log.Printf("Waiting up to %s for stream %s\n", streamWaitTimeout, streamID)
+		stream, ok = waitForStream(r.Context(), streamID, streamWaitTimeout)
+	}
+	if !ok && aliased {
+		log.Printf("Error: Alias %s points to stream %s, which isn't found\n", alias, streamID)
+		http.Error(w, fmt.Sprintf("Alias %s points to stream %s, which isn't found", alias, streamID), http.StatusNotFound)
+		return
+	}
 	if !ok {
-		fmt.Printf("[WHEP_PROXY] Error: Stream %s not found\n", streamID)
+		log.Printf("Error: Stream %s not found\n", streamID)
 		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
 		return
 	}
@@ -432,101 +577,450 @@ func whepHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodOptions:
 		w.Header().Set("Content-Type", "application/sdp")
-		fmt.Printf("[WHEP_PROXY] Sending OPTIONS response for stream %s\n", streamID)
+		w.Header().Set("X-WHEP-Capabilities", whepCapabilities)
+		log.Printf("Sending OPTIONS response for stream %s\n", streamID)
 		fmt.Fprint(w, "")
 
 	case http.MethodGet:
+		// Polling clients revalidate against the ETag handed out with answers
+		stream.mu.Lock()
+		etag := stream.etag
+		stream.mu.Unlock()
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
 		fmt.Fprint(w, "")
 
 	case http.MethodPost:
+		received := time.Now()
 		contentType := r.Header.Get("Content-Type")
 		if contentType != "application/sdp" {
-			fmt.Printf("[WHEP_PROXY] Error: Invalid Content-Type %s\n", contentType)
+			log.Printf("Error: Invalid Content-Type %s\n", contentType)
 			http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
 			return
 		}
 
+		answerType, ok := negotiateAnswerType(r.Header.Get("Accept"))
+		if !ok {
+			log.Printf("Error: Cannot satisfy Accept %s\n", r.Header.Get("Accept"))
+			http.Error(w, "Answer is only available as application/sdp or application/json", http.StatusNotAcceptable)
+			return
+		}
+
+		if failure := stream.ingestFailure(); failure != "" {
+			log.Printf("Error: Stream %s can't serve viewers: %s\n", streamID, failure)
+			http.Error(w, fmt.Sprintf("Stream %s is unavailable: %s", streamID, failure), http.StatusBadGateway)
+			return
+		}
+
+		// Checked again when the viewer is added; this just fails fast
+		if stream.isFull() {
+			log.Printf("Error: Stream %s already has %d viewers\n", streamID, maxViewersPerStream)
+			http.Error(w, fmt.Sprintf("Stream %s has too many viewers", streamID), http.StatusServiceUnavailable)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			fmt.Printf("[WHEP_PROXY] Error reading request body: %v\n", err)
+			if isMaxBytesError(err) {
+				log.Printf("Error: Offer for stream %s exceeds %d bytes\n", streamID, maxBodySize)
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			log.Printf("Error reading request body: %v\n", err)
 			http.Error(w, "Error reading request body", http.StatusBadRequest)
 			return
 		}
 		offer := string(body)
-		fmt.Printf("[WHEP_PROXY] Received POST offer for stream %s\n", streamID)
-		fmt.Printf("[WHEP_PROXY] Offer:\n%s\n", offer)
+		log.Printf("Received POST offer for stream %s\n", streamID)
+		log.Printf("Offer:\n%s\n", offer)
 
-		peerConnectionConfiguration := webrtc.Configuration{}
-		peerConnection, err := webrtc.NewPeerConnection(peerConnectionConfiguration)
-		if err != nil {
-			cleanupStream(streamID, stream)
-			panic(err)
+		wantsVideo, wantsAudio, err := offerMedia(offer)
+		if errors.Is(err, errOfferWithoutMedia) {
+			log.Printf("Error: Offer for stream %s has no audio or video section\n", streamID)
+			http.Error(w, "Offer has no audio or video section", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("Error parsing offer: %v\n", err)
+			http.Error(w, "Invalid SDP offer", http.StatusBadRequest)
+			return
+		}
+		if !wantsVideo && (!wantsAudio || disableAudio) {
+			log.Printf("Error: Offer for stream %s requests no media the stream can send\n", streamID)
+			http.Error(w, "Offer must receive H264 video or PCMU audio", http.StatusBadRequest)
+			return
 		}
+		var impairment *viewerImpairment
+		if impairmentTesting {
+			if impairment, err = parseImpairment(r.URL.Query()); err != nil {
+				log.Printf("Error: %v\n", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		release, ok := acquireNegotiation(r.Context())
+		if !ok {
+			log.Printf("Error: No negotiation slot for stream %s within %s\n", streamID, negotiationWait)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many negotiations in progress", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
 
-		rtpSender, err := peerConnection.AddTrack(videoTrack)
+		peerConnection, err := newViewerPeerConnection(streamID, stream.config)
 		if err != nil {
-			panic(err)
+			log.Printf("Error creating viewer PeerConnection: %v\n", err)
+			http.Error(w, "Error creating PeerConnection", http.StatusInternalServerError)
+			return
 		}
 
-		go func() {
-			rtcpBuf := make([]byte, 1500)
-			for {
-				if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
-					return
-				}
+		viewer := &viewerSession{
+			id:             newViewerID(),
+			peerConnection: peerConnection,
+			remoteAddr:     r.RemoteAddr,
+			connectedAt:    time.Now(),
+			impairment:     impairment,
+		}
+		if impairment != nil {
+			log.Printf("Impairing viewer %s video for testing: %s\n", viewer.id, impairment)
+		}
+		mode := trickleMode(r)
+		trickle := mode == trickleSSE
+		if trickle {
+			viewer.candidates = newCandidateFeed()
+			peerConnection.OnICECandidate(viewer.candidates.add)
+		}
+
+		// Audio and video share the stream ID as their msid, so clients can
+		// group them onto one media element
+		var videoSender, audioSender *webrtc.RTPSender
+		if wantsVideo {
+			viewerTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", streamID)
+			if err != nil {
+				log.Printf("Error creating viewer track: %v\n", err)
+				peerConnection.Close()
+				http.Error(w, "Error creating track", http.StatusInternalServerError)
+				return
 			}
-		}()
+			rtpSender, err := peerConnection.AddTrack(viewerTrack)
+			if err != nil {
+				log.Printf("Error adding viewer track: %v\n", err)
+				peerConnection.Close()
+				http.Error(w, "Error adding track", http.StatusInternalServerError)
+				return
+			}
+			if err := applyCodecPreference(peerConnection, rtpSender); err != nil {
+				log.Printf("Error applying codec preference: %v\n", err)
+				peerConnection.Close()
+				http.Error(w, "Error applying codec preference", http.StatusInternalServerError)
+				return
+			}
+			viewer.track = viewerTrack
+			videoSender = rtpSender
+		} else {
+			log.Printf("Viewer %s offered no video, answering audio only\n", viewer.id)
+		}
+
+		if disableAudio {
+			log.Printf("Audio is disabled, answering viewer %s video only\n", viewer.id)
+		} else if wantsAudio {
+			audioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU}, "audio", streamID)
+			if err != nil {
+				log.Printf("Error creating viewer audio track: %v\n", err)
+				peerConnection.Close()
+				http.Error(w, "Error creating track", http.StatusInternalServerError)
+				return
+			}
+			audioSender, err = peerConnection.AddTrack(audioTrack)
+			if err != nil {
+				log.Printf("Error adding viewer audio track: %v\n", err)
+				peerConnection.Close()
+				http.Error(w, "Error adding track", http.StatusInternalServerError)
+				return
+			}
+			viewer.audioTrack = audioTrack
+		} else {
+			log.Printf("Viewer %s can't receive PCMU audio, answering video only\n", viewer.id)
+		}
 
 		peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-			fmt.Printf("[WHEP_PROXY] ICE Connection State has changed: %s\n", connectionState.String())
+			log.Printf("ICE Connection State has changed: %s\n", connectionState.String())
 
 			if connectionState == webrtc.ICEConnectionStateFailed {
 				_ = peerConnection.Close()
 			}
 		})
 
+		// Drop the viewer (and its counters) once its connection goes away
+		peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+			if state == webrtc.PeerConnectionStateConnected {
+				if len(srtpProfiles) > 0 {
+					log.Printf("Viewer %s connected with SRTP profile %s\n", viewer.id, negotiatedSRTPProfile())
+				}
+				stream.replayGOP(viewer)
+				stream.recordEvent(streamID, eventViewerJoin, viewer.id)
+			}
+			if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+				if viewer.candidates != nil {
+					viewer.candidates.add(nil) // end its event stream
+				}
+				stream.removeViewer(viewer.id)
+				stream.recordEvent(streamID, eventViewerLeave, viewer.id)
+				log.Printf("Viewer %s left stream %s\n", viewer.id, streamID)
+			}
+		})
+
 		// Set the remote description first
 		err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
 			Type: webrtc.SDPTypeOffer,
 			SDP:  offer,
 		})
 		if err != nil {
-			fmt.Printf("[WHEP_PROXY] Error setting remote description: %v\n", err)
+			log.Printf("Error setting remote description: %v\n", err)
+			peerConnection.Close()
 			http.Error(w, "Error setting remote description", http.StatusInternalServerError)
 			return
 		}
 		gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
 		// Create a new SDP answer
 		answer, err := peerConnection.CreateAnswer(&webrtc.AnswerOptions{})
+		if err == nil {
+			err = checkAnswerCodecs(offer, answer.SDP, viewer.track != nil, viewer.audioTrack != nil)
+		}
 
-		if err != nil {
-			fmt.Printf("[WHEP_PROXY] Error creating SDP answer: %v\n", err)
+		var noCommonCodec *noCommonCodecError
+		if errors.As(err, &noCommonCodec) {
+			log.Printf("Error: Unusable offer from viewer %s of stream %s: %v\n", viewer.id, streamID, err)
+			peerConnection.Close()
+			http.Error(w, fmt.Sprintf("Offer has no %s codec in common with the stream, which sends H264 video and PCMU audio", noCommonCodec.kind), http.StatusUnprocessableEntity)
+			return
+		} else if err != nil {
+			log.Printf("Error creating SDP answer: %v\n", err)
+			peerConnection.Close()
 			http.Error(w, "Error creating SDP answer", http.StatusInternalServerError)
 			return
 		} else if err = peerConnection.SetLocalDescription(answer); err != nil {
-			fmt.Printf("[WHEP_PROXY] Error setting local description: %v\n", err)
+			log.Printf("Error setting local description: %v\n", err)
+			peerConnection.Close()
 			http.Error(w, "Error setting local description", http.StatusInternalServerError)
 			return
 		}
+		go observeViewerGathering(gatherComplete)
+
+		// Read the viewer's RTCP, and watch for it going quiet, only once it
+		// has an answer; each of these ends when the connection closes
+		if videoSender != nil {
+			go relayKeyframeRequests(streamID, stream, viewer, videoSender)
+		}
+		if audioSender != nil {
+			if videoSender == nil {
+				go drainAudioRTCP(viewer, audioSender)
+			} else {
+				go drainRTCP(audioSender)
+			}
+		}
+		if viewerIdleTimeout > 0 {
+			go reclaimIdleViewer(streamID, stream, viewer)
+		}
 
 		// Generate ETag if not exists
+		stream.mu.Lock()
 		if stream.etag == "" {
 			stream.etag = fmt.Sprintf("\"%x\"", time.Now().UnixNano())
 		}
-		<-gatherComplete
+		etag := stream.etag
+		stream.mu.Unlock()
+		if !trickle {
+			<-gatherComplete
+		}
+		answer = *peerConnection.LocalDescription()
+		if !trickle {
+			log.Printf("Answering viewer %s with candidates: %s\n", viewer.id, candidateFamilies(answer.SDP))
+		}
+		if rtcpCNAME != "" {
+			if answer.SDP, err = setAnswerCNAME(answer.SDP, viewerCNAME(streamID)); err != nil {
+				log.Printf("Error setting cname in answer: %v\n", err)
+				peerConnection.Close()
+				http.Error(w, "Error creating SDP answer", http.StatusInternalServerError)
+				return
+			}
+		}
+		if answerSSRCLines {
+			if answer.SDP, err = addSSRCLines(answer.SDP, viewerSSRCSources(peerConnection)); err != nil {
+				log.Printf("Error adding a=ssrc lines to answer: %v\n", err)
+				peerConnection.Close()
+				http.Error(w, "Error creating SDP answer", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := stream.addViewer(viewer); err != nil {
+			peerConnection.Close()
+			if errors.Is(err, errTooManyViewers) {
+				log.Printf("Error: Stream %s already has %d viewers\n", streamID, maxViewersPerStream)
+				http.Error(w, fmt.Sprintf("Stream %s has too many viewers", streamID), http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+			return
+		}
 		// Set response headers
-		w.Header().Set("Content-Type", "application/sdp")
-		w.Header().Set("Location", fmt.Sprintf("/whep/%s", streamID))
-		w.Header().Set("ETag", stream.etag)
+		w.Header().Set("Content-Type", answerType)
+		w.Header().Set("Location", viewer.resource(streamID))
+		w.Header().Set("ETag", etag)
+		w.Header().Set("X-WHEP-Capabilities", whepCapabilities)
+		w.Header().Set(trickleHeader, mode)
+		if trickle {
+			w.Header().Set("Link", fmt.Sprintf("<%s/events>; rel=\"%s\"; events=\"candidate\"", viewer.resource(streamID), sseLinkRelation))
+		}
 		w.WriteHeader(http.StatusCreated) // 201
 
 		// Filter out application media section before sending
-		fmt.Printf("[WHEP_PROXY] Filtered SDP:\n%s\n", peerConnection.LocalDescription().SDP)
-		fmt.Printf("[WHEP_PROXY] Sending POST response (answer) for stream %s with ETag %s\n", streamID, stream.etag)
-		fmt.Fprint(w, peerConnection.LocalDescription().SDP)
+		log.Printf("Filtered SDP:\n%s\n", answer.SDP)
+		log.Printf("Sending POST response (answer) for stream %s with ETag %s\n", streamID, etag)
+		if answerType == "application/json" {
+			json.NewEncoder(w).Encode(answer)
+		} else {
+			fmt.Fprint(w, answer.SDP)
+		}
+		viewerNegotiationSeconds.WithLabelValues(streamID).Observe(time.Since(received).Seconds())
 
 	default:
-		fmt.Printf("[WHEP_PROXY] Error: Method %s not allowed\n", r.Method)
+		// Unreachable: the router only sends GET, OPTIONS and POST here
+		log.Printf("Error: Method %s not allowed\n", r.Method)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+// whepCapabilities lists the optional WHEP features this proxy supports, sent
+// as X-WHEP-Capabilities on OPTIONS and answers so clients can adapt: delete
+// for ending a session with DELETE on its Location, json-answer for Accept:
+// application/json, sse for the proxy's candidates over server-sent events.
+// Client trickle ICE and ICE restarts aren't supported yet and are left out.
+var whepCapabilities = strings.Join([]string{"delete", "json-answer", "sse"}, ", ")
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison RFC 9110 specifies for it.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// newRouter serves the proxy's routes.
+func newRouter() *mux.Router {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/whep/{streamID}", withRequestID(rateLimited(whepHandler))).Methods("GET", "OPTIONS", "POST")
+	r.HandleFunc("/websocket/{streamID}", withRequestID(rateLimited(websocketHandler))).Methods("POST")
+	r.HandleFunc("/whep/{streamID}/{viewerID}", withRequestID(whepResourceHandler)).Methods("DELETE")
+	r.HandleFunc("/whep/{streamID}/{viewerID}/events", withRequestID(whepEventsHandler)).Methods("GET")
+	// Polled JSON and text endpoints honour Accept-Encoding; SDP and signaling
+	// stay uncompressed
+	r.Handle("/streams/{streamID}", handlers.CompressHandler(http.HandlerFunc(streamHandler))).Methods("GET")
+	r.Handle("/streams/{streamID}/viewers", handlers.CompressHandler(adminOnly(viewersHandler))).Methods("GET")
+	r.HandleFunc("/streams/{streamID}/keyframe", withRequestID(adminOnly(keyframeHandler))).Methods("POST")
+	r.HandleFunc("/streams/{streamID}/restart", withRequestID(adminOnly(restartHandler))).Methods("POST")
+	r.HandleFunc("/streams/{streamID}/sdp", adminOnly(sdpHandler)).Methods("GET")
+	r.HandleFunc("/streams/{streamID}/events", timelineHandler).Methods("GET")
+	r.Handle("/metrics", handlers.CompressHandler(promhttp.Handler())).Methods("GET")
+	handleDebug(r)
+	handleAliases(r)
+	if hlsEnabled {
+		r.HandleFunc("/hls/{streamID}/index.m3u8", hlsPlaylistHandler).Methods("GET")
+		r.HandleFunc("/hls/{streamID}/{sequence:[0-9]+}.ts", hlsSegmentHandler).Methods("GET")
+	}
+	if snapshotEnabled {
+		r.HandleFunc("/snapshot/{streamID}.jpg", withRequestID(snapshotHandler)).Methods("GET")
+	}
+
+	r.MethodNotAllowedHandler = methodNotAllowedHandler(r)
+	return r
+}
+
+// routeMethods are the methods probed to build a 405's Allow header.
+var routeMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// methodNotAllowedHandler answers a request for a known path with the wrong
+// method with 405 and an Allow header listing the methods the path takes.
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		for _, method := range routeMethods {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			var match mux.RouteMatch
+			if router.Match(probe, &match) && match.MatchErr == nil {
+				allowed = append(allowed, method)
+			}
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	})
+}
+
+// drainRTCP reads a sender's incoming RTCP so interceptors keep running.
+func drainRTCP(rtpSender *webrtc.RTPSender) {
+	rtcpBuf := make([]byte, 1500)
+	for {
+		if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+			return
+		}
+	}
+}
+
+func isMaxBytesError(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// negotiateAnswerType picks the answer encoding from the client's Accept
+// header: raw SDP by default, or the SDP wrapped in a JSON session description.
+func negotiateAnswerType(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return "application/sdp", true
+	}
+
+	best, bestQ := "", 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+
+		var candidate string
+		switch mediaType {
+		case "application/sdp", "application/json":
+			candidate = mediaType
+		case "*/*", "application/*":
+			candidate = "application/sdp"
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = candidate, q
+		}
+	}
+	return best, best != ""
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+)
+
+// When the camera goes away and the stream is cleaned up, as the negotiation
+// timeout and shutdown do, every viewer is closed rather than left frozen.
+func TestCleanupStreamClosesViewers(t *testing.T) {
+	camera := newFakeCamera(t, nil)
+	streamID := "cleanup-closes-viewers"
+	stream := registerStream(t, streamID, camera)
+	waitForIngest(t, stream)
+
+	router := testRouter()
+	var viewers []*testViewer
+	for range 3 {
+		viewer := newTestViewer(t)
+		if recorder := viewer.offer(t, router, streamID); recorder.Code != http.StatusCreated {
+			t.Fatalf("offer returned %d: %s", recorder.Code, recorder.Body)
+		}
+		viewer.waitForPackets(t, 5, 5*time.Second)
+		viewers = append(viewers, viewer)
+	}
+	stream.mu.Lock()
+	var sessions []*viewerSession
+	for _, session := range stream.viewers {
+		sessions = append(sessions, session)
+	}
+	stream.mu.Unlock()
+	if len(sessions) != len(viewers) {
+		t.Fatalf("stream has %d viewers, want %d", len(sessions), len(viewers))
+	}
+
+	camera.dropPeers()
+	streamsMu.Lock()
+	cleanupStream(streamID, stream)
+	streamsMu.Unlock()
+
+	for _, session := range sessions {
+		if state := session.peerConnection.ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+			t.Errorf("viewer %s is %s after cleanup", session.id, state)
+		}
+	}
+	for i, viewer := range viewers {
+		waitFor(t, 15*time.Second, "viewer "+strconv.Itoa(i)+" to lose its connection", func() bool {
+			return viewer.peerConnection.ConnectionState() != webrtc.PeerConnectionStateConnected
+		})
+	}
+	if _, ok := getStream(streamID); ok {
+		t.Error("stream is still registered")
+	}
+}
+
+// Every route answers a method it doesn't take with 405, listing the ones it
+// does in Allow.
+func TestWrongMethodListsAllowed(t *testing.T) {
+	router := newRouter()
+	pathVariable := regexp.MustCompile(`\{[^}]+\}`)
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		path := pathVariable.ReplaceAllString(template, "1")
+		t.Run(path, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPatch, path, nil))
+			if recorder.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("PATCH returned %d, want 405", recorder.Code)
+			}
+			allowed := strings.Split(recorder.Header().Get("Allow"), ", ")
+			for _, method := range methods {
+				if !slices.Contains(allowed, method) {
+					t.Errorf("Allow = %q, missing %s", allowed, method)
+				}
+			}
+			if slices.Contains(allowed, http.MethodPatch) {
+				t.Errorf("Allow = %q lists PATCH", allowed)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A Pion client can play a stream through the proxy's own routes: the offer
+// is answered with 201 and SDP, video arrives, and DELETE ends the session.
+func TestWHEPRoundTrip(t *testing.T) {
+	stream := registerStream(t, "whep-round-trip", newFakeCamera(t, nil))
+	waitForIngest(t, stream)
+
+	router := newRouter()
+	viewer := newTestViewer(t)
+	recorder := viewer.offer(t, router, "whep-round-trip")
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("offer returned %d: %s", recorder.Code, recorder.Body)
+	}
+	if got := recorder.Header().Get("Content-Type"); got != "application/sdp" {
+		t.Errorf("Content-Type = %q, want application/sdp", got)
+	}
+	if !strings.HasPrefix(recorder.Body.String(), "v=0") {
+		t.Errorf("answer isn't SDP:\n%s", recorder.Body)
+	}
+	if !strings.HasPrefix(viewer.location, "/whep/whep-round-trip/") {
+		t.Fatalf("Location = %q, want a session under the stream", viewer.location)
+	}
+	viewer.waitForPackets(t, 10, 5*time.Second)
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, viewer.location, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("DELETE returned %d: %s", recorder.Code, recorder.Body)
+	}
+	if viewers := stream.viewerStats(); len(viewers) != 0 {
+		t.Errorf("stream still has %d viewers", len(viewers))
+	}
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, viewer.location, nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("second DELETE returned %d, want 404", recorder.Code)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// negotiationBuckets span 50ms to about 25s, from host-only LAN gathering to
+// slow TURN allocations.
+var negotiationBuckets = prometheus.ExponentialBuckets(0.05, 2, 10)
+
+// Prometheus metrics, served at /metrics. Signaling endpoints are labelled
+// without their query string, which for KVS holds the request signature.
+var (
+	breakerOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "whep_signaling_breaker_open",
+		Help: "Whether the circuit breaker for a signaling endpoint is open (1) or closed (0).",
+	}, []string{"endpoint"})
+	breakerTrips = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "whep_signaling_breaker_trips_total",
+		Help: "Times the circuit breaker for a signaling endpoint has opened.",
+	}, []string{"endpoint"})
+	breakerRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "whep_signaling_breaker_rejections_total",
+		Help: "Stream registrations rejected because the signaling endpoint's breaker was open.",
+	}, []string{"endpoint"})
+	keyframeRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "whep_keyframe_requests_total",
+		Help: "Keyframes requested from the camera on behalf of viewers, by reason: viewer (a relayed PLI/FIR), loss (sustained receiver report loss) or watchdog (no keyframe since the ingest connected).",
+	}, []string{"reason"})
+	signalingKeepalives = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whep_signaling_keepalives_total",
+		Help: "Empty keepalive messages received from signaling servers: empty frames, {} or null.",
+	})
+	ingestSSRCChanges = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whep_ingest_ssrc_changes_total",
+		Help: "Times a camera changed the SSRC of an ingest track without renegotiating.",
+	})
+	rateLimitRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whep_rate_limit_rejections_total",
+		Help: "Requests to /websocket and /whep answered 429 because the client was over WHEP_RATE_LIMIT_PER_MINUTE.",
+	})
+	ingestGatheringSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "whep_ingest_gathering_seconds",
+		Help:    "Time from creating an ingest offer to ICE gathering completing, when the offer is sent to the camera.",
+		Buckets: negotiationBuckets,
+	}, []string{"stream"})
+	viewerNegotiationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "whep_viewer_negotiation_seconds",
+		Help:    "Time from receiving a viewer's WHEP POST to sending its answer. Trickle viewers get theirs before ICE gathering completes.",
+		Buckets: negotiationBuckets,
+	}, []string{"stream"})
+	viewerGatheringSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "whep_viewer_gathering_seconds",
+		Help:    "Time from setting a viewer's answer to ICE gathering completing, by whether the viewer shared WHEP_VIEWER_UDP_PORT (udp_mux \"shared\") or bound its own sockets (\"none\").",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"udp_mux"})
+	viewerIdleReclaims = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whep_viewer_idle_reclaims_total",
+		Help: "Viewer sessions closed after sending no RTCP for WHEP_VIEWER_IDLE_TIMEOUT.",
+	})
+	viewerResyncs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "whep_viewer_resyncs_total",
+		Help: "Times a lagging viewer's video backlog was dropped to resync on the next keyframe.",
+	})
+)
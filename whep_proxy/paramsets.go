@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+)
+
+// parameterSets holds the SPS/PPS a camera advertised out of band, in its
+// answer's sprop-parameter-sets, and sends them inline ahead of keyframes
+// that arrive without them. Viewers joining mid-stream, and decoders that
+// ignore the SDP, can't start decoding otherwise.
+type parameterSets struct {
+	mu     sync.Mutex
+	nalus  [][]byte // nil when the camera advertised none
+	inline bool     // an SPS arrived inline since the last keyframe
+	// keyframe is the timestamp of the last keyframe handled, so the later
+	// IDR slices of a multi-slice keyframe don't get parameter sets between
+	// them
+	keyframe     uint32
+	keyframeSeen bool
+}
+
+// set replaces the parameter sets, on each new ingest answer.
+func (p *parameterSets) set(nalus [][]byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nalus = nalus
+	p.inline = false
+	p.keyframeSeen = false
+}
+
+// before returns a STAP-A packet of the parameter sets to send ahead of pkt,
+// or nil. Its sequence number is left for the caller to fill in, and its
+// marker bit is clear as the keyframe's slices follow it.
+func (p *parameterSets) before(pkt *rtp.Packet) *rtp.Packet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.nalus == nil {
+		return nil
+	}
+	idr := false
+	for _, nalType := range h264PacketNALTypes(pkt.Payload) {
+		switch nalType {
+		case 7:
+			p.inline = true
+		case 5:
+			idr = true
+		}
+	}
+	if !idr || p.keyframeSeen && pkt.Timestamp == p.keyframe {
+		return nil
+	}
+	p.keyframe, p.keyframeSeen = pkt.Timestamp, true
+	if p.inline {
+		p.inline = false
+		return nil
+	}
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:     2,
+			PayloadType: pkt.PayloadType,
+			SSRC:        pkt.SSRC,
+			Timestamp:   pkt.Timestamp,
+		},
+		Payload: stapA(p.nalus),
+	}
+}
+
+// h264PacketNALTypes returns the types of the NAL units an H264 RTP payload
+// starts: one for a single NAL or the first FU-A fragment, each aggregated
+// one for STAP-A.
+func h264PacketNALTypes(payload []byte) []byte {
+	if len(payload) < 2 {
+		return nil
+	}
+	switch nalType := payload[0] & 0x1f; nalType {
+	case 24: // STAP-A
+		var types []byte
+		for rest := payload[1:]; len(rest) > 2; {
+			size := int(binary.BigEndian.Uint16(rest))
+			if size == 0 || len(rest) < 2+size {
+				break
+			}
+			types = append(types, rest[2]&0x1f)
+			rest = rest[2+size:]
+		}
+		return types
+	case 28: // FU-A
+		if payload[1]&0x80 == 0 {
+			return nil
+		}
+		return []byte{payload[1] & 0x1f}
+	default:
+		return []byte{nalType}
+	}
+}
+
+// stapA aggregates NAL units into one STAP-A payload (RFC 6184 5.7.1).
+func stapA(nalus [][]byte) []byte {
+	var nri byte
+	for _, nalu := range nalus {
+		nri = max(nri, nalu[0]&0x60)
+	}
+	payload := []byte{nri | 24}
+	for _, nalu := range nalus {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(nalu)))
+		payload = append(payload, nalu...)
+	}
+	return payload
+}
+
+// spropParameterSets returns the SPS/PPS in the sprop-parameter-sets of the
+// first H264 format in an answer's video sections.
+func spropParameterSets(answer string) [][]byte {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(answer)); err != nil {
+		return nil
+	}
+	for _, media := range desc.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			name, _, fmtp := sdpCodec(media, format)
+			if !strings.EqualFold(name, "H264") {
+				continue
+			}
+			sprop := parseFmtp(fmtp)["sprop-parameter-sets"]
+			if sprop == "" {
+				continue
+			}
+			var nalus [][]byte
+			for _, set := range strings.Split(sprop, ",") {
+				nalu, err := base64.StdEncoding.DecodeString(set)
+				if err != nil {
+					nalu, err = base64.RawStdEncoding.DecodeString(set)
+				}
+				if err != nil || len(nalu) == 0 {
+					return nil
+				}
+				nalus = append(nalus, nalu)
+			}
+			return nalus
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0x00, 0x1f, 0x95, 0xa8, 0x14, 0x01, 0x6e, 0x40}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+const testSprop = "sprop-parameter-sets=Z0IAH5WoFAFuQA==,aM48gA=="
+
+func TestSpropParameterSets(t *testing.T) {
+	const header = "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"
+	tests := []struct {
+		name   string
+		answer string
+		want   [][]byte
+	}{
+		{
+			"padded",
+			header + "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=rtpmap:102 H264/90000\r\na=fmtp:102 packetization-mode=1;" + testSprop + "\r\n",
+			[][]byte{testSPS, testPPS},
+		},
+		{
+			"unpadded",
+			header + "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=rtpmap:102 H264/90000\r\na=fmtp:102 sprop-parameter-sets=Z0IAH5WoFAFuQA,aM48gA\r\n",
+			[][]byte{testSPS, testPPS},
+		},
+		{
+			"second format",
+			header + "m=video 9 UDP/TLS/RTP/SAVPF 96 102\r\na=rtpmap:96 VP8/90000\r\na=rtpmap:102 H264/90000\r\na=fmtp:102 " + testSprop + "\r\n",
+			[][]byte{testSPS, testPPS},
+		},
+		{
+			"none",
+			header + "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=rtpmap:102 H264/90000\r\na=fmtp:102 packetization-mode=1\r\n",
+			nil,
+		},
+		{
+			"not base64",
+			header + "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=rtpmap:102 H264/90000\r\na=fmtp:102 sprop-parameter-sets=Z0IAH5WoFAFuQA==,!!\r\n",
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := spropParameterSets(test.answer)
+			if len(got) != len(test.want) {
+				t.Fatalf("spropParameterSets = %x, want %x", got, test.want)
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], test.want[i]) {
+					t.Errorf("set %d = %x, want %x", i, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParameterSetsBefore(t *testing.T) {
+	var p parameterSets
+	idr := func(ts uint32) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{PayloadType: 102, SSRC: 5, Timestamp: ts, Marker: true}, Payload: []byte{0x65, 0x88}}
+	}
+	if inserted := p.before(idr(0)); inserted != nil {
+		t.Fatal("inserted parameter sets the camera never advertised")
+	}
+
+	p.set([][]byte{testSPS, testPPS})
+	inserted := p.before(idr(3000))
+	if inserted == nil {
+		t.Fatal("no parameter sets before a bare keyframe")
+	}
+	if want := stapA([][]byte{testSPS, testPPS}); !bytes.Equal(inserted.Payload, want) {
+		t.Errorf("payload = %x, want %x", inserted.Payload, want)
+	}
+	if inserted.Marker || inserted.Timestamp != 3000 || inserted.SSRC != 5 || inserted.PayloadType != 102 {
+		t.Errorf("header = %+v, want the keyframe's timestamp, SSRC and payload type without the marker", inserted.Header)
+	}
+	if p.before(idr(3000)) != nil {
+		t.Error("inserted parameter sets between slices of one keyframe")
+	}
+	if p.before(&rtp.Packet{Header: rtp.Header{Timestamp: 6000}, Payload: []byte{0x41, 0x9a}}) != nil {
+		t.Error("inserted parameter sets before a non-IDR frame")
+	}
+
+	// A keyframe that carries its own SPS/PPS needs none
+	inline := &rtp.Packet{Header: rtp.Header{Timestamp: 9000}, Payload: stapA([][]byte{testSPS, testPPS, {0x65, 0x88}})}
+	if p.before(inline) != nil {
+		t.Error("inserted parameter sets before a keyframe carrying them")
+	}
+	if p.before(idr(12000)) == nil {
+		t.Error("no parameter sets before the next bare keyframe")
+	}
+}
+
+// Viewers of a camera that advertises sprop-parameter-sets get them inline
+// ahead of its keyframes, numbered into the stream.
+func TestViewerGetsInlineParameterSets(t *testing.T) {
+	fmtp := regexp.MustCompile(`(a=fmtp:\d+ [^\r]*packetization-mode=1[^\r]*)`)
+	camera := newFakeCamera(t, func(c *fakeCamera) {
+		c.answerSDP = func(sdp string) string { return fmtp.ReplaceAllString(sdp, "$1;"+testSprop) }
+	})
+	stream := registerStream(t, "inline-parameter-sets", camera)
+	waitForIngest(t, stream)
+
+	viewer := newTestViewer(t)
+	if recorder := viewer.offer(t, testRouter(), "inline-parameter-sets"); recorder.Code != http.StatusCreated {
+		t.Fatalf("offer returned %d: %s", recorder.Code, recorder.Body)
+	}
+	// The camera sends a keyframe every 30 frames
+	pkts := viewer.waitForPackets(t, 70, 10*time.Second)
+	found := false
+	for i := 1; i+1 < len(pkts); i++ {
+		if pkts[i].Payload[0]&0x1f != 24 {
+			continue
+		}
+		found = true
+		if next := pkts[i+1]; next.Payload[0]&0x1f != 5 || next.Timestamp != pkts[i].Timestamp {
+			t.Errorf("parameter sets at seq %d aren't followed by their keyframe", pkts[i].SequenceNumber)
+		}
+		if pkts[i].SequenceNumber != pkts[i-1].SequenceNumber+1 || pkts[i+1].SequenceNumber != pkts[i].SequenceNumber+1 {
+			t.Errorf("parameter sets at seq %d break the numbering: %d, %d, %d", pkts[i].SequenceNumber, pkts[i-1].SequenceNumber, pkts[i].SequenceNumber, pkts[i+1].SequenceNumber)
+		}
+	}
+	if !found {
+		t.Error("viewer got no parameter sets")
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientLimiter is a token bucket per client IP, so one client stuck in a
+// reconnect loop can't starve the proxy of negotiations.
+type clientLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var limiter = &clientLimiter{buckets: make(map[string]*tokenBucket)}
+
+// allow takes a token for client, or reports how long until one is available.
+func (l *clientLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	perSecond := float64(rateLimitPerMinute) / 60
+	burst := float64(rateLimitBurst)
+	l.sweep(now, perSecond, burst)
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*perSecond)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep drops, at most once a minute, the buckets that have refilled, which
+// are the same as no bucket.
+func (l *clientLimiter) sweep(now time.Time, perSecond, burst float64) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*perSecond >= burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// rateLimited answers 429 to clients over WHEP_RATE_LIMIT_PER_MINUTE. Unix
+// socket peers, the bridge in the same container, aren't limited.
+func rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	if rateLimitPerMinute <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientIP(r)
+		if net.ParseIP(client) == nil {
+			next(w, r)
+			return
+		}
+		if ok, wait := limiter.allow(client); !ok {
+			requestLog(r).Printf("Rate limiting %s %s from %s\n", r.Method, r.URL.Path, client)
+			rateLimitRejections.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, fmt.Sprintf("Too many requests from %s", client), http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientIP is the address a request came from. Behind WHEP_TRUSTED_PROXIES it
+// is the rightmost X-Forwarded-For entry that isn't one of those proxies,
+// since clients can put anything they like further left.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr // unix socket peers have no port
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !trustedProxy(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+func trustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
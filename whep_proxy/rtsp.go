@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/pion/rtp"
+)
+
+// rtspServer serves each stream at rtsp://host:WHEP_RTSP_PORT/{streamID}, for
+// NVRs and tools that don't speak WHEP. It's nil unless WHEP_RTSP is set.
+// Clients are served over TCP interleaving only, which passes through Docker's
+// port mapping without a UDP range.
+var rtspServer *gortsplib.Server
+
+// rtspOutput relays a stream's ingest packets to its RTSP clients unchanged:
+// H264 as payload type 102 and PCMU as 0, as negotiated with the camera.
+type rtspOutput struct {
+	stream *gortsplib.ServerStream
+	video  *description.Media
+	audio  *description.Media // nil with WHEP_DISABLE_AUDIO
+}
+
+func startRTSPServer() error {
+	rtspServer = &gortsplib.Server{
+		Handler:     rtspHandler{},
+		RTSPAddress: fmt.Sprintf(":%d", rtspPort),
+		Listen: func(network, address string) (net.Listener, error) {
+			return net.Listen(tcpNetwork(), address)
+		},
+	}
+	return rtspServer.Start()
+}
+
+func newRTSPOutput() *rtspOutput {
+	output := &rtspOutput{
+		video: &description.Media{
+			Type:    description.MediaTypeVideo,
+			Formats: []format.Format{&format.H264{PayloadTyp: 102, PacketizationMode: 1}},
+		},
+	}
+	desc := &description.Session{Medias: []*description.Media{output.video}}
+	if !disableAudio {
+		output.audio = &description.Media{
+			Type:    description.MediaTypeAudio,
+			Formats: []format.Format{&format.G711{PayloadTyp: 0, MULaw: true, SampleRate: 8000, ChannelCount: 1}},
+		}
+		desc.Medias = append(desc.Medias, output.audio)
+	}
+	output.stream = gortsplib.NewServerStream(rtspServer, desc)
+	return output
+}
+
+func (o *rtspOutput) writeVideo(pkt *rtp.Packet) {
+	o.stream.WritePacketRTP(o.video, pkt)
+}
+
+func (o *rtspOutput) writeAudio(pkt *rtp.Packet) {
+	if o.audio != nil {
+		o.stream.WritePacketRTP(o.audio, pkt)
+	}
+}
+
+// close disconnects the stream's RTSP clients.
+func (o *rtspOutput) close() {
+	o.stream.Close()
+}
+
+// rtspHandler answers RTSP clients from the streams map. Publishing isn't
+// supported, so ANNOUNCE and RECORD get 501.
+type rtspHandler struct{}
+
+// rtspStream finds the output for an RTSP request path, /{streamID}.
+func rtspStream(path string) (*rtspOutput, bool) {
+	stream, ok := getStream(strings.TrimPrefix(path, "/"))
+	if !ok || stream.rtsp == nil {
+		return nil, false
+	}
+	return stream.rtsp, true
+}
+
+func (rtspHandler) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	output, ok := rtspStream(ctx.Path)
+	if !ok {
+		return &base.Response{StatusCode: base.StatusNotFound}, nil, nil
+	}
+	return &base.Response{StatusCode: base.StatusOK}, output.stream, nil
+}
+
+func (rtspHandler) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	output, ok := rtspStream(ctx.Path)
+	if !ok {
+		return &base.Response{StatusCode: base.StatusNotFound}, nil, nil
+	}
+	return &base.Response{StatusCode: base.StatusOK}, output.stream, nil
+}
+
+func (rtspHandler) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
+	fmt.Printf("[WHEP_PROXY] RTSP client %s playing stream %s\n", ctx.Conn.NetConn().RemoteAddr(), strings.TrimPrefix(ctx.Path, "/"))
+	return &base.Response{StatusCode: base.StatusOK}, nil
+}
+
+func (rtspHandler) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCtx) {
+	fmt.Printf("[WHEP_PROXY] RTSP session closed: %v\n", ctx.Error)
+}
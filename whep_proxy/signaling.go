@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// Signaler carries KVS signaling messages between the proxy and the camera.
+// wsSignaler and pollSignaler implement it for WebSocket and HTTP signaling.
+// WriteJSON may be called concurrently, e.g. from Pion's ICE candidate
+// callback while an offer is being sent; ReadJSON has a single caller.
+type Signaler interface {
+	WriteJSON(v interface{}) error
+	ReadJSON(v interface{}) error
+	Close() error
+}
+
+var errSignalerClosed = errors.New("signaling closed")
+
+// KVS signaling envelopes. Messages to the camera name their kind in action,
+// messages from it in messageType; the asymmetry is the KVS protocol's.
+const (
+	actionSDPOffer      = "SDP_OFFER"
+	messageSDPAnswer    = "SDP_ANSWER"
+	messageICECandidate = "ICE_CANDIDATE"
+)
+
+// kvsViewerClientID is the recipient the camera's master answers.
+const kvsViewerClientID = "ada06f08-87f4-4e13-b699-e82db8517ae5"
+
+// SignalingRequest is a message to the camera, with a base64 JSON payload.
+type SignalingRequest struct {
+	Action            string `json:"action"`
+	MessagePayload    string `json:"messagePayload"`
+	RecipientClientID string `json:"recipientClientId,omitempty"`
+}
+
+func newSignalingRequest(action string, payload interface{}) (SignalingRequest, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return SignalingRequest{}, err
+	}
+	return SignalingRequest{
+		Action:            action,
+		MessagePayload:    base64.StdEncoding.EncodeToString(data),
+		RecipientClientID: kvsViewerClientID,
+	}, nil
+}
+
+// SignalingResponse is a message from the camera.
+type SignalingResponse struct {
+	MessageType    string          `json:"messageType"`
+	MessagePayload json.RawMessage `json:"messagePayload"`
+	SenderClientID string          `json:"senderClientId,omitempty"`
+}
+
+// decodePayload unmarshals the JSON carried in messagePayload into v. KVS
+// sends it base64-encoded, but some signaling versions send a plain object.
+func (m SignalingResponse) decodePayload(v interface{}) error {
+	payload := bytes.TrimSpace(m.MessagePayload)
+	switch {
+	case len(payload) == 0 || bytes.Equal(payload, []byte("null")):
+		return errors.New("missing messagePayload")
+	case payload[0] == '"':
+		var encoded string
+		if err := json.Unmarshal(payload, &encoded); err != nil {
+			return err
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(decoded, v)
+	case payload[0] == '{':
+		return json.Unmarshal(payload, v)
+	default:
+		return fmt.Errorf("unexpected messagePayload %.20s", payload)
+	}
+}
+
+// iceCandidateMessage sends a local candidate to the signaling server. It
+// predates the KVS envelopes and keeps its own shape.
+type iceCandidateMessage struct {
+	Type      string                  `json:"type"`
+	Candidate webrtc.ICECandidateInit `json:"candidate"`
+}
+
+// dialSignaling connects to the camera's signaling server, over WebSocket for
+// ws(s):// URLs or HTTP polling for http(s):// URLs.
+func dialSignaling(log logger, signalingURL string) (Signaler, error) {
+	parsedURL, err := url.Parse(signalingURL)
+	if err != nil {
+		return nil, err
+	}
+	switch parsedURL.Scheme {
+	case "http", "https":
+		log.Printf("Using HTTP polling signaling: %s\n", signalingURL)
+		return newPollSignaler(log, signalingURL), nil
+	case "ws", "wss":
+		return dialWebSocket(log, signalingURL)
+	}
+	return nil, fmt.Errorf("unsupported signaling scheme %q", parsedURL.Scheme)
+}
+
+// signalingDialer bounds every stage of the WebSocket dial so a hung
+// signaling server can't tie up the caller indefinitely.
+var signalingDialer = &websocket.Dialer{
+	NetDialContext: (&net.Dialer{
+		Timeout:   wsConnectTimeout,
+		KeepAlive: wsKeepAlive,
+	}).DialContext,
+	Proxy:            http.ProxyFromEnvironment,
+	HandshakeTimeout: wsHandshakeTimeout,
+	ReadBufferSize:   int(wsReadBufferSize),
+	WriteBufferSize:  int(wsWriteBufferSize),
+}
+
+// dialWebSocket opens the WebSocket to the camera's signaling server.
+func dialWebSocket(log logger, wsURL string) (Signaler, error) {
+	log.Printf("Attempting to connect to WebSocket: %s\n", wsURL) // Log connection attempt
+
+	conn, resp, err := signalingDialer.Dial(wsURL, nil)
+	if err != nil {
+		log.Println("Response:", resp)
+		if resp != nil {
+			bodyBytes := make([]byte, 1024)
+			n, readErr := resp.Body.Read(bodyBytes)
+			if readErr != nil && readErr != io.EOF {
+				log.Println("Error reading response body:", readErr)
+			} else {
+				log.Println("Response body:", string(bodyBytes[:n]))
+			}
+		}
+		log.Printf("Failed to connect to WebSocket: %v\n", err) // Log connection failure
+		if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+			if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				log.Printf("Signaling server asked to retry after %s\n", wait)
+				return nil, &retryAfterError{err: err, wait: wait}
+			}
+		}
+		return nil, err
+	}
+	log.Println("Successfully connected to WebSocket") // Log successful connection
+	conn.SetReadLimit(wsReadLimit)
+	signaler := &wsSignaler{Conn: conn, log: log}
+	signaler.refreshReadDeadline()
+	conn.SetPingHandler(func(data string) error {
+		signaler.refreshReadDeadline()
+		err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		var netErr net.Error
+		if errors.Is(err, websocket.ErrCloseSent) || errors.As(err, &netErr) && netErr.Timeout() {
+			return nil // as gorilla's default handler does
+		}
+		return err
+	})
+	return signaler, nil
+}
+
+// retryAfterError is a dial the signaling server rejected with a Retry-After.
+type retryAfterError struct {
+	err  error
+	wait time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %s)", e.err, e.wait)
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// parseRetryAfter reads a Retry-After header in either delay-seconds or
+// HTTP-date form.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// wsSignaler serializes writes to a WebSocket, which gorilla doesn't allow
+// concurrently.
+type wsSignaler struct {
+	*websocket.Conn
+	log     logger
+	writeMu sync.Mutex
+}
+
+// ReadJSON reads a message within WHEP_WS_READ_LIMIT, warning when one comes
+// close, since a larger one closes the connection with 1009. Every frame,
+// pings included, gives the server another WHEP_WS_READ_TIMEOUT to send the
+// next. Empty frames, which some servers send as keepalives and aren't JSON,
+// are counted and skipped, as are frames of nothing but whitespace.
+func (s *wsSignaler) ReadJSON(v interface{}) error {
+	for {
+		_, r, err := s.Conn.NextReader()
+		var data []byte
+		if err == nil {
+			data, err = io.ReadAll(r)
+		}
+		if errors.Is(err, websocket.ErrReadLimit) {
+			s.log.Printf("Error: Signaling message exceeds WHEP_WS_READ_LIMIT of %d bytes\n", wsReadLimit)
+		}
+		if err != nil {
+			return err
+		}
+		s.refreshReadDeadline()
+		if len(data) == 0 {
+			signalingKeepalives.Inc()
+			s.log.Debugf("Signaling keepalive (empty frame)")
+			continue
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			s.log.Debugf("Ignoring malformed signaling frame of %d whitespace bytes", len(data))
+			continue
+		}
+		if int64(len(data)) > wsReadLimit*3/4 {
+			s.log.Printf("Warning: %d byte signaling message is close to WHEP_WS_READ_LIMIT of %d bytes\n", len(data), wsReadLimit)
+		}
+		return json.Unmarshal(data, v)
+	}
+}
+
+// isKeepalive reports whether a signaling message is one of the empty
+// messages servers send to keep connections alive: {} or null, or nothing
+// over HTTP polling.
+func isKeepalive(raw json.RawMessage) bool {
+	switch string(bytes.TrimSpace(raw)) {
+	case "", "{}", "null":
+		return true
+	}
+	return false
+}
+
+// refreshReadDeadline gives the server another WHEP_WS_READ_TIMEOUT to send
+// something.
+func (s *wsSignaler) refreshReadDeadline() {
+	if wsReadTimeout > 0 {
+		s.Conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	}
+}
+
+func (s *wsSignaler) WriteJSON(v interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.Conn.WriteJSON(v)
+}
+
+// Close sends a close frame before closing, so the signaling server sees a
+// normal closure rather than a dropped connection.
+func (s *wsSignaler) Close() error {
+	s.writeMu.Lock()
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	s.Conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	s.writeMu.Unlock()
+	return s.Conn.Close()
+}
+
+// pollSignaler speaks the same envelopes as the WebSocket transport over
+// plain HTTP: requests are POSTed to the signaling URL, and responses are
+// polled with GET, which returns one message, an array of messages, or 204
+// when nothing is pending.
+type pollSignaler struct {
+	url     string
+	log     logger
+	client  *http.Client
+	pending []json.RawMessage // Only touched by the ReadJSON caller
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func newPollSignaler(log logger, signalingURL string) *pollSignaler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pollSignaler{
+		url:    signalingURL,
+		log:    log,
+		client: &http.Client{Timeout: 30 * time.Second},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (p *pollSignaler) WriteJSON(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("signaling POST returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *pollSignaler) ReadJSON(v interface{}) error {
+	for len(p.pending) == 0 {
+		if err := p.poll(); err == errSignalerClosed {
+			return err
+		} else if err != nil {
+			p.log.Printf("Error polling signaling: %v\n", err)
+		}
+		if len(p.pending) == 0 {
+			select {
+			case <-p.ctx.Done():
+				return errSignalerClosed
+			case <-time.After(pollInterval):
+			}
+		}
+	}
+	msg := p.pending[0]
+	p.pending = p.pending[1:]
+	return json.Unmarshal(msg, v)
+}
+
+func (p *pollSignaler) poll() error {
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		if p.ctx.Err() != nil {
+			return errSignalerClosed
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("signaling GET returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return err
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil
+	}
+	if body[0] == '[' {
+		var msgs []json.RawMessage
+		if err := json.Unmarshal(body, &msgs); err != nil {
+			return err
+		}
+		p.pending = append(p.pending, msgs...)
+		return nil
+	}
+	p.pending = append(p.pending, json.RawMessage(body))
+	return nil
+}
+
+func (p *pollSignaler) Close() error {
+	p.cancel()
+	return nil
+}
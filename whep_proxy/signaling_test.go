@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestDecodePayload(t *testing.T) {
+	answer := `{"type":"answer","sdp":"v=0\r\n"}`
+	tests := []struct {
+		name    string
+		payload string
+		wantErr bool
+	}{
+		{"base64 string", `"` + base64.StdEncoding.EncodeToString([]byte(answer)) + `"`, false},
+		{"object", answer, false},
+		{"object with whitespace", " \n" + answer, false},
+		{"missing", ``, true},
+		{"null", `null`, true},
+		{"number", `42`, true},
+		{"array", `[1]`, true},
+		{"invalid base64", `"not base64!"`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := SignalingResponse{MessageType: messageSDPAnswer, MessagePayload: json.RawMessage(test.payload)}
+			var got webrtc.SessionDescription
+			err := msg.decodePayload(&got)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("decodePayload(%s) = nil error, want one", test.payload)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodePayload(%s): %v", test.payload, err)
+			}
+			if got.Type != webrtc.SDPTypeAnswer || got.SDP != "v=0\r\n" {
+				t.Errorf("decodePayload(%s) = %+v", test.payload, got)
+			}
+		})
+	}
+}
+
+func TestDecodePayloadFromMessage(t *testing.T) {
+	// Both encodings as they arrive on the wire, through SignalingResponse
+	candidate := `{"candidate":"candidate:1 1 udp 1 192.0.2.1 5000 typ host","sdpMid":"0"}`
+	for _, raw := range []string{
+		`{"messageType":"ICE_CANDIDATE","messagePayload":"` + base64.StdEncoding.EncodeToString([]byte(candidate)) + `"}`,
+		`{"messageType":"ICE_CANDIDATE","messagePayload":` + candidate + `}`,
+	} {
+		var msg SignalingResponse
+		if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+			t.Fatalf("unmarshaling %s: %v", raw, err)
+		}
+		var got webrtc.ICECandidateInit
+		if err := msg.decodePayload(&got); err != nil {
+			t.Fatalf("decodePayload of %s: %v", raw, err)
+		}
+		if got.Candidate != "candidate:1 1 udp 1 192.0.2.1 5000 typ host" {
+			t.Errorf("decodePayload of %s = %+v", raw, got)
+		}
+	}
+}
+
+func TestWebSocketReadTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { wsReadTimeout = timeout }(wsReadTimeout)
+	wsReadTimeout = 200 * time.Millisecond
+
+	// Each frame arrives within the timeout of the one before, but the
+	// message comes after it would have expired had the empty keepalive and
+	// the ping not extended it
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(150 * time.Millisecond)
+		conn.WriteMessage(websocket.TextMessage, nil)
+		time.Sleep(150 * time.Millisecond)
+		conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+		time.Sleep(150 * time.Millisecond)
+		conn.WriteMessage(websocket.TextMessage, []byte(" \n"))
+		time.Sleep(150 * time.Millisecond)
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"messageType":"SDP_ANSWER"}`))
+		conn.ReadMessage() // until the client gives up
+	}))
+	defer server.Close()
+
+	conn, err := dialWebSocket(baseLogger, "ws"+strings.TrimPrefix(server.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var msg SignalingResponse
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("reading past keepalives: %v", err)
+	}
+	if msg.MessageType != messageSDPAnswer {
+		t.Errorf("read %+v", msg)
+	}
+
+	started := time.Now()
+	err = conn.ReadJSON(&msg)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("reading a silent connection returned %v, want a timeout", err)
+	}
+	if waited := time.Since(started); waited > time.Second {
+		t.Errorf("timed out after %s, want about %s", waited, wsReadTimeout)
+	}
+}
+
+func TestPollSignaler(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+
+	// Each GET gets the next response: nothing pending, a server error, an
+	// array of messages, then one message
+	responses := []struct {
+		status int
+		body   string
+	}{
+		{http.StatusNoContent, ""},
+		{http.StatusInternalServerError, "try again"},
+		{http.StatusOK, `[{"messageType":"SDP_ANSWER"}, {"messageType":"ICE_CANDIDATE"}]`},
+		{http.StatusOK, " {\"messageType\":\"ICE_CANDIDATE\",\"senderClientId\":\"last\"}\n"},
+	}
+	var mu sync.Mutex
+	var posted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != "application/json" {
+				http.Error(w, "not JSON", http.StatusUnsupportedMediaType)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			posted = append(posted, string(body))
+		case http.MethodGet:
+			if len(responses) == 0 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			response := responses[0]
+			responses = responses[1:]
+			w.WriteHeader(response.status)
+			io.WriteString(w, response.body)
+		}
+	}))
+	defer server.Close()
+
+	conn, err := dialSignaling(baseLogger, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := newSignalingRequest(actionSDPOffer, webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0\r\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteJSON(request); err != nil {
+		t.Fatalf("posting the offer: %v", err)
+	}
+	mu.Lock()
+	if len(posted) != 1 || !strings.Contains(posted[0], `"action":"SDP_OFFER"`) {
+		t.Errorf("server got %q", posted)
+	}
+	mu.Unlock()
+
+	var got []SignalingResponse
+	for range 3 {
+		var msg SignalingResponse
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("reading message %d: %v", len(got)+1, err)
+		}
+		got = append(got, msg)
+	}
+	if got[0].MessageType != messageSDPAnswer || got[1].MessageType != messageICECandidate || got[2].SenderClientID != "last" {
+		t.Errorf("read %+v", got)
+	}
+
+	// Close ends a ReadJSON waiting on an empty queue
+	read := make(chan error, 1)
+	go func() {
+		var msg SignalingResponse
+		read <- conn.ReadJSON(&msg)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-read:
+		if !errors.Is(err, errSignalerClosed) {
+			t.Errorf("ReadJSON after Close returned %v, want errSignalerClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadJSON didn't return after Close")
+	}
+}
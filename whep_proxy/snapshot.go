@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// snapshotTimeout bounds a single ffmpeg decode.
+const snapshotTimeout = 5 * time.Second
+
+// snapshotter keeps a stream's most recent H264 keyframe and decodes it to a
+// JPEG on demand with ffmpeg, caching the result for WHEP_SNAPSHOT_TTL.
+type snapshotter struct {
+	mu           sync.Mutex
+	depacketizer codecs.H264Packet
+	ssrc         uint32
+	au           []byte
+	auTS         uint32
+	sps, pps     []byte
+	keyframe     []byte // Annex B SPS, PPS and IDR slices, nil until the first one
+
+	decodeMu sync.Mutex // serializes decodes so concurrent requests share one
+	jpeg     []byte
+	jpegAt   time.Time
+}
+
+func newSnapshotter() *snapshotter {
+	return &snapshotter{}
+}
+
+// writeRTP adds an ingest video packet, keeping each complete keyframe.
+func (s *snapshotter) writeRTP(pkt *rtp.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pkt.SSRC != s.ssrc {
+		s.ssrc = pkt.SSRC
+		s.au = nil
+		s.depacketizer = codecs.H264Packet{}
+	}
+	if len(s.au) > 0 && pkt.Timestamp != s.auTS {
+		s.finishAccessUnit()
+	}
+
+	nals, err := s.depacketizer.Unmarshal(pkt.Payload)
+	if err != nil {
+		logDebugf("Dropping H264 packet for snapshot: %v", err)
+		return
+	}
+	if len(nals) > 0 {
+		s.auTS = pkt.Timestamp
+		s.au = append(s.au, nals...)
+	}
+	if pkt.Marker && len(s.au) > 0 {
+		s.finishAccessUnit()
+	}
+}
+
+// finishAccessUnit remembers the parameter sets, and the access unit if it's
+// a keyframe. Cameras often send SPS/PPS apart from the IDR, so the last ones
+// seen are prepended.
+func (s *snapshotter) finishAccessUnit() {
+	au := s.au
+	s.au = nil
+
+	var hasSPS, hasPPS bool
+	for _, nal := range splitAnnexB(au) {
+		switch nal[0] & 0x1f {
+		case 7:
+			s.sps, hasSPS = nal, true
+		case 8:
+			s.pps, hasPPS = nal, true
+		}
+	}
+	if !h264IsKeyframe(au) || s.sps == nil || s.pps == nil {
+		return
+	}
+	var keyframe []byte
+	startCode := []byte{0x00, 0x00, 0x00, 0x01}
+	if !hasSPS {
+		keyframe = append(append(keyframe, startCode...), s.sps...)
+	}
+	if !hasPPS {
+		keyframe = append(append(keyframe, startCode...), s.pps...)
+	}
+	s.keyframe = append(keyframe, au...)
+}
+
+// snapshot returns a JPEG of the latest keyframe, decoding a new one once the
+// cached JPEG is older than WHEP_SNAPSHOT_TTL. ok is false before the first
+// keyframe.
+func (s *snapshotter) snapshot(ctx context.Context) (jpeg []byte, ok bool, err error) {
+	s.decodeMu.Lock()
+	defer s.decodeMu.Unlock()
+	if s.jpeg != nil && time.Since(s.jpegAt) < snapshotTTL {
+		return s.jpeg, true, nil
+	}
+
+	s.mu.Lock()
+	keyframe := s.keyframe
+	s.mu.Unlock()
+	if keyframe == nil {
+		return nil, false, nil
+	}
+
+	jpeg, err = decodeJPEG(ctx, keyframe)
+	if err != nil {
+		return nil, true, err
+	}
+	s.jpeg = jpeg
+	s.jpegAt = time.Now()
+	return jpeg, true, nil
+}
+
+// decodeJPEG pipes an Annex B keyframe through ffmpeg and returns the first
+// frame as a JPEG.
+func decodeJPEG(ctx context.Context, keyframe []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, snapshotFFmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-f", "h264", "-i", "pipe:0",
+		"-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "pipe:1")
+	cmd.Stdin = bytes.NewReader(keyframe)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", snapshotFFmpeg, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("%s produced no image: %s", snapshotFFmpeg, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// splitAnnexB returns the NAL units of an Annex B byte stream.
+func splitAnnexB(au []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(au); i++ {
+		if au[i] != 0 || au[i+1] != 0 || au[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			if end > start && au[end-1] == 0 {
+				end-- // four-byte start code
+			}
+			if end > start {
+				nals = append(nals, au[start:end])
+			}
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(au) {
+		nals = append(nals, au[start:])
+	}
+	return nals
+}
+
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	streamID := mux.Vars(r)["streamID"]
+
+	stream, ok := getStream(streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+	jpeg, ok, err := stream.snapshot.snapshot(r.Context())
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s has no keyframe yet", streamID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error decoding snapshot for stream %s: %v\n", streamID, err)
+		http.Error(w, "Failed to decode snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(jpeg)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/transport/v2"
+	"github.com/pion/transport/v2/stdnet"
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// mediaNet applies WHEP_DSCP and the UDP buffer sizes to every socket Pion
+// opens, so RTP and RTCP leave the host with that marking and buffering.
+type mediaNet struct {
+	*stdnet.Net
+	dscp          int // -1 leaves sockets unmarked
+	sendBuffer    int // bytes, 0 keeps the OS default
+	receiveBuffer int
+}
+
+// applyAdvertisedIP makes a PeerConnection's host candidates carry
+// WHEP_ADVERTISED_IP, if set, instead of the interface addresses.
+func applyAdvertisedIP(settingEngine *webrtc.SettingEngine) {
+	if advertisedIP != "" {
+		settingEngine.SetNAT1To1IPs([]string{advertisedIP}, webrtc.ICECandidateTypeHost)
+	}
+}
+
+// applySocketOptions makes a PeerConnection's sockets carry WHEP_DSCP and
+// WHEP_UDP_SEND_BUFFER/WHEP_UDP_RECEIVE_BUFFER, if set.
+func applySocketOptions(settingEngine *webrtc.SettingEngine) error {
+	n, err := newMediaNet()
+	if err != nil || n == nil {
+		return err
+	}
+	settingEngine.SetNet(n)
+	return nil
+}
+
+// newMediaNet returns the net for the socket options, or nil if none are set.
+func newMediaNet() (*mediaNet, error) {
+	if mediaDSCP < 0 && udpSendBuffer == 0 && udpReceiveBuffer == 0 {
+		return nil, nil
+	}
+	n, err := stdnet.NewNet()
+	if err != nil {
+		return nil, err
+	}
+	return &mediaNet{
+		Net:           n,
+		dscp:          mediaDSCP,
+		sendBuffer:    int(udpSendBuffer),
+		receiveBuffer: int(udpReceiveBuffer),
+	}, nil
+}
+
+// viewerUDPMux carries every viewer's ICE when WHEP_VIEWER_UDP_PORT is set.
+// It's created once at startup.
+var viewerUDPMux ice.UDPMux
+
+// startViewerUDPMux listens on WHEP_VIEWER_UDP_PORT on each interface Pion
+// would gather host candidates from.
+func startViewerUDPMux() error {
+	options := []ice.UDPMuxFromPortOption{ice.UDPMuxFromPortWithNetworks(iceNetworkTypes()...)}
+	n, err := newMediaNet()
+	if err != nil {
+		return err
+	}
+	if n != nil {
+		options = append(options, ice.UDPMuxFromPortWithNet(n))
+	}
+	mux, err := ice.NewMultiUDPMuxFromPort(int(viewerUDPPort), options...)
+	if err != nil {
+		return err
+	}
+	viewerUDPMux = mux
+	return nil
+}
+
+// applyViewerUDPMux shares viewerUDPMux with a viewer PeerConnection, if
+// there is one.
+func applyViewerUDPMux(settingEngine *webrtc.SettingEngine) {
+	if viewerUDPMux != nil {
+		settingEngine.SetICEUDPMux(viewerUDPMux)
+	}
+}
+
+func (n *mediaNet) ListenUDP(network string, locAddr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.ListenUDP(network, locAddr)
+	if err != nil {
+		return nil, err
+	}
+	n.configure(conn)
+	return conn, nil
+}
+
+func (n *mediaNet) ListenPacket(network string, address string) (net.PacketConn, error) {
+	conn, err := n.Net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	n.configure(conn)
+	return conn, nil
+}
+
+// configure sets the socket options, failing open: a socket with default
+// options still carries media.
+func (n *mediaNet) configure(conn interface{}) {
+	c, ok := conn.(net.PacketConn)
+	if !ok {
+		return
+	}
+	if n.dscp >= 0 {
+		n.mark(c)
+	}
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return
+	}
+	if n.sendBuffer > 0 {
+		if err := udp.SetWriteBuffer(n.sendBuffer); err != nil {
+			fmt.Printf("[WHEP_PROXY] Error setting send buffer on %s: %v\n", c.LocalAddr(), err)
+		}
+	}
+	if n.receiveBuffer > 0 {
+		if err := udp.SetReadBuffer(n.receiveBuffer); err != nil {
+			fmt.Printf("[WHEP_PROXY] Error setting receive buffer on %s: %v\n", c.LocalAddr(), err)
+		}
+	}
+}
+
+// mark sets the traffic class on a socket.
+func (n *mediaNet) mark(c net.PacketConn) {
+	tos := n.dscp << 2 // DSCP is the top six bits of the TOS byte
+
+	var err error
+	if addr, ok := c.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil && !addr.IP.IsUnspecified() {
+		err = ipv6.NewPacketConn(c).SetTrafficClass(tos)
+	} else {
+		err = ipv4.NewPacketConn(c).SetTOS(tos)
+	}
+	if err != nil {
+		fmt.Printf("[WHEP_PROXY] Error setting DSCP on %s: %v\n", c.LocalAddr(), err)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// sourceIngest is a running extra source of a stream, from its config's
+// sources. Its fields are guarded by the stream's mu.
+type sourceIngest struct {
+	source         IngestSource
+	kind           webrtc.RTPCodecType
+	peerConnection *webrtc.PeerConnection
+	signaler       Signaler
+	reconnecting   bool
+	// failure is the stream failure this source's unusable answer set
+	failure string
+
+	reconnectAttempts atomic.Int64 // since the source last connected
+}
+
+// checkSources rejects sources the stream can't merge: each must carry video
+// or audio, no kind twice, and signaling_url has to be left something.
+func (c WebRTCConfig) checkSources() error {
+	claimed := make(map[string]bool)
+	for _, source := range c.Sources {
+		if source.SignalingURL == "" {
+			return errors.New("sources need a signaling_url")
+		}
+		switch source.Media {
+		case "video", "audio":
+		default:
+			return fmt.Errorf("source media must be video or audio, got %q", source.Media)
+		}
+		if source.Media == "audio" && disableAudio {
+			return errors.New("an audio source can't be used with WHEP_DISABLE_AUDIO")
+		}
+		if claimed[source.Media] {
+			return fmt.Errorf("only one source can carry %s", source.Media)
+		}
+		claimed[source.Media] = true
+	}
+	if claimed["video"] && (claimed["audio"] || disableAudio) {
+		return errors.New("sources leave signaling_url no media to carry")
+	}
+	return nil
+}
+
+// carries reports whether the stream's own signaling_url carries media of
+// kind, rather than one of its sources.
+func (c WebRTCConfig) carries(kind webrtc.RTPCodecType) bool {
+	if kind == webrtc.RTPCodecTypeAudio && disableAudio {
+		return false
+	}
+	for _, source := range c.Sources {
+		if webrtc.NewRTPCodecType(source.Media) == kind {
+			return false
+		}
+	}
+	return true
+}
+
+// startSources connects the stream's extra sources in the background. Each
+// reconnects by itself, following WHEP_RECONNECT_POLICY, until the stream is
+// cleaned up.
+func startSources(streamID string, stream *WebRTCStream) {
+	for _, source := range stream.config.Sources {
+		ingest := &sourceIngest{source: source, kind: webrtc.NewRTPCodecType(source.Media)}
+		stream.mu.Lock()
+		stream.sources = append(stream.sources, ingest)
+		stream.mu.Unlock()
+		go connectSource(streamID, stream, ingest, 0)
+	}
+}
+
+// connectSource dials a source's signaling and negotiates its connection,
+// waiting wait first and backing off between failed attempts.
+func connectSource(streamID string, stream *WebRTCStream, ingest *sourceIngest, wait time.Duration) {
+	log := stream.log
+	delay := reconnectDelay
+	for {
+		time.Sleep(wait)
+		conn, err := dialSignaling(log, ingest.source.SignalingURL)
+
+		stream.mu.Lock()
+		gone := stream.closed || stream.dead
+		stream.mu.Unlock()
+		if gone {
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err == nil {
+			err = startSource(streamID, stream, ingest, conn)
+			if err == nil {
+				log.Printf("Connected %s source for stream %s\n", ingest.kind, streamID)
+				return
+			}
+			if errors.Is(err, errStreamClosed) {
+				return
+			}
+			log.Printf("Error starting %s source for stream %s: %v\n", ingest.kind, streamID, err)
+		}
+		if giveUpReconnecting(streamID, stream, &ingest.reconnectAttempts) {
+			return
+		}
+
+		// As with the main ingest, back off unless the signaling server
+		// says when to come back
+		wait = delay
+		var retryAfter *retryAfterError
+		if errors.As(err, &retryAfter) {
+			wait = retryAfter.wait
+		}
+		delay = min(delay*2, max(reconnectMaxDelay, reconnectDelay))
+	}
+}
+
+// startSource offers a source's one media kind over conn, replacing its
+// current connection. Call it without stream.mu: like startIngest it gathers
+// first, and only takes the lock to make the connection the source's. conn is
+// closed if it fails.
+func startSource(streamID string, stream *WebRTCStream, ingest *sourceIngest, conn Signaler) error {
+	log := stream.log
+	peerConnection, offer, err := offerSource(streamID, stream, ingest)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	stream.mu.Lock()
+	if stream.closed || stream.dead {
+		stream.mu.Unlock()
+		peerConnection.Close()
+		conn.Close()
+		return errStreamClosed
+	}
+	closeSource(streamID, stream, ingest)
+	ingest.peerConnection = peerConnection
+	ingest.signaler = conn
+	ingest.reconnecting = false
+	stream.mu.Unlock()
+
+	request, err := newSignalingRequest(actionSDPOffer, offer)
+	if err != nil {
+		err = fmt.Errorf("encoding offer: %w", err)
+	} else if err = conn.WriteJSON(request); err != nil {
+		err = fmt.Errorf("sending offer: %w", err)
+	}
+	if err != nil {
+		stream.mu.Lock()
+		if ingest.peerConnection == peerConnection {
+			closeSource(streamID, stream, ingest)
+		}
+		stream.mu.Unlock()
+		return err
+	}
+	time.AfterFunc(ingestNegotiationTimeout, func() {
+		if peerConnection.RemoteDescription() == nil {
+			log.Printf("Error: %s source for stream %s didn't answer within %s\n", ingest.kind, streamID, ingestNegotiationTimeout)
+			reconnectSource(streamID, stream, ingest, peerConnection)
+		}
+	})
+	go readSourceSignaling(streamID, stream, ingest, conn, peerConnection)
+	return nil
+}
+
+// offerSource creates a source's PeerConnection and waits for ICE gathering
+// to complete, returning its offer with every candidate inline; nothing is
+// trickled. It doesn't touch the stream's guarded fields, and closes the
+// connection if it fails.
+func offerSource(streamID string, stream *WebRTCStream, ingest *sourceIngest) (*webrtc.PeerConnection, webrtc.SessionDescription, error) {
+	log := stream.log
+	peerConnection, err := newIngestPeerConnection(stream.config)
+	if err != nil {
+		return nil, webrtc.SessionDescription{}, err
+	}
+	fail := func(err error) (*webrtc.PeerConnection, webrtc.SessionDescription, error) {
+		peerConnection.Close()
+		return nil, webrtc.SessionDescription{}, err
+	}
+
+	if _, err = peerConnection.AddTransceiverFromKind(ingest.kind); err != nil {
+		return fail(fmt.Errorf("adding %s transceiver: %w", ingest.kind, err))
+	}
+
+	// Handlers go in before the local description, which starts gathering
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if track.Kind() != ingest.kind {
+			return
+		}
+		err := readIngestTrack(streamID, stream, track, receiver)
+		log.Printf("Track from %s source for stream %s ended: %v\n", ingest.kind, streamID, err)
+		if reconnectPolicy == reconnectAlways {
+			reconnectSource(streamID, stream, ingest, peerConnection)
+		}
+	})
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("Connection state of %s source for stream %s: %s\n", ingest.kind, streamID, state.String())
+		if state == webrtc.PeerConnectionStateConnected {
+			ingest.reconnectAttempts.Store(0)
+		}
+		if reconnectPolicy.shouldReconnect(state) {
+			reconnectSource(streamID, stream, ingest, peerConnection)
+		}
+	})
+
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return fail(fmt.Errorf("creating offer: %w", err))
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err = peerConnection.SetLocalDescription(offer); err != nil {
+		return fail(fmt.Errorf("setting local description: %w", err))
+	}
+	<-gatherComplete
+	return peerConnection, *peerConnection.LocalDescription(), nil
+}
+
+// readSourceSignaling applies a source camera's answer and candidates to the
+// connection offered over conn, until conn fails.
+func readSourceSignaling(streamID string, stream *WebRTCStream, ingest *sourceIngest, conn Signaler, peerConnection *webrtc.PeerConnection) {
+	log := stream.log
+	var pendingCandidates []webrtc.ICECandidateInit // received before the answer
+	seenCandidates := make(map[string]struct{})
+	for {
+		var raw json.RawMessage
+		if err := conn.ReadJSON(&raw); err != nil {
+			log.Printf("Signaling for %s source of stream %s ended: %v\n", ingest.kind, streamID, err)
+			return
+		}
+		if isKeepalive(raw) {
+			signalingKeepalives.Inc()
+			continue
+		}
+		var msg SignalingResponse
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			log.Println("Invalid message format:", err)
+			continue
+		}
+		switch msg.MessageType {
+		case messageSDPAnswer:
+			var answer webrtc.SessionDescription
+			if err := msg.decodePayload(&answer); err != nil {
+				log.Println("Error decoding answer payload:", err)
+				continue
+			}
+			if err := peerConnection.SetRemoteDescription(answer); err != nil {
+				log.Println("Error setting remote description:", err)
+				continue
+			}
+			dumpSDP(log, streamID, ingest.kind.String()+"-source-answer", answer.SDP)
+			// Without the source's section OnTrack never fires
+			if err := checkAnswerHasMedia(answer.SDP, ingest.kind); err != nil {
+				log.Printf("Error: %s source answer for stream %s is unusable: %v\n", ingest.kind, streamID, err)
+				failSource(streamID, stream, ingest, peerConnection, fmt.Sprintf("%s source: %v", ingest.kind, err))
+				return
+			}
+			stream.mu.Lock()
+			if ingest.failure != "" && stream.failure == ingest.failure {
+				stream.failure = ""
+			}
+			ingest.failure = ""
+			stream.mu.Unlock()
+			if ingest.kind == webrtc.RTPCodecTypeVideo {
+				stream.parameterSets.set(spropParameterSets(answer.SDP))
+			}
+			for _, candidate := range pendingCandidates {
+				addIngestCandidate(log, peerConnection, candidate)
+			}
+			pendingCandidates = nil
+
+		case messageICECandidate:
+			var candidate webrtc.ICECandidateInit
+			if err := msg.decodePayload(&candidate); err != nil || candidate.Candidate == "" {
+				continue
+			}
+			if _, seen := seenCandidates[candidate.Candidate]; seen {
+				stream.duplicateCandidates.Add(1)
+				log.Debugf("Dropping duplicate ICE candidate from %s source: %s", ingest.kind, candidate.Candidate)
+				continue
+			}
+			seenCandidates[candidate.Candidate] = struct{}{}
+			if peerConnection.RemoteDescription() == nil {
+				pendingCandidates = append(pendingCandidates, candidate)
+				continue
+			}
+			addIngestCandidate(log, peerConnection, candidate)
+
+		case "":
+			log.Debugf("Ignoring signaling message without a messageType: %s", raw)
+		default:
+			log.Println("Unknown message type:", msg.MessageType)
+		}
+	}
+}
+
+// reconnectSource replaces a source's failed connection, unless it was
+// already replaced or the stream is gone.
+func reconnectSource(streamID string, stream *WebRTCStream, ingest *sourceIngest, failed *webrtc.PeerConnection) {
+	stream.mu.Lock()
+	if stream.closed || stream.dead || ingest.peerConnection != failed || ingest.reconnecting {
+		stream.mu.Unlock()
+		return
+	}
+	ingest.reconnecting = true
+	stream.mu.Unlock()
+	stream.reconnects.Add(1)
+	stream.recordEvent(streamID, eventReconnect, ingest.kind.String()+" source")
+	if giveUpReconnecting(streamID, stream, &ingest.reconnectAttempts) {
+		return
+	}
+	stream.log.Printf("Reconnecting %s source for stream %s\n", ingest.kind, streamID)
+	connectSource(streamID, stream, ingest, reconnectDelay)
+}
+
+// failSource handles a source connection whose answer is unusable: it's
+// reconnected following WHEP_RECONNECT_POLICY, or else closed. A video
+// source's failure is the stream's, as viewers would get no video.
+func failSource(streamID string, stream *WebRTCStream, ingest *sourceIngest, peerConnection *webrtc.PeerConnection, reason string) {
+	stream.mu.Lock()
+	if stream.closed || ingest.peerConnection != peerConnection {
+		stream.mu.Unlock()
+		return
+	}
+	if ingest.kind == webrtc.RTPCodecTypeVideo {
+		ingest.failure = reason
+		stream.failure = reason
+	}
+	stream.mu.Unlock()
+	notifyStreamEvent(streamID, stream, eventFailed)
+	if reconnectPolicy.shouldReconnect(webrtc.PeerConnectionStateFailed) {
+		reconnectSource(streamID, stream, ingest, peerConnection)
+		return
+	}
+	stream.mu.Lock()
+	if ingest.peerConnection == peerConnection {
+		closeSource(streamID, stream, ingest)
+	}
+	stream.mu.Unlock()
+}
+
+// closeSource closes a source's signaling and connection. The caller must
+// hold stream.mu.
+func closeSource(streamID string, stream *WebRTCStream, ingest *sourceIngest) {
+	if ingest.signaler != nil {
+		ingest.signaler.Close()
+		ingest.signaler = nil
+	}
+	if ingest.peerConnection != nil {
+		if err := ingest.peerConnection.Close(); err != nil {
+			stream.log.Printf("Error closing %s source for stream %s: %v\n", ingest.kind, streamID, err)
+		}
+	}
+}
+
+// closeSources closes all of the stream's extra sources. The caller must hold
+// stream.mu.
+func closeSources(streamID string, stream *WebRTCStream) {
+	for _, ingest := range stream.sources {
+		closeSource(streamID, stream, ingest)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// registerWithVideoSource registers a stream whose video comes from a source
+// at sourceURL, and its audio from camera.
+func registerWithVideoSource(t *testing.T, streamID string, camera *fakeCamera, sourceURL string) *WebRTCStream {
+	t.Helper()
+	config := `{"signaling_url":"` + camera.url + `","ice_servers":[],"sources":[{"signaling_url":"` + sourceURL + `","media":"video"}]}`
+	recorder := httptest.NewRecorder()
+	websocketHandler(recorder, withVars(httptest.NewRequest(http.MethodPost, "/websocket/"+streamID, strings.NewReader(config)), "streamID", streamID))
+	stream, ok := getStream(streamID)
+	if !ok {
+		t.Fatalf("registering %s: %d %s", streamID, recorder.Code, recorder.Body)
+	}
+	t.Cleanup(func() { removeTestStream(streamID, stream) })
+	return stream
+}
+
+func videoSource(stream *WebRTCStream) *sourceIngest {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	for _, ingest := range stream.sources {
+		if ingest.kind == webrtc.RTPCodecTypeVideo {
+			return ingest
+		}
+	}
+	return nil
+}
+
+func TestSourceDropsDuplicateCandidates(t *testing.T) {
+	camera := newFakeCamera(t, nil)
+	source := newFakeCamera(t, func(c *fakeCamera) { c.repeatCandidates = true })
+	stream := registerWithVideoSource(t, "source-duplicates", camera, source.url)
+
+	waitFor(t, 5*time.Second, "the source's repeated candidates", func() bool {
+		return stream.duplicateCandidates.Load() > 0
+	})
+	if failure := stream.ingestFailure(); failure != "" {
+		t.Errorf("stream failed: %s", failure)
+	}
+}
+
+func TestSourceAnswerWithoutVideoFails(t *testing.T) {
+	camera := newFakeCamera(t, nil)
+	source := newFakeCamera(t, func(c *fakeCamera) { c.noVideo = true })
+	stream := registerWithVideoSource(t, "source-without-video", camera, source.url)
+
+	waitFor(t, 5*time.Second, "the source to fail the stream", func() bool {
+		return strings.Contains(stream.ingestFailure(), errNoVideoSection.Error())
+	})
+	// WHEP_RECONNECT_POLICY defaults to never, so the source is closed
+	waitFor(t, 5*time.Second, "the source to close", func() bool {
+		ingest := videoSource(stream)
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		return ingest != nil && ingest.peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed
+	})
+}
+
+func TestSourceGivesUpReconnecting(t *testing.T) {
+	defer func(attempts int64, delay, maxDelay time.Duration) {
+		maxReconnectAttempts, reconnectDelay, reconnectMaxDelay = attempts, delay, maxDelay
+	}(maxReconnectAttempts, reconnectDelay, reconnectMaxDelay)
+	maxReconnectAttempts, reconnectDelay, reconnectMaxDelay = 2, 10*time.Millisecond, 10*time.Millisecond
+
+	// Nothing listens here, so every dial fails
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	sourceURL := "ws" + strings.TrimPrefix(unreachable.URL, "http")
+	unreachable.Close()
+
+	stream := registerWithVideoSource(t, "source-gives-up", newFakeCamera(t, nil), sourceURL)
+	waitFor(t, 5*time.Second, "the stream to be given up on", func() bool {
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		return stream.dead
+	})
+	if got, want := stream.ingestFailure(), "gave up after 2 reconnect attempts"; got != want {
+		t.Errorf("failure = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// srtpProfilesByName are the DTLS-SRTP protection profiles Pion can run SRTP
+// with, by their RFC 5764/7714 names without the SRTP_ prefix.
+var srtpProfilesByName = map[string]dtls.SRTPProtectionProfile{
+	"AEAD_AES_256_GCM":       dtls.SRTP_AEAD_AES_256_GCM,
+	"AEAD_AES_128_GCM":       dtls.SRTP_AEAD_AES_128_GCM,
+	"AES128_CM_HMAC_SHA1_80": dtls.SRTP_AES128_CM_HMAC_SHA1_80,
+	"NULL_HMAC_SHA1_80":      dtls.SRTP_NULL_HMAC_SHA1_80,
+}
+
+// srtpProfiles restricts the protection profiles offered on ingest and viewer
+// connections, in preference order. nil keeps Pion's defaults. It's set from
+// WHEP_SRTP_PROFILES at startup.
+var (
+	srtpProfiles     []dtls.SRTPProtectionProfile
+	srtpProfileNames []string
+)
+
+// parseSRTPProfiles reads a comma-separated list of profile names, e.g.
+// AEAD_AES_256_GCM,AEAD_AES_128_GCM, rejecting names Pion doesn't support.
+// Pion v3 has no setting for DTLS cipher suites, which follow from its
+// ECDSA certificates.
+func parseSRTPProfiles(value string) ([]dtls.SRTPProtectionProfile, []string, error) {
+	var profiles []dtls.SRTPProtectionProfile
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SRTP_")
+		if name == "" {
+			continue
+		}
+		profile, ok := srtpProfilesByName[name]
+		if !ok {
+			supported := make([]string, 0, len(srtpProfilesByName))
+			for known := range srtpProfilesByName {
+				supported = append(supported, known)
+			}
+			sort.Strings(supported)
+			return nil, nil, fmt.Errorf("unknown SRTP profile %q, supported: %s", name, strings.Join(supported, ", "))
+		}
+		profiles = append(profiles, profile)
+		names = append(names, name)
+	}
+	return profiles, names, nil
+}
+
+func applySRTPProfiles(settingEngine *webrtc.SettingEngine) {
+	if len(srtpProfiles) > 0 {
+		settingEngine.SetSRTPProtectionProfiles(srtpProfiles...)
+	}
+}
+
+// negotiatedSRTPProfile describes the profile a connection restricted by
+// WHEP_SRTP_PROFILES ended up with. Pion doesn't expose the one chosen, so
+// with several allowed this names the candidates.
+func negotiatedSRTPProfile() string {
+	if len(srtpProfileNames) == 1 {
+		return srtpProfileNames[0]
+	}
+	return "one of " + strings.Join(srtpProfileNames, ", ")
+}
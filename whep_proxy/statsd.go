@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"time"
+)
+
+// statsdMaxPacket keeps datagrams under a typical MTU.
+const statsdMaxPacket = 1400
+
+// statsdCounters are a stream's counters at the last flush, to send deltas.
+type statsdCounters struct {
+	packets    uint64
+	bytes      uint64
+	reconnects uint64
+}
+
+var statsdUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// runStatsD sends per-stream stats to WHEP_STATSD_ADDR every
+// WHEP_STATSD_INTERVAL: ingest packets and reconnects as counters, viewers
+// and ingest bitrate in bits per second as gauges, under
+// {prefix}stream.{streamID}.
+func runStatsD(addr string) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		fmt.Printf("[WHEP_PROXY] Error starting StatsD exporter: %v\n", err)
+		return
+	}
+	defer conn.Close()
+	fmt.Printf("[WHEP_PROXY] Sending StatsD metrics to %s every %s\n", addr, statsdInterval)
+
+	// Keyed by stream rather than ID, so a stream re-registered under the
+	// same ID starts its deltas from zero instead of wrapping
+	last := make(map[*WebRTCStream]statsdCounters)
+	ticker := time.NewTicker(statsdInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		streamsMu.Lock()
+		snapshot := make(map[string]*WebRTCStream, len(streams))
+		for streamID, stream := range streams {
+			snapshot[streamID] = stream
+		}
+		streamsMu.Unlock()
+
+		sendStatsD(conn, statsdLines(snapshot, last))
+	}
+}
+
+// statsdLines formats the snapshot's stats, sending counters as deltas from
+// last, which it updates and prunes of streams no longer registered.
+func statsdLines(snapshot map[string]*WebRTCStream, last map[*WebRTCStream]statsdCounters) []string {
+	var lines []string
+	current := make(map[*WebRTCStream]bool, len(snapshot))
+	for streamID, stream := range snapshot {
+		current[stream] = true
+		stream.mu.Lock()
+		viewers := len(stream.viewers)
+		stream.mu.Unlock()
+		now := statsdCounters{
+			packets:    stream.ingestPackets.Load(),
+			bytes:      stream.ingestBytes.Load(),
+			reconnects: stream.reconnects.Load(),
+		}
+		prev := last[stream]
+		last[stream] = now
+
+		name := statsdPrefix + "stream." + statsdUnsafe.ReplaceAllString(streamID, "_")
+		bitrate := float64(now.bytes-prev.bytes) * 8 / statsdInterval.Seconds()
+		lines = append(lines,
+			fmt.Sprintf("%s.packets:%d|c", name, now.packets-prev.packets),
+			fmt.Sprintf("%s.reconnects:%d|c", name, now.reconnects-prev.reconnects),
+			fmt.Sprintf("%s.viewers:%d|g", name, viewers),
+			fmt.Sprintf("%s.bitrate:%.0f|g", name, bitrate),
+		)
+	}
+	for stream := range last {
+		if !current[stream] {
+			delete(last, stream)
+		}
+	}
+	return lines
+}
+
+// sendStatsD packs lines into as few datagrams as fit. Send errors, such as
+// nothing listening, are ignored as StatsD is fire and forget.
+func sendStatsD(conn net.Conn, lines []string) {
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			conn.Write(packet.Bytes())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		conn.Write(packet.Bytes())
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestStatsdLinesReregisteredStream(t *testing.T) {
+	last := make(map[*WebRTCStream]statsdCounters)
+	first := newWebRTCStream(WebRTCConfig{}, baseLogger)
+	first.ingestPackets.Store(1000)
+	first.reconnects.Store(3)
+	statsdLines(map[string]*WebRTCStream{"cam": first}, last)
+
+	first.ingestPackets.Store(1500)
+	lines := statsdLines(map[string]*WebRTCStream{"cam": first}, last)
+	if !slices.Contains(lines, statsdPrefix+"stream.cam.packets:500|c") {
+		t.Errorf("second flush sent %q, want a delta of 500 packets", lines)
+	}
+
+	// The camera re-registers: a new stream under the same ID, with counters
+	// below the old one's
+	second := newWebRTCStream(WebRTCConfig{}, baseLogger)
+	second.ingestPackets.Store(20)
+	lines = statsdLines(map[string]*WebRTCStream{"cam": second}, last)
+	for _, want := range []string{
+		statsdPrefix + "stream.cam.packets:20|c",
+		statsdPrefix + "stream.cam.reconnects:0|c",
+	} {
+		if !slices.Contains(lines, want) {
+			t.Errorf("flush after re-registering sent %q, want %q", lines, want)
+		}
+	}
+	if _, ok := last[first]; ok {
+		t.Error("the replaced stream's counters weren't pruned")
+	}
+}
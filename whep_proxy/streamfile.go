@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+)
+
+// streamFileEntry is one stream in WHEP_STREAMS_FILE, a JSON object keyed by
+// stream ID. It takes the same fields as the /websocket POST config.
+type streamFileEntry struct {
+	WebRTCConfig
+	// Port, if set, also serves this stream's WHEP endpoint at /whep on its
+	// own port, for tooling that expects one camera per port.
+	Port int `json:"port"`
+	// SignalingURLFile reads signaling_url from a file, such as a Docker
+	// secret, when signaling_url isn't set.
+	SignalingURLFile string `json:"signaling_url_file"`
+}
+
+// fileStreams holds the WHEP_STREAMS_FILE entries, or the streams in
+// WHEP_CONFIG_FILE. It's set once at startup.
+var fileStreams map[string]streamFileEntry
+
+// withStreamFileDefaults fills in the settings a /websocket POST left unset
+// from the stream's WHEP_STREAMS_FILE entry, so each camera can keep its own
+// signaling URL, ICE servers, name and sources there, then from
+// WHEP_SIGNALING_URL.
+func withStreamFileDefaults(streamID string, config WebRTCConfig) WebRTCConfig {
+	if entry, ok := fileStreams[streamID]; ok {
+		if config.SignalingURL == "" {
+			config.SignalingURL = entry.SignalingURL
+		}
+		if config.ICEServers == nil {
+			config.ICEServers = entry.ICEServers
+		}
+		if config.Name == "" {
+			config.Name = entry.Name
+		}
+		if config.Sources == nil {
+			config.Sources = entry.Sources
+		}
+	}
+	if config.SignalingURL == "" {
+		config.SignalingURL = defaultSignalingURL
+	}
+	return config
+}
+
+// loadStreams reads the per-stream settings from WHEP_STREAMS_FILE, or else
+// the streams in WHEP_CONFIG_FILE, and the name of the file they came from.
+func loadStreams() (map[string]streamFileEntry, string, error) {
+	if streamsFile != "" || fileConfig.Streams == nil {
+		entries, err := loadStreamsFile(streamsFile)
+		return entries, streamsFile, err
+	}
+	if err := checkStreamEntries(fileConfig.Streams); err != nil {
+		return nil, configFile, fmt.Errorf("%s: %w", configFile, err)
+	}
+	return fileConfig.Streams, configFile, nil
+}
+
+func loadStreamsFile(path string) (map[string]streamFileEntry, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]streamFileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return entries, checkStreamEntries(entries)
+}
+
+// checkStreamEntries reads signaling_url_file secrets into the entries and
+// rejects invalid sources and invalid or shared ports.
+func checkStreamEntries(entries map[string]streamFileEntry) error {
+	ports := make(map[int]string)
+	for streamID, entry := range entries {
+		if entry.SignalingURL == "" && entry.SignalingURLFile != "" {
+			signalingURL, err := readSecretFile(entry.SignalingURLFile)
+			if err != nil {
+				return fmt.Errorf("stream %s: %w", streamID, err)
+			}
+			entry.SignalingURL = signalingURL
+			entries[streamID] = entry
+		}
+		if err := entry.checkSources(); err != nil {
+			return fmt.Errorf("stream %s: %w", streamID, err)
+		}
+		if entry.Port == 0 {
+			continue
+		}
+		if entry.Port < 0 || entry.Port > 65535 {
+			return fmt.Errorf("stream %s: invalid port %d", streamID, entry.Port)
+		}
+		if other, ok := ports[entry.Port]; ok {
+			return fmt.Errorf("streams %s and %s both use port %d", other, streamID, entry.Port)
+		}
+		ports[entry.Port] = streamID
+	}
+	return nil
+}
+
+// serveStreamPort serves a single stream's WHEP endpoint on its own port. The
+// session resource keeps its usual /whep/{streamID}/{viewerID} path so the
+// Location returned by whepHandler works unchanged.
+func serveStreamPort(streamID string, port int) (*http.Server, error) {
+	withStream := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			if id, ok := vars["streamID"]; ok && id != streamID {
+				http.Error(w, fmt.Sprintf("Stream %s not found", id), http.StatusNotFound)
+				return
+			}
+			if vars == nil {
+				vars = make(map[string]string)
+			}
+			vars["streamID"] = streamID
+			next(w, mux.SetURLVars(r, vars))
+		}
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/whep", withRequestID(rateLimited(withStream(whepHandler)))).Methods("GET", "OPTIONS", "POST")
+	r.HandleFunc("/whep/{streamID}/{viewerID}", withRequestID(withStream(whepResourceHandler))).Methods("DELETE")
+	r.HandleFunc("/whep/{streamID}/{viewerID}/events", withRequestID(withStream(whepEventsHandler))).Methods("GET")
+	r.MethodNotAllowedHandler = methodNotAllowedHandler(r)
+
+	addr := fmt.Sprintf(":%d", port)
+	listener, err := net.Listen(tcpNetwork(), addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: r}
+	go func() {
+		fmt.Printf("[WHEP_PROXY] Serving stream %s on %s\n", streamID, addr)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("[WHEP_PROXY] Error serving stream %s on %s: %v\n", streamID, addr, err)
+		}
+	}()
+	return server, nil
+}
+
+// shutdownStreamPorts stops the per-stream servers, giving in-flight
+// negotiations until ctx is done to finish.
+func shutdownStreamPorts(ctx context.Context, servers []*http.Server) {
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+// The test pattern is encoded in-process so it needs no sample file or
+// external encoder: every changed macroblock is sent as I_PCM, which any
+// baseline H264 decoder accepts. It is deliberately tiny and low frame rate.
+const (
+	testPatternWidthMbs  = 10 // 160px
+	testPatternHeightMbs = 7  // 112px
+	testPatternFPS       = 10
+	testPatternGOP       = testPatternFPS // one IDR per second
+)
+
+// Background colour bars (Y, Cb, Cr) and the moving bar colour
+var (
+	testPatternBars = [][3]byte{
+		{180, 128, 128}, {168, 44, 136}, {145, 147, 44}, {133, 63, 52},
+		{63, 193, 204}, {51, 109, 212}, {28, 212, 120}, {16, 128, 128},
+	}
+	testPatternMarker = [3]byte{235, 128, 128}
+)
+
+// runTestPattern feeds a synthetic moving H264 pattern into the stream until
+// it is cleaned up.
+func runTestPattern(streamID string, stream *WebRTCStream) {
+	stream.log.Printf("Serving test pattern on stream %s\n", streamID)
+
+	packetizer := rtp.NewPacketizer(1200, 102, rand.Uint32(), &codecs.H264Payloader{}, rtp.NewRandomSequencer(), 90000)
+	encoder := &testPatternEncoder{}
+
+	ticker := time.NewTicker(time.Second / testPatternFPS)
+	defer ticker.Stop()
+	for frame := 0; ; frame++ {
+		<-ticker.C
+
+		if stream.isClosed() {
+			stream.log.Printf("Test pattern on stream %s stopped\n", streamID)
+			return
+		}
+
+		for _, pkt := range packetizer.Packetize(encoder.encode(frame), 90000/testPatternFPS) {
+			stream.forwardRTP(pkt)
+		}
+	}
+}
+
+type testPatternEncoder struct {
+	previous []byte
+	frameNum int
+	idrID    int
+}
+
+// render draws colour bars with a white bar sweeping across them, as planar
+// 4:2:0 macroblocks (256 luma, 64 Cb, 64 Cr bytes each).
+func (e *testPatternEncoder) render(frame int) []byte {
+	mbs := testPatternWidthMbs * testPatternHeightMbs
+	pixels := make([]byte, 0, mbs*384)
+	markerCol := frame % testPatternWidthMbs
+	for mb := 0; mb < mbs; mb++ {
+		col := mb % testPatternWidthMbs
+		color := testPatternBars[col*len(testPatternBars)/testPatternWidthMbs]
+		if col == markerCol {
+			color = testPatternMarker
+		}
+		for plane, size := range []int{256, 64, 64} {
+			for i := 0; i < size; i++ {
+				pixels = append(pixels, color[plane])
+			}
+		}
+	}
+	return pixels
+}
+
+// encode returns the Annex B access unit for the given frame number.
+func (e *testPatternEncoder) encode(frame int) []byte {
+	pixels := e.render(frame)
+	idr := frame%testPatternGOP == 0 || e.previous == nil
+
+	var au []byte
+	if idr {
+		e.frameNum = 0
+		au = append(au, annexB(0x67, testPatternSPS())...)
+		au = append(au, annexB(0x68, testPatternPPS())...)
+		au = append(au, annexB(0x65, e.slice(pixels, true))...)
+		e.idrID = (e.idrID + 1) % 2
+	} else {
+		e.frameNum = (e.frameNum + 1) % 16
+		au = append(au, annexB(0x41, e.slice(pixels, false))...)
+	}
+	e.previous = pixels
+	return au
+}
+
+func (e *testPatternEncoder) slice(pixels []byte, idr bool) []byte {
+	w := &bitWriter{}
+	w.ue(0) // first_mb_in_slice
+	if idr {
+		w.ue(7) // slice_type: I (all slices)
+	} else {
+		w.ue(5) // slice_type: P (all slices)
+	}
+	w.ue(0)                     // pic_parameter_set_id
+	w.bits(uint(e.frameNum), 4) // frame_num
+	if idr {
+		w.ue(uint(e.idrID)) // idr_pic_id
+	} else {
+		w.bit(0) // num_ref_idx_active_override_flag
+		w.bit(0) // ref_pic_list_modification_flag_l0
+	}
+	if idr {
+		w.bit(0) // no_output_of_prior_pics_flag
+		w.bit(0) // long_term_reference_flag
+	} else {
+		w.bit(0) // adaptive_ref_pic_marking_mode_flag
+	}
+	w.se(0) // slice_qp_delta
+	w.ue(1) // disable_deblocking_filter_idc
+
+	skipRun := uint(0)
+	for mb := 0; mb < testPatternWidthMbs*testPatternHeightMbs; mb++ {
+		samples := pixels[mb*384 : (mb+1)*384]
+		if !idr {
+			if string(samples) == string(e.previous[mb*384:(mb+1)*384]) {
+				skipRun++
+				continue
+			}
+			w.ue(skipRun) // mb_skip_run
+			skipRun = 0
+			w.ue(30) // mb_type: I_PCM in a P slice
+		} else {
+			w.ue(25) // mb_type: I_PCM
+		}
+		w.align()
+		w.bytes(samples)
+	}
+	if skipRun > 0 {
+		w.ue(skipRun)
+	}
+	w.trailing()
+	return w.buf
+}
+
+func testPatternSPS() []byte {
+	w := &bitWriter{}
+	w.bits(66, 8)   // profile_idc: baseline
+	w.bits(0xc0, 8) // constraint_set0_flag, constraint_set1_flag
+	w.bits(30, 8)   // level_idc
+	w.ue(0)         // seq_parameter_set_id
+	w.ue(0)         // log2_max_frame_num_minus4
+	w.ue(2)         // pic_order_cnt_type
+	w.ue(1)         // max_num_ref_frames
+	w.bit(0)        // gaps_in_frame_num_value_allowed_flag
+	w.ue(testPatternWidthMbs - 1)
+	w.ue(testPatternHeightMbs - 1)
+	w.bit(1) // frame_mbs_only_flag
+	w.bit(1) // direct_8x8_inference_flag
+	w.bit(0) // frame_cropping_flag
+	w.bit(0) // vui_parameters_present_flag
+	w.trailing()
+	return w.buf
+}
+
+func testPatternPPS() []byte {
+	w := &bitWriter{}
+	w.ue(0)      // pic_parameter_set_id
+	w.ue(0)      // seq_parameter_set_id
+	w.bit(0)     // entropy_coding_mode_flag: CAVLC
+	w.bit(0)     // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)      // num_slice_groups_minus1
+	w.ue(0)      // num_ref_idx_l0_default_active_minus1
+	w.ue(0)      // num_ref_idx_l1_default_active_minus1
+	w.bit(0)     // weighted_pred_flag
+	w.bits(0, 2) // weighted_bipred_idc
+	w.se(0)      // pic_init_qp_minus26
+	w.se(0)      // pic_init_qs_minus26
+	w.se(0)      // chroma_qp_index_offset
+	w.bit(1)     // deblocking_filter_control_present_flag
+	w.bit(0)     // constrained_intra_pred_flag
+	w.bit(0)     // redundant_pic_cnt_present_flag
+	w.trailing()
+	return w.buf
+}
+
+// annexB prefixes a start code and NAL header, inserting emulation
+// prevention bytes into the RBSP.
+func annexB(header byte, rbsp []byte) []byte {
+	nal := []byte{0, 0, 0, 1, header}
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros == 2 && b <= 3 {
+			nal = append(nal, 3)
+			zeros = 0
+		}
+		nal = append(nal, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return nal
+}
+
+// bitWriter writes the MSB-first bit fields used by H264 RBSPs.
+type bitWriter struct {
+	buf   []byte
+	nbits uint
+}
+
+func (w *bitWriter) bit(b uint) {
+	if w.nbits%8 == 0 {
+		w.buf = append(w.buf, 0)
+	}
+	if b != 0 {
+		w.buf[len(w.buf)-1] |= 0x80 >> (w.nbits % 8)
+	}
+	w.nbits++
+}
+
+func (w *bitWriter) bits(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.bit((v >> uint(i)) & 1)
+	}
+}
+
+// ue writes an unsigned Exp-Golomb code.
+func (w *bitWriter) ue(v uint) {
+	v++
+	n := 0
+	for t := v; t > 1; t >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v, n+1)
+}
+
+// se writes a signed Exp-Golomb code.
+func (w *bitWriter) se(v int) {
+	if v > 0 {
+		w.ue(uint(2*v - 1))
+	} else {
+		w.ue(uint(-2 * v))
+	}
+}
+
+func (w *bitWriter) align() {
+	for w.nbits%8 != 0 {
+		w.bit(0)
+	}
+}
+
+func (w *bitWriter) bytes(b []byte) {
+	w.align()
+	w.buf = append(w.buf, b...)
+	w.nbits += uint(len(b)) * 8
+}
+
+// trailing writes rbsp_trailing_bits.
+func (w *bitWriter) trailing() {
+	w.bit(1)
+	w.align()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Media and viewer events recorded on a stream's timeline, alongside the
+// lifecycle events also sent to the webhook
+const (
+	eventKeyframe    = "keyframe"
+	eventReconnect   = "reconnect"
+	eventSSRCChange  = "ssrc-change"
+	eventDegraded    = "degraded"
+	eventRecovered   = "recovered"
+	eventViewerJoin  = "viewer-join"
+	eventViewerLeave = "viewer-leave"
+)
+
+// timelineLength is how many of its latest events a stream keeps for clients
+// that connect to /streams/{streamID}/events later.
+const timelineLength = 256
+
+type timelineEvent struct {
+	StreamID  string    `json:"streamID"`
+	Event     string    `json:"event"`
+	Detail    string    `json:"detail,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// streamTimeline holds a stream's recent events, for debugging intermittent
+// issues after the fact.
+type streamTimeline struct {
+	mu      sync.Mutex
+	events  []timelineEvent // the newest timelineLength
+	total   int             // events ever recorded, the next event's ID
+	changed chan struct{}   // closed and replaced on every event
+}
+
+// recordEvent adds an event to the stream's timeline and to WHEP_EVENT_LOG.
+func (s *WebRTCStream) recordEvent(streamID, event, detail string) {
+	entry := timelineEvent{StreamID: streamID, Event: event, Detail: detail, Timestamp: time.Now()}
+	t := &s.timeline
+	t.mu.Lock()
+	if len(t.events) == timelineLength {
+		t.events = append(t.events[:0], t.events[1:]...)
+	}
+	t.events = append(t.events, entry)
+	t.total++
+	if t.changed != nil {
+		close(t.changed)
+	}
+	t.changed = make(chan struct{})
+	t.mu.Unlock()
+	writeEventLog(entry)
+}
+
+// since returns the events from ID next on that are still kept, the ID of the
+// first returned, and a channel closed on the next event.
+func (t *streamTimeline) since(next int) ([]timelineEvent, int, <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.changed == nil {
+		t.changed = make(chan struct{})
+	}
+	first := t.total - len(t.events)
+	if next < first {
+		next = first
+	}
+	if next > t.total {
+		next = t.total
+	}
+	return append([]timelineEvent(nil), t.events[next-first:]...), next, t.changed
+}
+
+// eventLog is WHEP_EVENT_LOG, opened at startup, or nil.
+var (
+	eventLog   *os.File
+	eventLogMu sync.Mutex
+)
+
+// writeEventLog appends an event to WHEP_EVENT_LOG as a line of JSON.
+func writeEventLog(entry timelineEvent) {
+	if eventLog == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	eventLogMu.Lock()
+	defer eventLogMu.Unlock()
+	if _, err := eventLog.Write(append(line, '\n')); err != nil {
+		fmt.Printf("[WHEP_PROXY] Error writing event log: %v\n", err)
+	}
+}
+
+// openEventLog opens WHEP_EVENT_LOG for appending.
+func openEventLog(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
+
+// timelineHandler streams a stream's timeline as server-sent events: the
+// events still kept, then new ones as they happen, until the stream is
+// reaped. Each carries its ID, so a reconnecting EventSource resumes after
+// Last-Event-ID.
+func timelineHandler(w http.ResponseWriter, r *http.Request) {
+	streamID := mux.Vars(r)["streamID"]
+	stream, ok := getStream(streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	next := 0
+	if lastID, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		next = lastID + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		events, first, changed := stream.timeline.since(next)
+		for i, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", first+i, event.Event, data)
+			if event.Event == eventReaped {
+				flusher.Flush()
+				return
+			}
+		}
+		next = first + len(events)
+		flusher.Flush()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// RTP header extensions cameras may stamp packets with. The proxy offers the
+// one in WHEP_TIMESTAMP_EXTENSION and, when the camera agrees, measures how
+// long packets take to arrive.
+const (
+	absSendTimeURI    = "http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time"
+	absCaptureTimeURI = "http://www.webrtc.org/experiments/rtp-hdrext/abs-capture-time"
+)
+
+// cameraLatencyStale is how long a latency sample stays current, so a camera
+// that stops stamping packets stops reporting a latency.
+const cameraLatencyStale = 10 * time.Second
+
+// cameraLatency is the smoothed delay between a camera stamping video packets
+// and the proxy receiving them. abs-send-time only carries the low 64 seconds
+// of the send time and abs-capture-time is absolute, so both rely on the
+// camera's clock agreeing with the proxy's, e.g. both on NTP.
+type cameraLatency struct {
+	smoothed  atomic.Int64 // nanoseconds
+	sampledAt atomic.Int64 // UnixNano of the last sample, 0 if none
+}
+
+// record takes a sample from pkt's timestamp extension, which has the
+// negotiated id. Samples are smoothed with a gain of 1/16, as RTP jitter is.
+func (l *cameraLatency) record(pkt *rtp.Packet, id uint8, received time.Time) {
+	payload := pkt.GetExtension(id)
+	if payload == nil {
+		return
+	}
+	var stamped time.Time
+	switch timestampExtension {
+	case absSendTimeURI:
+		var ext rtp.AbsSendTimeExtension
+		if ext.Unmarshal(payload) != nil {
+			return
+		}
+		stamped = ext.Estimate(received)
+	case absCaptureTimeURI:
+		var ext rtp.AbsCaptureTimeExtension
+		if ext.Unmarshal(payload) != nil {
+			return
+		}
+		stamped = ext.CaptureTime()
+	default:
+		return
+	}
+	sample := int64(received.Sub(stamped))
+	if l.sampledAt.Swap(received.UnixNano()) == 0 {
+		l.smoothed.Store(sample)
+		return
+	}
+	previous := l.smoothed.Load()
+	l.smoothed.Store(previous + (sample-previous)/16)
+}
+
+// value returns the smoothed latency, if a sample is recent enough.
+func (l *cameraLatency) value() (time.Duration, bool) {
+	sampledAt := l.sampledAt.Load()
+	if sampledAt == 0 || time.Since(time.Unix(0, sampledAt)) > cameraLatencyStale {
+		return 0, false
+	}
+	return time.Duration(l.smoothed.Load()), true
+}
+
+// timestampExtensionID returns the id a receiver negotiated for
+// WHEP_TIMESTAMP_EXTENSION, or 0 if the camera didn't accept it.
+func timestampExtensionID(receiver *webrtc.RTPReceiver) uint8 {
+	if timestampExtension == "" {
+		return 0
+	}
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == timestampExtension {
+			return uint8(extension.ID)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/pion/webrtc/v3"
+)
+
+// Viewers choose how they get the proxy's ICE candidates with a trickle query
+// parameter or X-WHEP-Trickle header, defaulting to WHEP_TRICKLE:
+//
+//   - off waits for ICE gathering and answers with every candidate inline.
+//     Any client works, but the answer takes as long as gathering, which with
+//     STUN or TURN servers can be seconds.
+//   - sse answers as soon as the answer is created, with a Link to an event
+//     stream on the session resource that carries the rest of the candidates.
+//     Connecting is faster, but the client has to read the stream.
+//
+// The mode used is echoed in X-WHEP-Trickle on the answer.
+const (
+	trickleHeader   = "X-WHEP-Trickle"
+	trickleOff      = "off"
+	trickleSSE      = "sse"
+	sseLinkRelation = "urn:ietf:params:whep:ext:core:server-sent-events"
+)
+
+// trickleMode is the mode a POST asked for, the query parameter winning over
+// the header. Unknown values are ignored.
+func trickleMode(r *http.Request) string {
+	for _, mode := range []string{r.URL.Query().Get("trickle"), r.Header.Get(trickleHeader)} {
+		switch mode := strings.ToLower(mode); mode {
+		case trickleOff, trickleSSE:
+			return mode
+		}
+	}
+	return defaultTrickleMode
+}
+
+// candidateFeed buffers a viewer's local ICE candidates until its event
+// stream reads them, since the client only connects after the answer.
+type candidateFeed struct {
+	mu         sync.Mutex
+	candidates []webrtc.ICECandidateInit
+	done       bool          // gathering finished
+	changed    chan struct{} // closed and replaced on every update
+}
+
+func newCandidateFeed() *candidateFeed {
+	return &candidateFeed{changed: make(chan struct{})}
+}
+
+// add records a gathered candidate, or the end of gathering for nil, as
+// passed to OnICECandidate.
+func (f *candidateFeed) add(candidate *webrtc.ICECandidate) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return
+	}
+	if candidate == nil {
+		f.done = true
+	} else {
+		f.candidates = append(f.candidates, candidate.ToJSON())
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// since returns the candidates after the first n, whether gathering has
+// finished, and a channel closed on the next update.
+func (f *candidateFeed) since(n int) ([]webrtc.ICECandidateInit, bool, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.candidates[n:], f.done, f.changed
+}
+
+// whepEventsHandler streams a trickle viewer's candidates as server-sent
+// events: a candidate event per candidate, with the JSON the ingest signaling
+// uses, then end-of-candidates.
+func whepEventsHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLog(r)
+	vars := mux.Vars(r)
+	streamID := vars["streamID"]
+	viewerID := vars["viewerID"]
+
+	stream, ok := getStream(streamID)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Stream %s not found", streamID), http.StatusNotFound)
+		return
+	}
+	viewer, ok := stream.viewer(viewerID)
+	if !ok || viewer.candidates == nil {
+		http.Error(w, fmt.Sprintf("Session %s not found", viewerID), http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sent := 0
+	for {
+		candidates, done, changed := viewer.candidates.since(sent)
+		for _, candidate := range candidates {
+			data, err := json.Marshal(candidate)
+			if err != nil {
+				log.Printf("Error encoding candidate for viewer %s: %v\n", viewerID, err)
+				return
+			}
+			fmt.Fprintf(w, "event: candidate\ndata: %s\n\n", data)
+		}
+		sent += len(candidates)
+		if done {
+			fmt.Fprint(w, "event: end-of-candidates\ndata:\n\n")
+			flusher.Flush()
+			log.Printf("Sent %d candidates to viewer %s\n", sent, viewerID)
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
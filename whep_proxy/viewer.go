@@ -0,0 +1,857 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// viewerSession is a single WHEP client watching a stream. Each viewer gets its
+// own local track so that forwarded packets and bytes can be counted per viewer.
+type viewerSession struct {
+	id             string
+	peerConnection *webrtc.PeerConnection
+	track          *webrtc.TrackLocalStaticRTP // nil when answered audio-only
+	audioTrack     *webrtc.TrackLocalStaticRTP // nil when answered video-only
+	remoteAddr     string
+	connectedAt    time.Time
+	packets        atomic.Uint64
+	bytes          atomic.Uint64
+	resyncs        atomic.Uint64
+	packetsLost    atomic.Uint32  // video, as last reported by the viewer
+	lastRTCP       atomic.Int64   // UnixNano of the viewer's last video RTCP, or audio if audio-only
+	candidates     *candidateFeed // nil unless the viewer trickles over SSE
+
+	// queue feeds writeVideo. It's created and closed under the stream's mu,
+	// which also guards resyncing.
+	queue     chan *rtp.Packet
+	resyncing bool // dropping video until the next keyframe
+
+	// impairment degrades the viewer's video for testing, if it asked to be
+	impairment *viewerImpairment
+}
+
+type viewerInfo struct {
+	ID          string    `json:"id"`
+	Resource    string    `json:"resource"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+}
+
+// viewerSummary is the end-of-session record returned by DELETE.
+type viewerSummary struct {
+	ID              string  `json:"id"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	Packets         uint64  `json:"packets"`
+	Bytes           uint64  `json:"bytes"`
+	PacketsLost     uint32  `json:"packetsLost"`
+	Resyncs         uint64  `json:"resyncs"`
+	RoundTripTime   float64 `json:"roundTripTime,omitempty"` // seconds, of the selected candidate pair
+}
+
+type viewerStats struct {
+	ID      string `json:"id"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+	Resyncs uint64 `json:"resyncs"`
+}
+
+// newViewerPeerConnection builds the PeerConnection served to a WHEP client of
+// streamID. Viewers use the stream's ICE transport policy, and its TURN
+// servers when that policy is relay.
+func newViewerPeerConnection(streamID string, config WebRTCConfig) (*webrtc.PeerConnection, error) {
+	m := &webrtc.MediaEngine{}
+	if err := registerViewerCodecs(m); err != nil {
+		return nil, err
+	}
+	interceptorRegistry, err := newViewerInterceptors(m, viewerCNAME(streamID))
+	if err != nil {
+		return nil, err
+	}
+
+	settingEngine := webrtc.SettingEngine{}
+	// Some clients only cope with one side of a=setup:actpass
+	if viewerDTLSRole != webrtc.DTLSRoleAuto {
+		if err := settingEngine.SetAnsweringDTLSRole(viewerDTLSRole); err != nil {
+			return nil, err
+		}
+	}
+	if err := applySocketOptions(&settingEngine); err != nil {
+		return nil, err
+	}
+	applyAdvertisedIP(&settingEngine)
+	applyIPFamily(&settingEngine)
+	applySRTPProfiles(&settingEngine)
+	applyViewerUDPMux(&settingEngine)
+
+	configuration := webrtc.Configuration{ICETransportPolicy: config.iceTransportPolicy(viewerICEPolicy)}
+	if configuration.ICETransportPolicy == webrtc.ICETransportPolicyRelay {
+		configuration.ICEServers = config.webrtcICEServers()
+	}
+	if viewerForceBundle {
+		configuration.BundlePolicy = webrtc.BundlePolicyMaxBundle
+		configuration.RTCPMuxPolicy = webrtc.RTCPMuxPolicyRequire
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
+		webrtc.WithSettingEngine(settingEngine),
+	).NewPeerConnection(configuration)
+}
+
+// registerViewerCodecs registers Pion's default codecs, or with
+// WHEP_DISABLE_AUDIO only its default video codecs, so audio sections in
+// viewer offers are rejected.
+func registerViewerCodecs(m *webrtc.MediaEngine) error {
+	if !disableAudio {
+		return m.RegisterDefaultCodecs()
+	}
+	codecs, err := defaultVideoCodecs()
+	if err != nil {
+		return err
+	}
+	for _, codec := range codecs {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	defaultVideoCodecsOnce sync.Once
+	defaultVideoCodecList  []webrtc.RTPCodecParameters
+	defaultVideoCodecsErr  error
+)
+
+// defaultVideoCodecs lists the video codecs RegisterDefaultCodecs registers,
+// read back from a throwaway PeerConnection as the MediaEngine doesn't
+// expose them.
+func defaultVideoCodecs() ([]webrtc.RTPCodecParameters, error) {
+	defaultVideoCodecsOnce.Do(func() {
+		m := &webrtc.MediaEngine{}
+		if defaultVideoCodecsErr = m.RegisterDefaultCodecs(); defaultVideoCodecsErr != nil {
+			return
+		}
+		var peerConnection *webrtc.PeerConnection
+		peerConnection, defaultVideoCodecsErr = webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+		if defaultVideoCodecsErr != nil {
+			return
+		}
+		defer peerConnection.Close()
+		var transceiver *webrtc.RTPTransceiver
+		transceiver, defaultVideoCodecsErr = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		if defaultVideoCodecsErr != nil {
+			return
+		}
+		defaultVideoCodecList = transceiver.Receiver().GetParameters().Codecs
+	})
+	return defaultVideoCodecList, defaultVideoCodecsErr
+}
+
+// newViewerInterceptors sets up NACK, RTCP reports and TWCC for viewers, and
+// SDES with cname unless it's "". The default video codecs already advertise
+// nack, nack pli and ccm fir, so unlike webrtc.ConfigureNack this doesn't
+// register that feedback a second time.
+func newViewerInterceptors(m *webrtc.MediaEngine, cname string) (*interceptor.Registry, error) {
+	interceptorRegistry := &interceptor.Registry{}
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	responder, err := nack.NewResponderInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	interceptorRegistry.Add(responder)
+	interceptorRegistry.Add(generator)
+
+	if cname != "" {
+		interceptorRegistry.Add(&cnameInterceptorFactory{cname: cname})
+	}
+	if err := webrtc.ConfigureRTCPReports(interceptorRegistry); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureTWCCSender(m, interceptorRegistry); err != nil {
+		return nil, err
+	}
+	return interceptorRegistry, nil
+}
+
+// viewerPLIInterval limits how often viewer keyframe requests are relayed to
+// the camera, so a room of viewers recovering from the same loss sends one PLI.
+const viewerPLIInterval = time.Second
+
+// relayKeyframeRequests reads a viewer's video RTCP and relays its PLI and FIR
+// to the camera, so browsers can recover from loss without waiting for the
+// next periodic keyframe. With WHEP_ADAPTIVE_PLI it also requests keyframes
+// while the viewer's receiver reports show sustained loss, which a browser
+// that keeps decoding through corruption may never PLI for.
+func relayKeyframeRequests(streamID string, stream *WebRTCStream, viewer *viewerSession, rtpSender *webrtc.RTPSender) {
+	var ssrc webrtc.SSRC
+	if encodings := rtpSender.GetParameters().Encodings; len(encodings) > 0 {
+		ssrc = encodings[0].SSRC
+	}
+	var lossySince time.Time
+	lossy := false
+	for {
+		pkts, _, err := rtpSender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		viewer.lastRTCP.Store(time.Now().UnixNano())
+		for _, pkt := range pkts {
+			switch pkt := pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				stream.throttledKeyframeRequest(streamID, &stream.lastViewerPLI, viewerPLIInterval, "viewer")
+			case *rtcp.ReceiverReport:
+				for _, report := range pkt.Reports {
+					if report.SSRC != uint32(ssrc) {
+						continue
+					}
+					viewer.packetsLost.Store(report.TotalLost)
+					if !adaptivePLI {
+						continue
+					}
+					lossPercent := int64(report.FractionLost) * 100 / 256
+					if lossPercent <= lossPLIThreshold {
+						if lossy {
+							stream.log.Printf("Viewer loss on stream %s subsided to %d%%\n", streamID, lossPercent)
+						}
+						lossySince, lossy = time.Time{}, false
+						continue
+					}
+					if lossySince.IsZero() {
+						lossySince = time.Now()
+					}
+					if time.Since(lossySince) < lossPLISustain {
+						continue
+					}
+					if !lossy {
+						stream.log.Printf("Viewer on stream %s reports %d%% loss, requesting keyframes\n", streamID, lossPercent)
+						lossy = true
+					}
+					stream.throttledKeyframeRequest(streamID, &stream.lastLossPLI, lossPLIInterval, "loss")
+				}
+			}
+		}
+	}
+}
+
+// reclaimIdleViewer closes a viewer that sends no RTCP for
+// WHEP_VIEWER_IDLE_TIMEOUT, counting from when it was created, as browsers
+// report every few seconds while a session is alive. It catches clients that
+// vanish without a DELETE and whose ICE, kept alive by a NAT or a suspended
+// tab, never fails.
+func reclaimIdleViewer(streamID string, stream *WebRTCStream, viewer *viewerSession) {
+	viewer.lastRTCP.CompareAndSwap(0, viewer.connectedAt.UnixNano())
+	ticker := time.NewTicker(viewerIdleTimeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		if viewer.peerConnection.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+		idle := time.Since(time.Unix(0, viewer.lastRTCP.Load()))
+		if idle < viewerIdleTimeout {
+			continue
+		}
+		stream.log.Printf("Closing viewer %s of stream %s, no RTCP for %s\n", viewer.id, streamID, idle.Round(time.Second))
+		viewerIdleReclaims.Inc()
+		viewer.peerConnection.Close()
+		return
+	}
+}
+
+// throttledKeyframeRequest asks the camera for a keyframe unless one was
+// requested for the same reason within interval, as recorded in last.
+func (stream *WebRTCStream) throttledKeyframeRequest(streamID string, last *atomic.Int64, interval time.Duration, reason string) {
+	now := time.Now().UnixNano()
+	prev := last.Load()
+	if now-prev < int64(interval) || !last.CompareAndSwap(prev, now) {
+		return
+	}
+	if err := stream.requestKeyframe(); err == nil {
+		keyframeRequests.WithLabelValues(reason).Inc()
+		logDebugf("Requested keyframe for stream %s (%s)", streamID, reason)
+	} else if !errors.Is(err, errNoIngestVideo) {
+		stream.log.Printf("Error requesting keyframe for stream %s: %v\n", streamID, err)
+	}
+}
+
+// negotiationSlots bounds concurrent viewer negotiations, which are heavy on
+// CPU and UDP ports, to WHEP_MAX_CONCURRENT_NEGOTIATIONS. nil is unlimited.
+var negotiationSlots chan struct{}
+
+func init() {
+	if maxConcurrentNegotiations > 0 {
+		negotiationSlots = make(chan struct{}, maxConcurrentNegotiations)
+	}
+}
+
+// acquireNegotiation waits up to WHEP_NEGOTIATION_WAIT for a negotiation
+// slot. The caller must call release once the answer is sent.
+func acquireNegotiation(ctx context.Context) (release func(), ok bool) {
+	if negotiationSlots == nil {
+		return func() {}, true
+	}
+	timer := time.NewTimer(negotiationWait)
+	defer timer.Stop()
+	select {
+	case negotiationSlots <- struct{}{}:
+		return func() { <-negotiationSlots }, true
+	case <-timer.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// applyCodecPreference restricts and orders the viewer's video codecs to
+// WHEP_CODEC_PREFERENCE, if set.
+func applyCodecPreference(peerConnection *webrtc.PeerConnection, rtpSender *webrtc.RTPSender) error {
+	if len(codecPreference) == 0 {
+		return nil
+	}
+	codecs := preferredCodecs(rtpSender.GetParameters().Codecs)
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Sender() == rtpSender {
+			return transceiver.SetCodecPreferences(codecs)
+		}
+	}
+	return nil
+}
+
+// preferredCodecs returns every registered variant of each preferred codec,
+// in preference order.
+func preferredCodecs(registered []webrtc.RTPCodecParameters) []webrtc.RTPCodecParameters {
+	codecs := []webrtc.RTPCodecParameters{}
+	for _, mimeType := range codecPreference {
+		for _, codec := range registered {
+			if strings.EqualFold(codec.MimeType, mimeType) {
+				codecs = append(codecs, codec)
+			}
+		}
+	}
+	// Keep retransmission for the codecs that made the cut
+	for _, codec := range codecs {
+		apt := fmt.Sprintf("apt=%d", codec.PayloadType)
+		for _, rtx := range registered {
+			if strings.EqualFold(rtx.MimeType, "video/rtx") && rtx.SDPFmtpLine == apt {
+				codecs = append(codecs, rtx)
+			}
+		}
+	}
+	return codecs
+}
+
+// validateCodecPreference drops preferred codecs the viewer media engine
+// doesn't register.
+func validateCodecPreference(preference []string) []string {
+	if len(preference) == 0 {
+		return preference
+	}
+	peerConnection, err := newViewerPeerConnection("", WebRTCConfig{})
+	if err != nil {
+		fmt.Printf("[WHEP_PROXY] Error validating codec preference: %v\n", err)
+		return nil
+	}
+	defer peerConnection.Close()
+	transceiver, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		fmt.Printf("[WHEP_PROXY] Error validating codec preference: %v\n", err)
+		return nil
+	}
+	registered := transceiver.Sender().GetParameters().Codecs
+
+	valid := []string{}
+	for _, mimeType := range preference {
+		found := false
+		for _, codec := range registered {
+			if strings.EqualFold(codec.MimeType, mimeType) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			invalidConfig("Ignoring unsupported codec %s in WHEP_CODEC_PREFERENCE", mimeType)
+			continue
+		}
+		valid = append(valid, mimeType)
+	}
+	fmt.Printf("[WHEP_PROXY] Viewer codec preference: %v\n", valid)
+	return valid
+}
+
+// offerMedia reports which of the stream's media a viewer's offer asks to
+// receive: video, and audio it can take as the camera's PCMU. The proxy
+// doesn't transcode, so viewers that only take e.g. Opus are answered without
+// audio rather than failing negotiation. Sections that are rejected, or only
+// send, don't count. An offer without any audio or video section, such as a
+// datachannel-only one, is errOfferWithoutMedia.
+func offerMedia(offer string) (video, audio bool, err error) {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(offer)); err != nil {
+		return false, false, err
+	}
+	sections := 0
+	for _, media := range desc.MediaDescriptions {
+		if kind := media.MediaName.Media; kind == "video" || kind == "audio" {
+			sections++
+		}
+		if media.MediaName.Port.Value == 0 {
+			continue
+		}
+		if _, ok := media.Attribute(sdp.AttrKeySendOnly); ok {
+			continue
+		}
+		if _, ok := media.Attribute(sdp.AttrKeyInactive); ok {
+			continue
+		}
+		switch media.MediaName.Media {
+		case "video":
+			video = true
+		case "audio":
+			audio = audio || mediaAcceptsPCMU(media)
+		}
+	}
+	if sections == 0 {
+		return false, false, errOfferWithoutMedia
+	}
+	return video, audio, nil
+}
+
+func mediaAcceptsPCMU(media *sdp.MediaDescription) bool {
+	for _, format := range media.MediaName.Formats {
+		// PCMU has static payload type 0, with or without an rtpmap
+		if format == "0" {
+			return true
+		}
+	}
+	for _, attr := range media.Attributes {
+		if attr.Key != "rtpmap" {
+			continue
+		}
+		if _, encoding, ok := strings.Cut(attr.Value, " "); ok && strings.HasPrefix(strings.ToUpper(encoding), "PCMU/") {
+			return true
+		}
+	}
+	return false
+}
+
+// noCommonCodecError means a viewer's offer shares no codec with the track of
+// kind the proxy sends it.
+type noCommonCodecError struct {
+	kind string
+}
+
+func (e *noCommonCodecError) Error() string {
+	return fmt.Sprintf("no %s codec in common with the offer", e.kind)
+}
+
+// checkAnswerCodecs checks that each section of answer carrying one of the
+// viewer's tracks negotiated the track's codec, H264 or PCMU, with the offer.
+// When the offer doesn't list it, Pion still answers, either rejecting the
+// section or picking another offered codec the track can't send, and the
+// viewer would silently get no media.
+func checkAnswerCodecs(offer, answer string, video, audio bool) error {
+	var offered, answered sdp.SessionDescription
+	if err := offered.Unmarshal([]byte(offer)); err != nil {
+		return err
+	}
+	if err := answered.Unmarshal([]byte(answer)); err != nil {
+		return err
+	}
+	for _, media := range answered.MediaDescriptions {
+		var encoding string
+		switch kind := media.MediaName.Media; {
+		case kind == "video" && video:
+			encoding = "H264/"
+		case kind == "audio" && audio:
+			encoding = "PCMU/"
+		default:
+			continue
+		}
+		mid, _ := media.Attribute(sdp.AttrKeyMID)
+		var offeredMedia *sdp.MediaDescription
+		for _, candidate := range offered.MediaDescriptions {
+			if value, _ := candidate.Attribute(sdp.AttrKeyMID); value == mid {
+				offeredMedia = candidate
+				break
+			}
+		}
+		if media.MediaName.Port.Value == 0 || offeredMedia == nil || !sharesCodec(media, offeredMedia, encoding) {
+			return &noCommonCodecError{media.MediaName.Media}
+		}
+	}
+	return nil
+}
+
+// sharesCodec reports whether an answer's media section uses a payload type
+// with encoding, which the offer's section mapped to the same codec.
+func sharesCodec(answer, offer *sdp.MediaDescription, encoding string) bool {
+	offered := mediaCodecs(offer)
+	for payloadType, codec := range mediaCodecs(answer) {
+		if strings.HasPrefix(codec, encoding) && offered[payloadType] == codec {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaCodecs maps a media section's payload types to their encodings, e.g.
+// "102" to "H264/90000".
+func mediaCodecs(media *sdp.MediaDescription) map[string]string {
+	codecs := make(map[string]string)
+	for _, format := range media.MediaName.Formats {
+		if format == "0" {
+			codecs[format] = "PCMU/8000" // static, with or without an rtpmap
+		}
+	}
+	for _, attr := range media.Attributes {
+		if attr.Key != "rtpmap" {
+			continue
+		}
+		if payloadType, encoding, ok := strings.Cut(attr.Value, " "); ok {
+			codecs[payloadType] = strings.ToUpper(encoding)
+		}
+	}
+	return codecs
+}
+
+// drainAudioRTCP reads an audio-only viewer's RTCP, which stands in for the
+// video RTCP reclaimIdleViewer watches.
+func drainAudioRTCP(viewer *viewerSession, rtpSender *webrtc.RTPSender) {
+	for {
+		if _, _, err := rtpSender.ReadRTCP(); err != nil {
+			return
+		}
+		viewer.lastRTCP.Store(time.Now().UnixNano())
+	}
+}
+
+// observeViewerGathering times a viewer's ICE gathering, which runs once its
+// answer is set, for whep_viewer_gathering_seconds.
+func observeViewerGathering(gatherComplete <-chan struct{}) {
+	started := time.Now()
+	<-gatherComplete
+	udpMux := "none"
+	if viewerUDPMux != nil {
+		udpMux = "shared"
+	}
+	viewerGatheringSeconds.WithLabelValues(udpMux).Observe(time.Since(started).Seconds())
+}
+
+// ssrcSource describes a track sent to a viewer, for answerSSRCLines.
+type ssrcSource struct {
+	ssrc    webrtc.SSRC
+	rtxSSRC webrtc.SSRC // 0 without RTX
+	cname   string
+	msid    string // "{stream} {track}"
+}
+
+// viewerSSRCSources lists the tracks a viewer is sent, by the mid of their
+// media section.
+func viewerSSRCSources(peerConnection *webrtc.PeerConnection) map[string]ssrcSource {
+	sources := make(map[string]ssrcSource)
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		sender := transceiver.Sender()
+		if sender == nil || sender.Track() == nil || transceiver.Mid() == "" {
+			continue
+		}
+		encodings := sender.GetParameters().Encodings
+		if len(encodings) == 0 {
+			continue
+		}
+		track := sender.Track()
+		cname := track.StreamID()
+		if rtcpCNAME != "" {
+			cname = viewerCNAME(track.StreamID())
+		}
+		sources[transceiver.Mid()] = ssrcSource{
+			ssrc:    encodings[0].SSRC,
+			rtxSSRC: encodings[0].RTX.SSRC,
+			cname:   cname,
+			msid:    track.StreamID() + " " + track.ID(),
+		}
+	}
+	return sources
+}
+
+// addSSRCLines adds a=ssrc lines, with an a=ssrc-group for RTX, to the media
+// sections of an answer that have a source but none, for WHEP_ANSWER_SSRC_LINES.
+// Sections that already have them are left as they are.
+func addSSRCLines(answer string, sources map[string]ssrcSource) (string, error) {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(answer)); err != nil {
+		return "", err
+	}
+	for _, media := range desc.MediaDescriptions {
+		mid, _ := media.Attribute(sdp.AttrKeyMID)
+		source, ok := sources[mid]
+		if _, hasSSRC := media.Attribute(sdp.AttrKeySSRC); !ok || hasSSRC {
+			continue
+		}
+		ssrcs := []webrtc.SSRC{source.ssrc}
+		if source.rtxSSRC != 0 {
+			ssrcs = append(ssrcs, source.rtxSSRC)
+			media.WithValueAttribute(sdp.AttrKeySSRCGroup, fmt.Sprintf("%s %d %d", sdp.SemanticTokenFlowIdentification, source.ssrc, source.rtxSSRC))
+		}
+		for _, ssrc := range ssrcs {
+			media.WithValueAttribute(sdp.AttrKeySSRC, fmt.Sprintf("%d cname:%s", ssrc, source.cname))
+			media.WithValueAttribute(sdp.AttrKeySSRC, fmt.Sprintf("%d msid:%s", ssrc, source.msid))
+		}
+	}
+	out, err := desc.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// resource is the WHEP session URL returned to the client in Location.
+func (v *viewerSession) resource(streamID string) string {
+	return fmt.Sprintf("/whep/%s/%s", streamID, v.id)
+}
+
+func newViewerID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+var (
+	errStreamClosed   = errors.New("stream closed")
+	errTooManyViewers = errors.New("too many viewers")
+	// A datachannel-only or empty offer, which is junk or a probe
+	errOfferWithoutMedia = errors.New("offer has no audio or video section")
+)
+
+// addViewer registers a viewer, unless the stream was cleaned up meanwhile or
+// is at WHEP_MAX_VIEWERS_PER_STREAM.
+func (s *WebRTCStream) addViewer(viewer *viewerSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStreamClosed
+	}
+	if maxViewersPerStream > 0 && len(s.viewers) >= int(maxViewersPerStream) {
+		return errTooManyViewers
+	}
+	if s.viewers == nil {
+		s.viewers = make(map[string]*viewerSession)
+	}
+	s.viewers[viewer.id] = viewer
+	viewer.queue = make(chan *rtp.Packet, viewerBacklog)
+	if viewer.track != nil {
+		go viewer.writeVideo(viewer.queue)
+	}
+	return nil
+}
+
+func (s *WebRTCStream) isFull() bool {
+	if maxViewersPerStream <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.viewers) >= int(maxViewersPerStream)
+}
+
+func (s *WebRTCStream) ingestFailure() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failure
+}
+
+func (s *WebRTCStream) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *WebRTCStream) viewer(id string) (*viewerSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	viewer, ok := s.viewers[id]
+	return viewer, ok
+}
+
+func (s *WebRTCStream) removeViewer(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if viewer, ok := s.viewers[id]; ok {
+		delete(s.viewers, id)
+		close(viewer.queue)
+	}
+}
+
+// forwardRTP fans an ingest packet out to every viewer's queue, and to HLS
+// and RTSP, and keeps it in the GOP cache.
+// A viewer whose queue is full has its backlog dropped and skips ahead to the
+// start of the next keyframe, so it resyncs cleanly instead of decoding a
+// broken frame. Packets are forwarded whole, with their marker bits, so
+// access units and FU-A fragments reach viewers as the camera sent them.
+func (s *WebRTCStream) forwardRTP(pkt *rtp.Packet) {
+	if s.hls != nil {
+		s.hls.writeRTP(pkt)
+	}
+	// Extension IDs were negotiated with the camera and mean nothing to
+	// viewers. Dropping them also keeps the viewers' writers, which run
+	// concurrently, from sharing a mutable slice.
+	pkt.Extension = false
+	pkt.Extensions = nil
+	if s.rtsp != nil {
+		s.rtsp.writeVideo(pkt)
+	}
+	keyframe := h264PacketIsKeyframe(pkt.Payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gop != nil {
+		s.gop.add(pkt, keyframe)
+	}
+	// A keyframe can span several packets with the same timestamp: its
+	// SPS/PPS and each of its IDR slices, FU-A fragmented. Only the first
+	// is a clean place to start decoding.
+	keyframeStart := keyframe && (!s.keyframeSeen || pkt.Timestamp != s.keyframe)
+	if keyframeStart {
+		s.keyframe, s.keyframeSeen = pkt.Timestamp, true
+	}
+	for _, viewer := range s.viewers {
+		if viewer.track == nil {
+			continue
+		}
+		if viewer.resyncing {
+			if !keyframeStart {
+				continue
+			}
+			viewer.resyncing = false
+		}
+		select {
+		case viewer.queue <- pkt:
+		default:
+			viewer.resync()
+		}
+	}
+}
+
+// resync drops a lagging viewer's backlog and waits for a keyframe. The
+// caller must hold the stream's mu.
+func (v *viewerSession) resync() {
+	v.resyncing = true
+	v.resyncs.Add(1)
+	viewerResyncs.Inc()
+	for {
+		select {
+		case <-v.queue:
+		default:
+			logDebugf("Viewer %s fell %d packets behind, skipping to the next keyframe", v.id, viewerBacklog)
+			return
+		}
+	}
+}
+
+// writeVideo sends a viewer's queued video until the queue is closed. The
+// track's WriteRTP stamps each packet with the payload type and SSRC the
+// viewer negotiated, so viewers that chose other than the ingest's H264
+// payload type 102 get packets they accept. Viewers under impairment testing
+// have it applied here.
+func (v *viewerSession) writeVideo(queue <-chan *rtp.Packet) {
+	if v.impairment != nil {
+		queue = v.impairment.apply(queue)
+	}
+	for pkt := range queue {
+		if err := v.track.WriteRTP(pkt); err != nil {
+			continue
+		}
+		v.packets.Add(1)
+		v.bytes.Add(uint64(pkt.MarshalSize()))
+	}
+}
+
+// forwardAudioRTP fans an ingest audio packet out to the viewers that
+// negotiated audio.
+func (s *WebRTCStream) forwardAudioRTP(pkt *rtp.Packet) {
+	size := uint64(pkt.MarshalSize())
+	if s.rtsp != nil {
+		s.rtsp.writeAudio(pkt)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, viewer := range s.viewers {
+		if viewer.audioTrack == nil {
+			continue
+		}
+		if err := viewer.audioTrack.WriteRTP(pkt); err != nil {
+			continue
+		}
+		viewer.packets.Add(1)
+		viewer.bytes.Add(size)
+	}
+}
+
+func (s *WebRTCStream) viewerStats() []viewerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]viewerStats, 0, len(s.viewers))
+	for _, viewer := range s.viewers {
+		stats = append(stats, viewerStats{
+			ID:      viewer.id,
+			Packets: viewer.packets.Load(),
+			Bytes:   viewer.bytes.Load(),
+			Resyncs: viewer.resyncs.Load(),
+		})
+	}
+	return stats
+}
+
+// summary totals a viewer's session. Call it before closing the connection,
+// while GetStats still has the candidate pair.
+func (v *viewerSession) summary() viewerSummary {
+	summary := viewerSummary{
+		ID:              v.id,
+		DurationSeconds: time.Since(v.connectedAt).Seconds(),
+		Packets:         v.packets.Load(),
+		Bytes:           v.bytes.Load(),
+		PacketsLost:     v.packetsLost.Load(),
+		Resyncs:         v.resyncs.Load(),
+	}
+	for _, stat := range v.peerConnection.GetStats() {
+		if pair, ok := stat.(webrtc.ICECandidatePairStats); ok && pair.Nominated {
+			summary.RoundTripTime = pair.CurrentRoundTripTime
+		}
+	}
+	return summary
+}
+
+func (s *WebRTCStream) viewerInfo(streamID string) []viewerInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := make([]viewerInfo, 0, len(s.viewers))
+	for _, viewer := range s.viewers {
+		info = append(info, viewerInfo{
+			ID:          viewer.id,
+			Resource:    viewer.resource(streamID),
+			RemoteAddr:  viewer.remoteAddr,
+			ConnectedAt: viewer.connectedAt,
+		})
+	}
+	return info
+}
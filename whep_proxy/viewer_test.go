@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+// registerH264 registers only H264, as the proxy's ingest offers it.
+func registerH264(m *webrtc.MediaEngine) error {
+	return m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: defaultH264Fmtp},
+		PayloadType:        102,
+	}, webrtc.RTPCodecTypeVideo)
+}
+
+// registerH264Opus registers H264 and, for audio, only Opus.
+func registerH264Opus(m *webrtc.MediaEngine) error {
+	if err := registerH264(m); err != nil {
+		return err
+	}
+	return m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio)
+}
+
+func TestMediaAcceptsPCMU(t *testing.T) {
+	tests := []struct {
+		name  string
+		media string
+		want  bool
+	}{
+		{"static payload type", "m=audio 9 UDP/TLS/RTP/SAVPF 111 0\r\na=rtpmap:111 opus/48000/2\r\n", true},
+		{"dynamic payload type", "m=audio 9 UDP/TLS/RTP/SAVPF 96\r\na=rtpmap:96 pcmu/8000\r\n", true},
+		{"opus only", "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=rtpmap:111 opus/48000/2\r\n", false},
+		{"PCMA only", "m=audio 9 UDP/TLS/RTP/SAVPF 8\r\na=rtpmap:8 PCMA/8000\r\n", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var desc sdp.SessionDescription
+			if err := desc.Unmarshal([]byte("v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n" + test.media)); err != nil {
+				t.Fatal(err)
+			}
+			if got := mediaAcceptsPCMU(desc.MediaDescriptions[0]); got != test.want {
+				t.Errorf("mediaAcceptsPCMU = %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+// A viewer that can't take the camera's PCMU is answered without audio, and
+// still gets video.
+func TestOpusOnlyViewerGetsVideo(t *testing.T) {
+	camera := newFakeCamera(t, func(c *fakeCamera) { c.audio = true })
+	stream := registerStream(t, "opus-only-viewer", camera)
+	waitForIngest(t, stream)
+
+	viewer := newCustomTestViewer(t, registerH264Opus, webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio)
+	recorder := viewer.offer(t, testRouter(), "opus-only-viewer")
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("offer returned %d: %s", recorder.Code, recorder.Body)
+	}
+	if answer := recorder.Body.String(); strings.Contains(answer, "PCMU") {
+		t.Errorf("answer offers PCMU the viewer can't take:\n%s", answer)
+	}
+	viewer.waitForPackets(t, 10, 5*time.Second)
+	select {
+	case <-viewer.audio:
+		t.Error("viewer got audio it can't decode")
+	default:
+	}
+}
+
+func TestPCMUViewerGetsAudio(t *testing.T) {
+	camera := newFakeCamera(t, func(c *fakeCamera) { c.audio = true })
+	stream := registerStream(t, "pcmu-viewer", camera)
+	waitForIngest(t, stream)
+
+	viewer := newCustomTestViewer(t, nil, webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio)
+	if recorder := viewer.offer(t, testRouter(), "pcmu-viewer"); recorder.Code != http.StatusCreated {
+		t.Fatalf("offer returned %d: %s", recorder.Code, recorder.Body)
+	}
+	viewer.waitForPackets(t, 10, 5*time.Second)
+	select {
+	case <-viewer.audio:
+	case <-time.After(5 * time.Second):
+		t.Error("viewer got no audio")
+	}
+}
+
+// Packets reach a viewer under the payload type it negotiated, not the
+// ingest's.
+func TestViewerGetsItsOwnPayloadType(t *testing.T) {
+	camera := newFakeCamera(t, nil)
+	stream := registerStream(t, "viewer-payload-type", camera)
+	waitForIngest(t, stream)
+
+	registerH264As96 := func(m *webrtc.MediaEngine) error {
+		return m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: defaultH264Fmtp},
+			PayloadType:        96,
+		}, webrtc.RTPCodecTypeVideo)
+	}
+	viewer := newCustomTestViewer(t, registerH264As96, webrtc.RTPCodecTypeVideo)
+	recorder := viewer.offer(t, testRouter(), "viewer-payload-type")
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("offer returned %d: %s", recorder.Code, recorder.Body)
+	}
+	if answer := recorder.Body.String(); !strings.Contains(answer, "a=rtpmap:96 H264/90000") {
+		t.Errorf("answer doesn't map H264 to 96:\n%s", answer)
+	}
+	for _, pkt := range viewer.waitForPackets(t, 10, 5*time.Second) {
+		if pkt.PayloadType != 96 {
+			t.Fatalf("packet %d has payload type %d, want 96", pkt.SequenceNumber, pkt.PayloadType)
+		}
+	}
+}
+
+func TestAddSSRCLines(t *testing.T) {
+	const header = "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"
+	sources := map[string]ssrcSource{
+		"0": {ssrc: 1111, rtxSSRC: 2222, cname: "proxy", msid: "stream video"},
+		"1": {ssrc: 3333, cname: "proxy", msid: "stream audio"},
+	}
+	tests := []struct {
+		name   string
+		answer string
+		want   string
+	}{
+		{
+			"video with RTX",
+			header + "m=video 9 UDP/TLS/RTP/SAVPF 102 103\r\na=mid:0\r\na=sendonly\r\n",
+			header + "m=video 9 UDP/TLS/RTP/SAVPF 102 103\r\na=mid:0\r\na=sendonly\r\n" +
+				"a=ssrc-group:FID 1111 2222\r\n" +
+				"a=ssrc:1111 cname:proxy\r\na=ssrc:1111 msid:stream video\r\n" +
+				"a=ssrc:2222 cname:proxy\r\na=ssrc:2222 msid:stream video\r\n",
+		},
+		{
+			"audio without RTX",
+			header + "m=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:1\r\na=sendonly\r\n",
+			header + "m=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:1\r\na=sendonly\r\n" +
+				"a=ssrc:3333 cname:proxy\r\na=ssrc:3333 msid:stream audio\r\n",
+		},
+		{
+			"already has SSRC lines",
+			header + "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=mid:0\r\na=ssrc:42 cname:other\r\n",
+			header + "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=mid:0\r\na=ssrc:42 cname:other\r\n",
+		},
+		{
+			"no source",
+			header + "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=mid:2\r\na=inactive\r\n",
+			header + "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=mid:2\r\na=inactive\r\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := addSSRCLines(test.answer, sources)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("addSSRCLines =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+	if _, err := addSSRCLines("not SDP", sources); err == nil {
+		t.Error("addSSRCLines accepted an answer that isn't SDP")
+	}
+}
+
+func TestOfferMedia(t *testing.T) {
+	const header = "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"
+	const (
+		video = "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=rtpmap:102 H264/90000\r\n"
+		pcmu  = "m=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=rtpmap:0 PCMU/8000\r\n"
+		opus  = "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=rtpmap:111 opus/48000/2\r\n"
+	)
+	tests := []struct {
+		name                 string
+		media                string
+		wantVideo, wantAudio bool
+	}{
+		{"video and audio", video + pcmu, true, true},
+		{"video only", video, true, false},
+		{"audio only", pcmu, false, true},
+		{"audio it can't take", opus, false, false},
+		{"inactive video", video + "a=inactive\r\n" + pcmu, false, true},
+		{"inactive audio", video + pcmu + "a=inactive\r\n", true, false},
+		{"sendonly video", video + "a=sendonly\r\n", false, false},
+		{"rejected video", "m=video 0 UDP/TLS/RTP/SAVPF 102\r\n" + pcmu, false, true},
+		{"recvonly video", video + "a=recvonly\r\n", true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gotVideo, gotAudio, err := offerMedia(header + test.media)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotVideo != test.wantVideo || gotAudio != test.wantAudio {
+				t.Errorf("offerMedia = video %t audio %t, want video %t audio %t", gotVideo, gotAudio, test.wantVideo, test.wantAudio)
+			}
+		})
+	}
+}
+
+// An audio-only viewer is answered with audio only, and gets the camera's.
+func TestAudioOnlyViewer(t *testing.T) {
+	camera := newFakeCamera(t, func(c *fakeCamera) { c.audio = true })
+	stream := registerStream(t, "audio-only-viewer", camera)
+	waitForIngest(t, stream)
+
+	viewer := newCustomTestViewer(t, nil, webrtc.RTPCodecTypeAudio)
+	recorder := viewer.offer(t, testRouter(), "audio-only-viewer")
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("offer returned %d: %s", recorder.Code, recorder.Body)
+	}
+	if answer := recorder.Body.String(); strings.Contains(answer, "m=video") {
+		t.Errorf("answer to an audio-only offer has video:\n%s", answer)
+	}
+	select {
+	case <-viewer.audio:
+	case <-time.After(5 * time.Second):
+		t.Error("viewer got no audio")
+	}
+}
+
+// FU-A fragments and marker bits reach viewers as the camera sent them, with
+// the inline parameter sets once ahead of a multi-slice keyframe.
+func TestViewerGetsAccessUnitsIntact(t *testing.T) {
+	fmtp := regexp.MustCompile(`(a=fmtp:\d+ [^\r]*packetization-mode=1[^\r]*)`)
+	camera := newFakeCamera(t, func(c *fakeCamera) {
+		c.fragmented = true
+		c.answerSDP = func(sdp string) string { return fmtp.ReplaceAllString(sdp, "$1;"+testSprop) }
+	})
+	stream := registerStream(t, "access-units-intact", camera)
+	waitForIngest(t, stream)
+
+	viewer := newTestViewer(t)
+	if recorder := viewer.offer(t, testRouter(), "access-units-intact"); recorder.Code != http.StatusCreated {
+		t.Fatalf("offer returned %d: %s", recorder.Code, recorder.Body)
+	}
+	// Over two seconds of frames, so at least one whole keyframe
+	pkts := viewer.waitForPackets(t, 200, 10*time.Second)
+	for i := 1; i < len(pkts); i++ {
+		if pkts[i].SequenceNumber != pkts[i-1].SequenceNumber+1 {
+			t.Fatalf("seq jumped from %d to %d", pkts[i-1].SequenceNumber, pkts[i].SequenceNumber)
+		}
+	}
+
+	var frames [][]*rtp.Packet
+	for i, pkt := range pkts {
+		if i == 0 || pkt.Timestamp != pkts[i-1].Timestamp {
+			frames = append(frames, nil)
+		}
+		frames[len(frames)-1] = append(frames[len(frames)-1], pkt)
+	}
+	// The first and last frames may be cut short
+	keyframes := 0
+	for _, frame := range frames[1 : len(frames)-1] {
+		index := int(frame[0].Timestamp / 3000)
+		if index%30 == 0 {
+			keyframes++
+			if frame[0].Payload[0]&0x1f != 24 || frame[0].Marker {
+				t.Errorf("keyframe %d doesn't start with parameter sets", index)
+				continue
+			}
+			frame = frame[1:]
+		}
+		want := fragmentedFrame(index)
+		if len(frame) != len(want) {
+			t.Errorf("frame %d has %d packets, want %d", index, len(frame), len(want))
+			continue
+		}
+		for n, pkt := range frame {
+			if !bytes.Equal(pkt.Payload, want[n]) {
+				t.Errorf("frame %d packet %d = %x, want %x", index, n, pkt.Payload, want[n])
+			}
+			if pkt.Marker != (n == len(frame)-1) {
+				t.Errorf("frame %d packet %d has marker %t", index, n, pkt.Marker)
+			}
+		}
+	}
+	if keyframes == 0 {
+		t.Error("no whole keyframe arrived")
+	}
+}
+
+func TestCheckAnswerCodecs(t *testing.T) {
+	const header = "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"
+	const (
+		h264     = "m=video 9 UDP/TLS/RTP/SAVPF 102\r\na=mid:0\r\na=rtpmap:102 H264/90000\r\n"
+		vp8      = "m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:0\r\na=rtpmap:96 VP8/90000\r\n"
+		pcmu     = "m=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:1\r\n"
+		opus     = "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:1\r\na=rtpmap:111 opus/48000/2\r\n"
+		rejected = "m=video 0 UDP/TLS/RTP/SAVPF 96\r\na=mid:0\r\na=rtpmap:96 VP8/90000\r\n"
+	)
+	tests := []struct {
+		name          string
+		offer, answer string
+		video, audio  bool
+		wantKind      string // empty for no error
+	}{
+		{"H264 and PCMU", h264 + pcmu, h264 + pcmu, true, true, ""},
+		{"answered another codec", vp8, vp8, true, false, "video"},
+		{"rejected video", vp8, rejected, true, false, "video"},
+		{"answered H264 the offer lacks", vp8, h264, true, false, "video"},
+		{"audio without PCMU", h264 + opus, h264 + opus, true, true, "audio"},
+		{"audio not sent", h264 + opus, h264 + opus, true, false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkAnswerCodecs(header+test.offer, header+test.answer, test.video, test.audio)
+			var noCommonCodec *noCommonCodecError
+			switch {
+			case test.wantKind == "" && err != nil:
+				t.Errorf("checkAnswerCodecs = %v, want nil", err)
+			case test.wantKind != "" && !errors.As(err, &noCommonCodec):
+				t.Errorf("checkAnswerCodecs = %v, want a noCommonCodecError", err)
+			case test.wantKind != "" && noCommonCodec.kind != test.wantKind:
+				t.Errorf("no common %s codec, want %s", noCommonCodec.kind, test.wantKind)
+			}
+		})
+	}
+}
+
+// A viewer offering only VP8 is refused with 422 rather than answered with
+// video it can't decode.
+func TestVP8OnlyViewerRefused(t *testing.T) {
+	stream := registerStream(t, "vp8-only-viewer", newFakeCamera(t, nil))
+	waitForIngest(t, stream)
+
+	registerVP8 := func(m *webrtc.MediaEngine) error {
+		return m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			PayloadType:        96,
+		}, webrtc.RTPCodecTypeVideo)
+	}
+	viewer := newCustomTestViewer(t, registerVP8, webrtc.RTPCodecTypeVideo)
+	recorder := viewer.offer(t, testRouter(), "vp8-only-viewer")
+	if recorder.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("offer returned %d, want 422: %s", recorder.Code, recorder.Body)
+	}
+	if !strings.Contains(recorder.Body.String(), "no video codec in common") {
+		t.Errorf("body = %q, want it to name video", recorder.Body)
+	}
+	if viewers := stream.viewerStats(); len(viewers) != 0 {
+		t.Errorf("stream kept %d viewers", len(viewers))
+	}
+}
+
+func TestOfferWithoutMedia(t *testing.T) {
+	const header = "v=0\r\no=- 0 0 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n"
+	for name, offer := range map[string]string{
+		"empty":            header,
+		"datachannel only": header + "m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\na=mid:0\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := offerMedia(offer); !errors.Is(err, errOfferWithoutMedia) {
+				t.Errorf("offerMedia = %v, want %v", err, errOfferWithoutMedia)
+			}
+		})
+	}
+}
+
+// A datachannel-only offer is refused with 400, before any PeerConnection is
+// set up for it.
+func TestDatachannelOnlyViewerRefused(t *testing.T) {
+	stream := registerStream(t, "datachannel-only-viewer", newFakeCamera(t, nil))
+	waitForIngest(t, stream)
+
+	viewer := newCustomTestViewer(t, nil)
+	if _, err := viewer.peerConnection.CreateDataChannel("probe", nil); err != nil {
+		t.Fatal(err)
+	}
+	recorder := viewer.offer(t, testRouter(), "datachannel-only-viewer")
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("offer returned %d, want 400: %s", recorder.Code, recorder.Body)
+	}
+	if !strings.Contains(recorder.Body.String(), "no audio or video section") {
+		t.Errorf("body = %q, want it to say the offer has no media", recorder.Body)
+	}
+	if viewers := stream.viewerStats(); len(viewers) != 0 {
+		t.Errorf("stream kept %d viewers", len(viewers))
+	}
+}
+
+// answerViewer registers streamID on a fake camera, with audio if audio is
+// set, and returns the answer to a default viewer receiving video and audio.
+func answerViewer(t *testing.T, streamID string, audio bool) *sdp.SessionDescription {
+	t.Helper()
+	camera := newFakeCamera(t, func(c *fakeCamera) { c.audio = audio })
+	stream := registerStream(t, streamID, camera)
+	waitForIngest(t, stream)
+
+	viewer := newCustomTestViewer(t, nil, webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio)
+	recorder := viewer.offer(t, testRouter(), streamID)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("offer returned %d: %s", recorder.Code, recorder.Body)
+	}
+	var answer sdp.SessionDescription
+	if err := answer.Unmarshal(recorder.Body.Bytes()); err != nil {
+		t.Fatalf("parsing answer: %v", err)
+	}
+	return &answer
+}
+
+// attributeValues returns the values of every key attribute in attributes.
+func attributeValues(attributes []sdp.Attribute, key string) []string {
+	var values []string
+	for _, attribute := range attributes {
+		if attribute.Key == key {
+			values = append(values, attribute.Value)
+		}
+	}
+	return values
+}
+
+// The answer lets viewers NACK lost packets and request keyframes, by PLI or
+// FIR, on the H264 they're sent.
+func TestAnswerAdvertisesKeyframeFeedback(t *testing.T) {
+	answer := answerViewer(t, "answer-feedback", false)
+	video := answer.MediaDescriptions[0]
+	var payloadType string
+	for _, rtpmap := range attributeValues(video.Attributes, "rtpmap") {
+		if format, codec, _ := strings.Cut(rtpmap, " "); codec == "H264/90000" {
+			payloadType = format
+			break
+		}
+	}
+	if payloadType == "" {
+		t.Fatal("answer has no H264")
+	}
+
+	feedback := make(map[string]bool)
+	for _, value := range attributeValues(video.Attributes, "rtcp-fb") {
+		if fields := strings.Fields(value); fields[0] == payloadType {
+			feedback[strings.Join(fields[1:], " ")] = true
+		}
+	}
+	for _, want := range []string{"nack", "nack pli", "ccm fir"} {
+		if !feedback[want] {
+			t.Errorf("answer lacks a=rtcp-fb:%s %s", payloadType, want)
+		}
+	}
+	if !feedback["goog-remb"] && !feedback["transport-cc"] {
+		t.Errorf("answer has neither goog-remb nor transport-cc for %s", payloadType)
+	}
+}
+
+// With WHEP_FORCE_BUNDLE the answer bundles every section onto rtcp-mux.
+func TestForcedBundleAnswer(t *testing.T) {
+	defer func(force bool) { viewerForceBundle = force }(viewerForceBundle)
+	viewerForceBundle = true
+
+	answer := answerViewer(t, "forced-bundle", true)
+	if len(answer.MediaDescriptions) != 2 {
+		t.Fatalf("answer has %d sections, want video and audio", len(answer.MediaDescriptions))
+	}
+	var mids []string
+	for _, media := range answer.MediaDescriptions {
+		mid, _ := media.Attribute("mid")
+		mids = append(mids, mid)
+		if _, ok := media.Attribute("rtcp-mux"); !ok {
+			t.Errorf("%s section %s lacks a=rtcp-mux", media.MediaName.Media, mid)
+		}
+	}
+	groups := attributeValues(answer.Attributes, "group")
+	if len(groups) != 1 {
+		t.Fatalf("answer has groups %q, want one BUNDLE", groups)
+	}
+	if want := "BUNDLE " + strings.Join(mids, " "); groups[0] != want {
+		t.Errorf("a=group:%s, want a=group:%s", groups[0], want)
+	}
+}
+
+// With WHEP_DISABLE_AUDIO the ingest offers video alone, and a viewer
+// offering audio too is answered with its audio section rejected or inactive.
+func TestDisabledAudioAnswer(t *testing.T) {
+	// Restored after the stream is removed, which registers its cleanup later
+	disabled := disableAudio
+	t.Cleanup(func() { disableAudio = disabled })
+	disableAudio = true
+
+	answer := answerViewer(t, "disabled-audio", false)
+	stream, _ := getStream("disabled-audio")
+	stream.mu.Lock()
+	offer := stream.peerConnection.LocalDescription().SDP
+	stream.mu.Unlock()
+	if strings.Contains(offer, "m=audio") {
+		t.Errorf("ingest offer has audio:\n%s", offer)
+	}
+
+	for _, media := range answer.MediaDescriptions {
+		if media.MediaName.Media != "audio" {
+			continue
+		}
+		if _, inactive := media.Attribute("inactive"); media.MediaName.Port.Value != 0 && !inactive {
+			t.Errorf("answer accepts audio on port %d with %v", media.MediaName.Port.Value, media.MediaName.Formats)
+		}
+	}
+}
+
+// WHEP_DTLS_ROLE picks the a=setup answered to an actpass offer.
+func TestViewerDTLSRole(t *testing.T) {
+	defer func(role webrtc.DTLSRole) { viewerDTLSRole = role }(viewerDTLSRole)
+	tests := []struct {
+		name  string
+		role  webrtc.DTLSRole
+		setup string
+	}{
+		{"auto", webrtc.DTLSRoleAuto, "active"},
+		{"client", webrtc.DTLSRoleClient, "active"},
+		{"server", webrtc.DTLSRoleServer, "passive"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viewerDTLSRole = test.role
+			answer := answerViewer(t, "dtls-role-"+test.name, false)
+			for _, media := range answer.MediaDescriptions {
+				if setup, _ := media.Attribute("setup"); setup != test.setup {
+					t.Errorf("%s section has a=setup:%s, want %s", media.MediaName.Media, setup, test.setup)
+				}
+			}
+		})
+	}
+}
+
+// Video and audio are answered under one msid stream, the WHEP stream ID, so
+// players put them on the same media element.
+func TestAnswerGroupsMediaInOneStream(t *testing.T) {
+	answer := answerViewer(t, "one-msid-stream", true)
+	if len(answer.MediaDescriptions) != 2 {
+		t.Fatalf("answer has %d sections, want video and audio", len(answer.MediaDescriptions))
+	}
+	for _, media := range answer.MediaDescriptions {
+		msid, ok := media.Attribute("msid")
+		if !ok {
+			t.Errorf("%s section has no a=msid", media.MediaName.Media)
+			continue
+		}
+		if stream, track, _ := strings.Cut(msid, " "); stream != "one-msid-stream" || track != media.MediaName.Media {
+			t.Errorf("%s section has a=msid:%s, want one-msid-stream %s", media.MediaName.Media, msid, media.MediaName.Media)
+		}
+	}
+}
+
+// A relay-only viewer policy answers no host or server reflexive candidates,
+// here none at all as there's no TURN server to relay through.
+func TestRelayOnlyViewerCandidates(t *testing.T) {
+	defer func(policy webrtc.ICETransportPolicy) { viewerICEPolicy = policy }(viewerICEPolicy)
+	viewerICEPolicy = webrtc.ICETransportPolicyRelay
+
+	answer := answerViewer(t, "relay-only-viewer", false)
+	for _, media := range answer.MediaDescriptions {
+		for _, candidate := range attributeValues(media.Attributes, "candidate") {
+			if !strings.Contains(candidate, " typ relay") {
+				t.Errorf("relay-only answer has candidate %q", candidate)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Stream lifecycle events sent to the event webhook
+const (
+	eventConnected    = "connected"
+	eventDisconnected = "disconnected"
+	eventFailed       = "failed"
+	eventDead         = "dead"
+	eventReaped       = "reaped"
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+type streamEvent struct {
+	StreamID  string    `json:"streamID"`
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// notifyStreamEvent records a lifecycle event on the stream's timeline and
+// posts it to the stream's webhook, falling back to WHEP_EVENT_WEBHOOK. It
+// never blocks the caller.
+func notifyStreamEvent(streamID string, stream *WebRTCStream, event string) {
+	stream.recordEvent(streamID, event, "")
+	webhookURL := stream.config.WebhookURL
+	if webhookURL == "" {
+		webhookURL = eventWebhook
+	}
+	if webhookURL == "" {
+		return
+	}
+
+	body, err := json.Marshal(streamEvent{StreamID: streamID, Event: event, Timestamp: time.Now()})
+	if err != nil {
+		return
+	}
+	go func() {
+		resp, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			fmt.Printf("[WHEP_PROXY] Error sending %s event for stream %s: %v\n", event, streamID, err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}